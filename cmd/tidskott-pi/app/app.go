@@ -4,31 +4,53 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 
 	"github.com/alesr/tidskott-pi/cmd/tidskott-pi/components"
+	"github.com/alesr/tidskott-pi/internal/pkg/config"
 )
 
 func Run() error {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "enroll":
+			return runEnroll(os.Args[2:])
+		case "audit":
+			return runAudit(os.Args[2:])
+		case "config":
+			return runConfig(os.Args[2:])
+		}
+	}
+
 	flags, err := parseFlags()
 	if err != nil {
 		return fmt.Errorf("could not parse flags: %w", err)
 	}
 
-	cfg, err := loadConfig(flags.ConfigPath)
+	cfg, err := loadConfig(flags.ConfigPath, flags.Overrides)
 	if err != nil {
 		return fmt.Errorf("could not load config: %w", err)
 	}
 
-	logger, logFile, err := setupLogger()
+	var level slog.LevelVar
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		return fmt.Errorf("could not set log level: %w", err)
+	}
+	logger, logFile, err := setupLogger(&level)
 	if err != nil {
 		return fmt.Errorf("could not set up logger: %w", err)
 	}
 	defer logFile.Close()
 
+	for _, warning := range cfg.Warnings {
+		logger.Warn("Configuration warning", "warning", warning)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -40,6 +62,11 @@ func Run() error {
 		cancel()
 	}()
 
+	// registered early so a SIGHUP during startup does not stop the process
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+
 	videoBuffer, err := components.NewVideoBuffer(
 		logger,
 		cfg.Buffer.WindowSeconds,
@@ -60,29 +87,61 @@ func Run() error {
 	}
 	defer stopVideoBuffer(videoBuffer, logger)
 
-	uploader, err := components.NewUploader(
-		logger,
-		cfg.Upload.Endpoint,
-		cfg.Upload.MaxRetries,
-		cfg.Upload.MaxConcurrent,
-		cfg.Upload.DeleteAfterUpload,
-		cfg.Auth.Enabled,
-		cfg.Auth.Endpoint,
-		cfg.Auth.ClientID,
-		cfg.Auth.ClientSecret,
-	)
+	hubClient, err := newHubClient(cfg, logger)
+	if err != nil {
+		return fmt.Errorf("could not create hub client: %w", err)
+	}
+
+	tokens := newTokenManager(cfg, hubClient, logger)
+
+	uploader, err := newUploader(cfg, hubClient, tokens, logger)
 	if err != nil {
 		return fmt.Errorf("could not create uploader: %w", err)
 	}
+
+	if tokens != nil {
+		tokens.Start(ctx)
+		defer tokens.Stop()
+	}
 	defer stopUploader(uploader, logger)
 
 	if err := uploader.Start(); err != nil {
 		return fmt.Errorf("could not start uploader: %w", err)
 	}
 
+	events := components.NewEvents(cfg.Device.ID)
+
+	if cfg.Audit.Enabled {
+		auditLog, err := components.NewAuditLog(
+			logger,
+			cfg.Audit.File,
+			cfg.Audit.MaxSizeMB*1024*1024,
+			cfg.Audit.MaxFiles,
+			events,
+		)
+		if err != nil {
+			return fmt.Errorf("could not create audit log: %w", err)
+		}
+		defer auditLog.Close()
+	}
+
+	var spool *components.Spool
+	if cfg.Spool.Enabled {
+		spool, err = components.NewSpool(
+			logger,
+			cfg.Spool.Dir,
+			time.Duration(cfg.Spool.RetryIntervalSeconds)*time.Second,
+		)
+		if err != nil {
+			return fmt.Errorf("could not create spool: %w", err)
+		}
+	}
+
 	snapshotHandler := components.NewSnapshotHandler(
 		videoBuffer,
 		uploader,
+		events,
+		spool,
 		time.Duration(cfg.Buffer.SnapshotInterval)*time.Second,
 		cfg.Device.ID,
 		cfg.Device.Name,
@@ -91,8 +150,152 @@ func Run() error {
 		cfg.Camera.Height,
 		logger,
 	)
+
+	if cfg.Tamper.Enabled {
+		snapshotHandler.AddAnalyzer(components.NewTamperDetector(
+			logger,
+			cfg.Tamper.MinBrightness,
+			cfg.Tamper.MinContrast,
+			cfg.Tamper.DefocusRatio,
+			cfg.Tamper.MinSimilarity,
+			cfg.Tamper.TriggerSnapshot,
+			snapshotHandler,
+			events,
+		))
+	}
+
+	if cfg.Inference.Enabled {
+		inference, err := components.NewInference(
+			logger,
+			cfg.Inference.Mode,
+			cfg.Inference.Endpoint,
+			cfg.Inference.Command,
+			cfg.Inference.Input,
+			time.Duration(cfg.Inference.TimeoutSeconds)*time.Second,
+			cfg.Inference.MinConfidence,
+			cfg.Inference.Labels,
+			cfg.Inference.DropUnmatched,
+		)
+		if err != nil {
+			return fmt.Errorf("could not create inference hook: %w", err)
+		}
+		snapshotHandler.AddAnalyzer(inference)
+	}
+
+	if cfg.Encryption.Enabled {
+		encryptor, err := components.NewEncryptor(cfg.Encryption.Recipient)
+		if err != nil {
+			return fmt.Errorf("could not create encryptor: %w", err)
+		}
+		snapshotHandler.SetEncryptor(encryptor)
+	}
+
+	if cfg.Manifest.Enabled {
+		signer, err := components.NewManifestSigner(
+			cfg.Manifest.KeyFile,
+			cfg.Manifest.ChainFile,
+			cfg.Device.ID,
+			cfg.Device.Name,
+			components.CameraSettings{
+				Width:   cfg.Camera.Width,
+				Height:  cfg.Camera.Height,
+				FPS:     cfg.Camera.FPS,
+				Bitrate: cfg.Camera.Bitrate,
+				Codec:   cfg.Camera.Codec,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("could not create manifest signer: %w", err)
+		}
+		logger.Info("Signing snapshot manifests", "public_key", signer.PublicKey())
+		snapshotHandler.SetManifestSigner(signer)
+	}
+
+	results := components.NewResults(logger, uploader)
+	results.Subscribe(snapshotHandler.HandleResult)
+	results.Start(ctx)
+	defer results.Stop()
+
 	go snapshotHandler.Start(ctx)
 
+	if cfg.MQTT.Enabled {
+		mqttClient := components.NewMQTT(
+			logger,
+			cfg.MQTT.Broker,
+			cfg.MQTT.ClientID,
+			cfg.MQTT.Username,
+			cfg.MQTT.Password,
+			cfg.MQTT.TopicPrefix,
+			cfg.Device.ID,
+			cfg.MQTT.QoS,
+			time.Duration(cfg.MQTT.KeepAliveSeconds)*time.Second,
+			snapshotHandler,
+			results,
+			tokens,
+			events,
+		)
+		mqttClient.Start(ctx)
+		defer mqttClient.Stop()
+	}
+
+	if cfg.Retention.Enabled {
+		retention := components.NewRetention(
+			logger,
+			cfg.Retention.Dir,
+			cfg.Retention.MaxMB*1024*1024,
+			time.Duration(cfg.Retention.MaxAgeHours)*time.Hour,
+			uint64(cfg.Retention.MinFreeMB)*1024*1024,
+			time.Duration(cfg.Retention.CheckIntervalSeconds)*time.Second,
+			events,
+			spool,
+		)
+		retention.Start(ctx)
+		defer retention.Stop()
+	}
+
+	if cfg.Audio.Enabled {
+		audioMonitor := components.NewAudioMonitor(
+			logger,
+			cfg.Audio.Device,
+			cfg.Audio.SampleRate,
+			time.Duration(cfg.Audio.WindowMillis)*time.Millisecond,
+			cfg.Audio.Metric,
+			cfg.Audio.ThresholdDBFS,
+			cfg.Audio.HysteresisDB,
+			time.Duration(cfg.Audio.CooldownSeconds)*time.Second,
+			snapshotHandler,
+			events,
+		)
+		audioMonitor.Start(ctx)
+		defer audioMonitor.Stop()
+	}
+
+	if len(cfg.Webhooks) > 0 {
+		hooks := make([]components.WebhookOptions, 0, len(cfg.Webhooks))
+		for _, hook := range cfg.Webhooks {
+			hooks = append(hooks, components.WebhookOptions{
+				URL:                hook.URL,
+				Events:             hook.Events,
+				Template:           hook.Template,
+				Secret:             hook.Secret,
+				MaxRetries:         hook.MaxRetries,
+				Timeout:            time.Duration(hook.TimeoutSeconds) * time.Second,
+				RateLimitPerMinute: hook.RateLimitPerMinute,
+				FailureThreshold:   hook.FailureThreshold,
+			})
+		}
+
+		webhooks, err := components.NewWebhooks(logger, hooks, events)
+		if err != nil {
+			return fmt.Errorf("could not create webhooks: %w", err)
+		}
+		webhooks.Start(ctx)
+		defer webhooks.Stop()
+	}
+
+	reloader := newReloader(logger, flags, cfg, &level, snapshotHandler, uploader, hubClient, tokens)
+	go reloader.run(ctx, hupCh)
+
 	return runMainLoop(ctx, snapshotHandler, logger)
 }
 
@@ -124,3 +327,188 @@ func stopUploader(uploader *components.Uploader, logger *slog.Logger) {
 		logger.Error("Error stopping uploader", "error", err)
 	}
 }
+
+// newHubClient returns the client for the hub uploads and checks, with the [tls] settings if any.
+func newHubClient(cfg *config.Config, logger *slog.Logger) (*http.Client, error) {
+	if !cfg.TLS.Enabled() {
+		return &http.Client{}, nil
+	}
+
+	tlsConfig, err := components.NewHubTLSConfig(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.CAFile, cfg.TLS.PinSHA256)
+	if err != nil {
+		return nil, err
+	}
+	client, err := components.NewHubClient(tlsConfig, hubURLs(cfg)...)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info(
+		"Using TLS settings for hub connections",
+		"client_certificate", cfg.TLS.CertFile != "",
+		"ca_file", cfg.TLS.CAFile,
+		"pins", len(cfg.TLS.PinSHA256),
+	)
+	return client, nil
+}
+
+func newUploader(
+	cfg *config.Config,
+	hubClient *http.Client,
+	tokens *components.TokenManager,
+	logger *slog.Logger,
+) (*components.Uploader, error) {
+	policy, err := components.ParseDeletePolicy(cfg.Upload.DeletePolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	sinks, err := newSinks(cfg, hubClient, tokens, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return components.NewUploader(
+		logger,
+		sinks,
+		policy,
+		cfg.Upload.MaxConcurrent,
+		cfg.Upload.DeleteAfterUpload,
+		cfg.Upload.MaxBytesPerSecond,
+		cfg.Upload.Windows,
+		time.Duration(cfg.Upload.PriorityAgingSeconds)*time.Second,
+	)
+}
+
+// hubURLs returns the hub endpoints the app uploads to.
+func hubURLs(cfg *config.Config) []string {
+	urls := []string{cfg.Upload.Endpoint}
+	if slices.Contains(cfg.Upload.Sinks, "tus") {
+		urls = append(urls, cfg.Tus.Endpoint)
+	}
+	return urls
+}
+
+func newSinks(
+	cfg *config.Config,
+	hubClient *http.Client,
+	tokens *components.TokenManager,
+	logger *slog.Logger,
+) ([]components.Sink, error) {
+	var check *components.HubCheck
+	if cfg.Upload.ExistsEndpoint != "" {
+		check = components.NewHubCheck(
+			hubClient,
+			components.HubURL(cfg.Upload.Endpoint, cfg.Upload.ExistsEndpoint),
+			tokens,
+		)
+	}
+
+	var sinks []components.Sink
+	for _, name := range cfg.Upload.Sinks {
+		sink, err := newSink(name, cfg, hubClient, tokens, check, logger)
+		if err != nil {
+			return nil, fmt.Errorf("could not create %s sink: %w", name, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// newTokenManager returns the token manager for the hub requests, or nil
+// when auth is disabled or no hub requests are made.
+func newTokenManager(cfg *config.Config, hubClient *http.Client, logger *slog.Logger) *components.TokenManager {
+	if !needsTokenManager(cfg) {
+		return nil
+	}
+	return components.NewTokenManager(
+		logger,
+		hubClient,
+		components.HubURL(cfg.Upload.Endpoint, cfg.Auth.Endpoint),
+		cfg.Auth.ClientID,
+		cfg.Auth.ClientSecret,
+		cfg.Auth.Scopes,
+		cfg.Auth.Audience,
+	)
+}
+
+func needsTokenManager(cfg *config.Config) bool {
+	return cfg.Auth.Enabled && (cfg.Upload.ExistsEndpoint != "" ||
+		slices.Contains(cfg.Upload.Sinks, "hub") || slices.Contains(cfg.Upload.Sinks, "tus"))
+}
+
+func newSink(
+	name string,
+	cfg *config.Config,
+	hubClient *http.Client,
+	tokens *components.TokenManager,
+	check *components.HubCheck,
+	logger *slog.Logger,
+) (components.Sink, error) {
+	switch name {
+	case "hub":
+		return components.NewHubSink(
+			logger,
+			hubClient,
+			cfg.Upload.Endpoint,
+			cfg.Upload.MaxRetries,
+			tokens,
+			check,
+		), nil
+	case "tus":
+		return components.NewTusSink(
+			logger,
+			hubClient,
+			cfg.Tus.Endpoint,
+			cfg.Tus.ChunkSizeMB<<20,
+			cfg.Tus.StateDir,
+			cfg.Upload.MaxRetries,
+			tokens,
+			check,
+		)
+	case "s3":
+		return components.NewS3Sink(
+			logger,
+			cfg.S3.Endpoint,
+			cfg.S3.Region,
+			cfg.S3.Bucket,
+			cfg.S3.Prefix,
+			cfg.S3.AccessKeyID,
+			cfg.S3.SecretAccessKey,
+			cfg.S3.SessionToken,
+			cfg.S3.PathStyle,
+			cfg.S3.PartSizeMB<<20,
+			cfg.Upload.MaxRetries,
+		)
+	case "webdav":
+		return components.NewWebDAVSink(
+			logger,
+			cfg.WebDAV.URL,
+			cfg.WebDAV.Username,
+			cfg.WebDAV.Password,
+			cfg.Upload.MaxRetries,
+			time.Duration(cfg.WebDAV.TimeoutSeconds)*time.Second,
+		)
+	case "sftp":
+		return components.NewSFTPSink(
+			logger,
+			cfg.SFTP.Host,
+			cfg.SFTP.Port,
+			cfg.SFTP.User,
+			cfg.SFTP.IdentityFile,
+			cfg.SFTP.Dir,
+			cfg.Upload.MaxRetries,
+		)
+	case "archive":
+		return components.NewArchiveSink(
+			logger,
+			cfg.Archive.Dir,
+			cfg.Upload.MaxRetries,
+			cfg.Archive.MaxMB*1024*1024,
+			time.Duration(cfg.Archive.MaxAgeDays)*24*time.Hour,
+			uint64(cfg.Archive.MinFreeMB)*1024*1024,
+			time.Duration(cfg.Archive.CheckIntervalSeconds)*time.Second,
+		)
+	default:
+		return nil, fmt.Errorf("unknown sink %q", name)
+	}
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alesr/tidskott-pi/cmd/tidskott-pi/components"
+	"github.com/alesr/tidskott-pi/internal/pkg/config"
+)
+
+// runAudit prints the audit log entries of a snapshot or a time range.
+func runAudit(args []string) error {
+	flagSet := flag.NewFlagSet("audit", flag.ContinueOnError)
+	configPath := flagSet.String("config", "", "Path to configuration file")
+	id := flagSet.String("id", "", "Snapshot ID")
+	since := flagSet.String("since", "", "Start of the time range: RFC 3339 time, date, or duration ago (e.g. 24h)")
+	until := flagSet.String("until", "", "End of the time range, in the same forms as -since")
+	asJSON := flagSet.Bool("json", false, "Print entries as JSON lines")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+
+	path := *configPath
+	if path == "" {
+		path = config.DefaultConfigPath()
+	}
+	cfg := config.DefaultConfig()
+	if _, err := os.Stat(path); err == nil {
+		if cfg, err = config.LoadConfig(path, nil); err != nil {
+			return fmt.Errorf("could not load config: %w", err)
+		}
+	}
+
+	query := components.AuditQuery{SnapshotID: *id}
+	var err error
+	if query.Since, err = parseAuditTime(*since); err != nil {
+		return fmt.Errorf("invalid -since: %w", err)
+	}
+	if query.Until, err = parseAuditTime(*until); err != nil {
+		return fmt.Errorf("invalid -until: %w", err)
+	}
+
+	entries, err := components.ReadAudit(cfg.Audit.File, cfg.Audit.MaxFiles, query)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No audit entries found")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTION\tSNAPSHOT\tSIZE\tHASH\tDETAILS")
+	for _, entry := range entries {
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Time.Local().Format(time.RFC3339),
+			entry.Action,
+			orDash(entry.SnapshotID),
+			auditSize(entry.Size),
+			orDash(shortHash(entry.Hash)),
+			orDash(auditDetails(entry)),
+		)
+	}
+	return w.Flush()
+}
+
+// parseAuditTime accepts an RFC 3339 time, a date, or a duration before
+// now; an empty string is the zero time.
+func parseAuditTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, errors.New("expected an RFC 3339 time, a YYYY-MM-DD date or a duration such as 24h")
+}
+
+func auditSize(size int64) string {
+	if size == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2fMB", float64(size)/(1024*1024))
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+func auditDetails(entry components.AuditEntry) string {
+	var parts []string
+	if entry.Trigger != "" {
+		parts = append(parts, "trigger="+entry.Trigger)
+	}
+	if entry.Path != "" {
+		parts = append(parts, "path="+entry.Path)
+	}
+	keys := make([]string, 0, len(entry.Details))
+	for key := range entry.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		parts = append(parts, key+"="+entry.Details[key])
+	}
+	if entry.Error != "" {
+		parts = append(parts, fmt.Sprintf("error=%q", entry.Error))
+	}
+	return strings.Join(parts, " ")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
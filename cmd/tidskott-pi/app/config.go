@@ -3,31 +3,67 @@ package app
 import (
 	"flag"
 	"fmt"
+	"reflect"
 
 	"github.com/alesr/tidskott-pi/internal/pkg/config"
 )
 
 type flags struct {
 	ConfigPath string
+	Overrides  config.Overrides
 }
 
 func parseFlags() (*flags, error) {
 	configPath := flag.String("config", "", "Path to configuration file")
-	flag.Parse()
-	return &flags{ConfigPath: *configPath}, nil
-}
 
-func loadConfig(configPath string) (*config.Config, error) {
-	var configFile string
-	if configPath != "" {
-		configFile = configPath
-	} else {
-		configFile = config.DefaultConfigPath()
+	// every config field is a flag too, e.g. --upload.endpoint
+	overrides := make(config.Overrides)
+	for _, field := range config.Fields() {
+		flag.Var(
+			&overrideFlag{overrides: overrides, path: field.Path, isBool: field.Kind == reflect.Bool},
+			field.Path,
+			fmt.Sprintf("Override %s (env %s)", field.Path, field.Env),
+		)
 	}
 
-	cfg, err := config.LoadConfig(configFile)
+	flag.Parse()
+	return &flags{ConfigPath: *configPath, Overrides: overrides}, nil
+}
+
+func loadConfig(configPath string, overrides config.Overrides) (*config.Config, error) {
+	cfg, err := config.LoadConfig(configFile(configPath), overrides)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load configuration: %w", err)
 	}
 	return cfg, nil
 }
+
+// configFile returns the config file to load, given the -config flag.
+func configFile(configPath string) string {
+	if configPath != "" {
+		return configPath
+	}
+	return config.DefaultConfigPath()
+}
+
+// overrideFlag records a config field set on the command line. Fields that
+// are not set keep their file or environment value.
+type overrideFlag struct {
+	overrides config.Overrides
+	path      string
+	isBool    bool
+}
+
+func (f *overrideFlag) String() string {
+	if f == nil || f.overrides == nil {
+		return ""
+	}
+	return f.overrides[f.path]
+}
+
+func (f *overrideFlag) Set(value string) error {
+	f.overrides[f.path] = value
+	return nil
+}
+
+func (f *overrideFlag) IsBoolFlag() bool { return f.isBool }
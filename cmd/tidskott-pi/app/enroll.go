@@ -0,0 +1,302 @@
+package app
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alesr/tidskott-pi/cmd/tidskott-pi/components"
+	"github.com/alesr/tidskott-pi/internal/pkg/config"
+)
+
+const enrollPath = "/enroll"
+
+type enrollRequest struct {
+	Token      string `json:"token"`
+	CSR        string `json:"csr"`
+	DeviceName string `json:"device_name"`
+	Hostname   string `json:"hostname"`
+}
+
+type enrollResponse struct {
+	DeviceID      string `json:"device_id"`
+	DeviceName    string `json:"device_name"`
+	Certificate   string `json:"certificate"`
+	CACertificate string `json:"ca_certificate"`
+}
+
+// deviceIdentity is stored next to the device certificate.
+type deviceIdentity struct {
+	DeviceID   string    `json:"device_id"`
+	DeviceName string    `json:"device_name"`
+	Hub        string    `json:"hub"`
+	EnrolledAt time.Time `json:"enrolled_at"`
+	NotAfter   time.Time `json:"not_after"`
+}
+
+// runEnroll enrolls the device with the hub: it creates a key pair, sends a
+// CSR with a one-time token, stores the issued certificate and writes the
+// device identity and certificate paths into the config file.
+func runEnroll(args []string) error {
+	flagSet := flag.NewFlagSet("enroll", flag.ContinueOnError)
+	configPath := flagSet.String("config", "", "Path to configuration file")
+	endpoint := flagSet.String("endpoint", "", "Hub upload endpoint (defaults to upload.endpoint)")
+	token := flagSet.String("token", "", "One-time enrollment token (defaults to $TIDSKOTT_ENROLL_TOKEN)")
+	name := flagSet.String("name", "", "Device name (defaults to the hostname)")
+	dir := flagSet.String("dir", "certs", "Directory for the device key and certificate")
+	caFile := flagSet.String("ca", "", "CA bundle to verify the hub with during enrollment")
+	force := flagSet.Bool("force", false, "Replace an existing device key")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+
+	if *token == "" {
+		*token = os.Getenv("TIDSKOTT_ENROLL_TOKEN")
+	}
+	if *token == "" {
+		return errors.New("an enrollment token is required")
+	}
+
+	path := *configPath
+	if path == "" {
+		path = config.DefaultConfigPath()
+	}
+	cfg := config.DefaultConfig()
+	if _, err := os.Stat(path); err == nil {
+		if cfg, err = config.LoadConfig(path, nil); err != nil {
+			return fmt.Errorf("could not load config: %w", err)
+		}
+	}
+	if *endpoint != "" {
+		cfg.Upload.Endpoint = *endpoint
+	}
+
+	hostname, _ := os.Hostname()
+	if *name == "" {
+		*name = hostname
+	}
+
+	dirPath, err := filepath.Abs(*dir)
+	if err != nil {
+		return fmt.Errorf("could not resolve certificate directory: %w", err)
+	}
+	keyPath := filepath.Join(dirPath, "device.key")
+	certPath := filepath.Join(dirPath, "device.crt")
+	if _, err := os.Stat(keyPath); err == nil && !*force {
+		return fmt.Errorf("%s exists, use -force to enroll again", keyPath)
+	}
+
+	// check the resulting config before the token is spent
+	cfg.TLS.CertFile, cfg.TLS.KeyFile = certPath, keyPath
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("enrolled configuration would be invalid: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("could not generate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: *name},
+	}, key)
+	if err != nil {
+		return fmt.Errorf("could not create CSR: %w", err)
+	}
+
+	client, err := enrollClient(*caFile)
+	if err != nil {
+		return err
+	}
+	enrollURL := components.HubURL(cfg.Upload.Endpoint, enrollPath)
+	resp, err := enroll(client, enrollURL, enrollRequest{
+		Token:      *token,
+		CSR:        string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+		DeviceName: *name,
+		Hostname:   hostname,
+	})
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("could not encode key: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	pair, err := tls.X509KeyPair([]byte(resp.Certificate), keyPEM)
+	if err != nil {
+		return fmt.Errorf("hub returned an unusable certificate: %w", err)
+	}
+
+	files := []privateFile{
+		{keyPath, keyPEM},
+		{certPath, []byte(resp.Certificate)},
+	}
+
+	values := map[string]any{
+		"device.id":     resp.DeviceID,
+		"device.name":   resp.DeviceName,
+		"tls.cert_file": certPath,
+		"tls.key_file":  keyPath,
+	}
+	if *endpoint != "" {
+		values["upload.endpoint"] = *endpoint
+	}
+	// the bundle the hub was verified with during enrollment wins over one
+	// the hub hands out
+	switch {
+	case *caFile != "":
+		caPath, err := filepath.Abs(*caFile)
+		if err != nil {
+			return fmt.Errorf("could not resolve CA bundle: %w", err)
+		}
+		values["tls.ca_file"] = caPath
+	case resp.CACertificate != "":
+		caPath := filepath.Join(dirPath, "ca.crt")
+		files = append(files, privateFile{caPath, []byte(resp.CACertificate)})
+		values["tls.ca_file"] = caPath
+	}
+
+	identity, err := json.MarshalIndent(deviceIdentity{
+		DeviceID:   resp.DeviceID,
+		DeviceName: resp.DeviceName,
+		Hub:        enrollURL,
+		EnrolledAt: time.Now().UTC(),
+		NotAfter:   pair.Leaf.NotAfter,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode device identity: %w", err)
+	}
+	files = append(files, privateFile{filepath.Join(dirPath, "identity.json"), identity})
+
+	if err := os.MkdirAll(dirPath, 0o700); err != nil {
+		return fmt.Errorf("could not create certificate directory: %w", err)
+	}
+	if err := writePrivateFiles(files); err != nil {
+		return err
+	}
+
+	if err := config.Update(path, values); err != nil {
+		return fmt.Errorf("could not update config: %w", err)
+	}
+
+	fmt.Printf(
+		"Enrolled as %s (%s), certificate valid until %s\nWrote %s\n",
+		resp.DeviceID, resp.DeviceName, pair.Leaf.NotAfter.Format(time.RFC3339), path,
+	)
+	return nil
+}
+
+func enrollClient(caFile string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		pemData, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+func enroll(client *http.Client, enrollURL string, body enrollRequest) (*enrollResponse, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode enrollment request: %w", err)
+	}
+
+	resp, err := client.Post(enrollURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("could not reach hub: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("hub rejected enrollment: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var enrolled enrollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&enrolled); err != nil {
+		return nil, fmt.Errorf("could not decode enrollment response: %w", err)
+	}
+	if enrolled.DeviceID == "" || enrolled.Certificate == "" {
+		return nil, errors.New("enrollment response has no device_id or certificate")
+	}
+	if enrolled.DeviceName == "" {
+		enrolled.DeviceName = body.DeviceName
+	}
+	return &enrolled, nil
+}
+
+type privateFile struct {
+	path string
+	data []byte
+}
+
+// writePrivateFiles writes files readable by the owner only. Each is written
+// to a temporary file next to it first, and none replaces an existing file
+// until all are written, so a failure leaves the previous key and
+// certificate in place rather than a key without its certificate.
+func writePrivateFiles(files []privateFile) error {
+	tmpPaths := make([]string, 0, len(files))
+	defer func() {
+		for _, tmp := range tmpPaths {
+			os.Remove(tmp)
+		}
+	}()
+
+	for _, f := range files {
+		tmp, err := writeTempFile(f.path, f.data)
+		if err != nil {
+			return err
+		}
+		tmpPaths = append(tmpPaths, tmp)
+	}
+
+	for i, f := range files {
+		if err := os.Rename(tmpPaths[i], f.path); err != nil {
+			return fmt.Errorf("could not replace %s: %w", f.path, err)
+		}
+	}
+	return nil
+}
+
+// writeTempFile writes data to a new file readable by the owner only in the
+// directory of path, and returns its name.
+func writeTempFile(path string, data []byte) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return "", fmt.Errorf("could not create temporary file for %s: %w", path, err)
+	}
+	if _, err := f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("could not write %s: %w", path, err)
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,262 @@
+package app
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alesr/tidskott-pi/internal/pkg/config"
+)
+
+// stubHub issues device certificates from a throwaway CA for the token
+// "valid", and rejects any other token.
+type stubHub struct {
+	server *httptest.Server
+	caPath string // CA bundle of the hub's TLS certificate
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+	serial int64
+}
+
+func newStubHub(t *testing.T) *stubHub {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "stub hub CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := &stubHub{caKey: caKey, caCert: caCert, serial: 1}
+	hub.server = httptest.NewTLSServer(http.HandlerFunc(hub.enroll))
+	t.Cleanup(hub.server.Close)
+
+	hub.caPath = filepath.Join(t.TempDir(), "hub-ca.pem")
+	serverCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: hub.server.Certificate().Raw})
+	if err := os.WriteFile(hub.caPath, serverCert, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return hub
+}
+
+func (h *stubHub) enroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != enrollPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req enrollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Token != "valid" {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil {
+		http.Error(w, "no CSR", http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil || csr.CheckSignature() != nil {
+		http.Error(w, "invalid CSR", http.StatusBadRequest)
+		return
+	}
+
+	h.serial++
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(h.serial),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, h.caCert, csr.PublicKey, h.caKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(enrollResponse{
+		DeviceID:    "device-1",
+		DeviceName:  req.DeviceName,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	})
+}
+
+// writeEnrollConfig writes a config uploading to the stub hub with tus.
+func writeEnrollConfig(t *testing.T, hubURL string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	contents := `[upload]
+sinks = ["tus"]
+endpoint = "` + hubURL + `/upload"
+
+[tus]
+endpoint = "` + hubURL + `/files"
+`
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func enrollArgs(hub *stubHub, configPath, dir, token string, extra ...string) []string {
+	args := []string{
+		"-config", configPath,
+		"-token", token,
+		"-dir", dir,
+		"-name", "front-door",
+		"-ca", hub.caPath,
+	}
+	return append(args, extra...)
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEnroll(t *testing.T) {
+	hub := newStubHub(t)
+	configPath := writeEnrollConfig(t, hub.server.URL)
+	dir := filepath.Join(t.TempDir(), "certs")
+
+	if err := runEnroll(enrollArgs(hub, configPath, dir, "valid")); err != nil {
+		t.Fatalf("could not enroll: %v", err)
+	}
+
+	keyPath, certPath := filepath.Join(dir, "device.key"), filepath.Join(dir, "device.crt")
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("stored key and certificate do not match: %v", err)
+	}
+	if pair.Leaf.Subject.CommonName != "front-door" {
+		t.Errorf("got certificate for %q, want front-door", pair.Leaf.Subject.CommonName)
+	}
+	for _, name := range []string{"device.key", "device.crt", "identity.json"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0o600 {
+			t.Errorf("%s has mode %o, want 600", name, perm)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+
+	cfg, err := config.LoadConfig(configPath, nil)
+	if err != nil {
+		t.Fatalf("enrolled config does not load: %v", err)
+	}
+	if cfg.Device.ID != "device-1" || cfg.Device.Name != "front-door" {
+		t.Errorf("got device %q %q, want device-1 front-door", cfg.Device.ID, cfg.Device.Name)
+	}
+	if cfg.TLS.CertFile != certPath || cfg.TLS.KeyFile != keyPath {
+		t.Errorf("got tls files %q %q, want %q %q", cfg.TLS.CertFile, cfg.TLS.KeyFile, certPath, keyPath)
+	}
+	if cfg.TLS.CAFile != hub.caPath {
+		t.Errorf("got tls.ca_file %q, want %q", cfg.TLS.CAFile, hub.caPath)
+	}
+}
+
+func TestEnrollAgain(t *testing.T) {
+	hub := newStubHub(t)
+	configPath := writeEnrollConfig(t, hub.server.URL)
+	dir := filepath.Join(t.TempDir(), "certs")
+	keyPath, certPath := filepath.Join(dir, "device.key"), filepath.Join(dir, "device.crt")
+
+	if err := runEnroll(enrollArgs(hub, configPath, dir, "valid")); err != nil {
+		t.Fatalf("could not enroll: %v", err)
+	}
+	key, cert := readFile(t, keyPath), readFile(t, certPath)
+
+	if err := runEnroll(enrollArgs(hub, configPath, dir, "valid")); err == nil {
+		t.Fatal("enrolled again without -force")
+	}
+
+	// a failed enrollment leaves the current pair alone
+	if err := runEnroll(enrollArgs(hub, configPath, dir, "spent", "-force")); err == nil {
+		t.Fatal("enrolled with a rejected token")
+	}
+	if !bytes.Equal(readFile(t, keyPath), key) || !bytes.Equal(readFile(t, certPath), cert) {
+		t.Fatal("failed enrollment replaced the key or certificate")
+	}
+
+	if err := runEnroll(enrollArgs(hub, configPath, dir, "valid", "-force")); err != nil {
+		t.Fatalf("could not enroll with -force: %v", err)
+	}
+	if bytes.Equal(readFile(t, keyPath), key) {
+		t.Error("key not replaced with -force")
+	}
+	if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		t.Fatalf("replaced key and certificate do not match: %v", err)
+	}
+}
+
+func TestEnrollDefaultConfig(t *testing.T) {
+	hub := newStubHub(t)
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	dir := filepath.Join(t.TempDir(), "certs")
+
+	args := enrollArgs(hub, configPath, dir, "valid", "-endpoint", hub.server.URL+"/upload")
+	if err := runEnroll(args); err != nil {
+		t.Fatalf("could not enroll: %v", err)
+	}
+
+	cfg, err := config.LoadConfig(configPath, nil)
+	if err != nil {
+		t.Fatalf("enrolled config does not load: %v", err)
+	}
+	if !slices.Equal(cfg.Upload.Sinks, []string{"hub"}) || !cfg.TLS.Enabled() {
+		t.Errorf("got sinks %v with tls %v, want the hub sink with tls", cfg.Upload.Sinks, cfg.TLS.Enabled())
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"time"
 )
 
-func setupLogger() (*slog.Logger, *os.File, error) {
+// setupLogger logs to stdout and a new file in logs/, at level, which can be
+// changed while running.
+func setupLogger(level *slog.LevelVar) (*slog.Logger, *os.File, error) {
 	logDir := "logs"
 
 	if err := os.MkdirAll(logDir, 0o755); err != nil {
@@ -33,7 +35,7 @@ func setupLogger() (*slog.Logger, *os.File, error) {
 
 	multiHandler := slog.NewTextHandler(
 		io.MultiWriter(os.Stdout, logFile), &slog.HandlerOptions{
-			Level: slog.LevelInfo,
+			Level: level,
 		},
 	)
 	return slog.New(multiHandler), logFile, nil
@@ -0,0 +1,241 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alesr/tidskott-pi/cmd/tidskott-pi/components"
+	"github.com/alesr/tidskott-pi/internal/pkg/config"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 5 * time.Second
+
+// liveFields are applied to the running components on reload.
+var liveFields = []string{
+	"log.level",
+	"buffer.snapshot_interval",
+	"upload.max_bytes_per_second",
+	"upload.windows",
+	"upload.priority_aging_seconds",
+}
+
+// sinkFields are applied on reload by replacing the upload sinks.
+var sinkFields = []string{
+	"upload.endpoint",
+	"upload.sinks",
+	"upload.max_retries",
+	"upload.exists_endpoint",
+}
+
+var sinkSections = []string{"s3.", "webdav.", "sftp.", "archive.", "tus."}
+
+// reloader reloads the config on SIGHUP or when the config file changes,
+// and applies what can be applied without a restart. Everything else is
+// reported as needing a restart. That includes the camera settings: the
+// buffer owns the camera and cannot reconfigure it, so applying them would
+// mean dropping the buffer. An invalid config is rejected and the current
+// one kept.
+type reloader struct {
+	logger    *slog.Logger
+	flags     *flags
+	level     *slog.LevelVar
+	snapshots *components.SnapshotHandler
+	uploader  *components.Uploader
+	hubClient *http.Client
+	tokens    *components.TokenManager
+
+	started   *config.Config // what components that are not reloaded run with
+	sinksFrom *config.Config // what the upload sinks were created from
+	current   *config.Config // the live fields as applied
+}
+
+func newReloader(
+	logger *slog.Logger,
+	flags *flags,
+	cfg *config.Config,
+	level *slog.LevelVar,
+	snapshots *components.SnapshotHandler,
+	uploader *components.Uploader,
+	hubClient *http.Client,
+	tokens *components.TokenManager,
+) *reloader {
+	return &reloader{
+		logger:    logger,
+		flags:     flags,
+		level:     level,
+		snapshots: snapshots,
+		uploader:  uploader,
+		hubClient: hubClient,
+		tokens:    tokens,
+		started:   cfg,
+		sinksFrom: cfg,
+		current:   cfg,
+	}
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statConfig(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+func (r *reloader) run(ctx context.Context, hup <-chan os.Signal) {
+	path := configFile(r.flags.ConfigPath)
+	applied := statConfig(path)
+	last := applied
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-hup:
+			r.logger.Info("Received signal, reloading configuration", "signal", sig)
+			applied = statConfig(path)
+			last = applied
+			r.reload()
+		case <-ticker.C:
+			// wait until the file stayed the same for a whole interval, so
+			// it is not read while being written
+			stamp := statConfig(path)
+			if stamp != applied && stamp == last {
+				r.logger.Info("Configuration file changed, reloading configuration", "path", path)
+				applied = stamp
+				r.reload()
+			}
+			last = stamp
+		}
+	}
+}
+
+func (r *reloader) reload() {
+	next, err := loadConfig(r.flags.ConfigPath, r.flags.Overrides)
+	if err != nil {
+		r.logger.Error("Rejected configuration reload, keeping the current configuration", "error", err)
+		return
+	}
+	for _, warning := range next.Warnings {
+		r.logger.Warn("Configuration warning", "warning", warning)
+	}
+
+	var applied []string
+
+	// replace the sinks first: if that fails, nothing is applied
+	changed := slices.DeleteFunc(config.Diff(r.sinksFrom, next), func(path string) bool { return !isSinkField(path) })
+	if len(changed) > 0 && r.canReplaceSinks(next) {
+		sinks, err := newSinks(next, r.hubClient, r.tokens, r.logger)
+		if err == nil {
+			err = r.uploader.SetSinks(sinks)
+		}
+		if err != nil {
+			r.logger.Error("Rejected configuration reload, keeping the current configuration", "error", err)
+			return
+		}
+		r.sinksFrom = next
+		applied = append(applied, changed...)
+	}
+
+	// current keeps the running value of any field that failed to apply,
+	// so the next reload tries it again
+	current := *r.current
+	var limits []string
+	for _, path := range config.Diff(r.current, next) {
+		switch path {
+		case "log.level":
+			if err := r.level.UnmarshalText([]byte(next.Log.Level)); err != nil {
+				r.logger.Error("Failed to set log level", "level", next.Log.Level, "error", err)
+				continue
+			}
+			current.Log.Level = next.Log.Level
+		case "buffer.snapshot_interval":
+			r.snapshots.SetSnapshotInterval(time.Duration(next.Buffer.SnapshotInterval) * time.Second)
+			current.Buffer.SnapshotInterval = next.Buffer.SnapshotInterval
+		case "upload.max_bytes_per_second", "upload.windows", "upload.priority_aging_seconds":
+			limits = append(limits, path)
+			continue
+		default:
+			continue
+		}
+		applied = append(applied, path)
+	}
+	if len(limits) > 0 {
+		err := r.uploader.SetLimits(
+			next.Upload.MaxBytesPerSecond,
+			next.Upload.Windows,
+			time.Duration(next.Upload.PriorityAgingSeconds)*time.Second,
+		)
+		if err != nil {
+			r.logger.Error("Failed to set upload limits", "error", err)
+		} else {
+			current.Upload.MaxBytesPerSecond = next.Upload.MaxBytesPerSecond
+			current.Upload.Windows = next.Upload.Windows
+			current.Upload.PriorityAgingSeconds = next.Upload.PriorityAgingSeconds
+			applied = append(applied, limits...)
+		}
+	}
+	r.current = &current
+
+	restart := r.needRestart(next)
+	switch {
+	case len(applied) > 0:
+		slices.Sort(applied)
+		r.logger.Info("Configuration reloaded", "applied", strings.Join(applied, ", "))
+	case len(restart) == 0:
+		r.logger.Info("Configuration reloaded, nothing changed")
+	}
+	if len(restart) > 0 {
+		r.logger.Warn("Configuration changes take effect after a restart", "fields", strings.Join(restart, ", "))
+	}
+}
+
+// canReplaceSinks reports whether sinks created from next can run with
+// what was set up at startup: the hub token manager, and the TLS settings,
+// which cover the hub hosts known at startup only.
+func (r *reloader) canReplaceSinks(next *config.Config) bool {
+	if needsTokenManager(next) != (r.tokens != nil) {
+		return false
+	}
+	if r.tokens != nil && components.HubURL(next.Upload.Endpoint, next.Auth.Endpoint) !=
+		components.HubURL(r.started.Upload.Endpoint, r.started.Auth.Endpoint) {
+		return false
+	}
+	if r.started.TLS.Enabled() && !slices.Equal(hubURLs(next), hubURLs(r.started)) {
+		return false
+	}
+	return true
+}
+
+// needRestart returns the fields that differ from the running config and
+// cannot be applied without a restart.
+func (r *reloader) needRestart(next *config.Config) []string {
+	replaceSinks := r.canReplaceSinks(next)
+	return slices.DeleteFunc(config.Diff(r.started, next), func(path string) bool {
+		return slices.Contains(liveFields, path) || replaceSinks && isSinkField(path)
+	})
+}
+
+func isSinkField(path string) bool {
+	if slices.Contains(sinkFields, path) {
+		return true
+	}
+	for _, section := range sinkSections {
+		if strings.HasPrefix(path, section) {
+			return true
+		}
+	}
+	return false
+}
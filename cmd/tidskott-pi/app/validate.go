@@ -0,0 +1,81 @@
+package app
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/alesr/tidskott-pi/internal/pkg/config"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// runConfig runs the config subcommands.
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "validate" {
+		return errors.New("usage: tidskott-pi config validate [-config path]")
+	}
+	return runValidate(args[1:])
+}
+
+// runValidate prints every problem with the config, including environment
+// overrides, and fails if there is any.
+func runValidate(args []string) error {
+	flagSet := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	configPath := flagSet.String("config", "", "Path to configuration file")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+
+	path := configFile(*configPath)
+	warnings, err := config.Check(path, nil)
+	for _, warning := range warnings {
+		fmt.Printf("%s: warning: %s\n", path, warning)
+	}
+
+	var errs config.ValidationErrors
+	var decodeErr *toml.DecodeError
+	switch {
+	case errors.As(err, &errs):
+		// in file order, then those set by overrides
+		slices.SortStableFunc(errs, func(a, b *config.FieldError) int {
+			return cmp.Compare(sortLine(a), sortLine(b))
+		})
+		for _, fieldErr := range errs {
+			fmt.Println(validationMessage(path, fieldErr))
+		}
+		if len(errs) == 1 {
+			return fmt.Errorf("%s: found 1 problem", path)
+		}
+		return fmt.Errorf("%s: found %d problems", path, len(errs))
+	case errors.As(err, &decodeErr):
+		line, column := decodeErr.Position()
+		fmt.Printf("%s:%d:%d: %s\n", path, line, column, decodeErr.Error())
+		return fmt.Errorf("%s: could not parse config file", path)
+	case err != nil:
+		return err
+	}
+
+	fmt.Printf("%s: configuration is valid\n", path)
+	return nil
+}
+
+func sortLine(err *config.FieldError) int {
+	if err.Line == 0 {
+		return math.MaxInt
+	}
+	return err.Line
+}
+
+func validationMessage(path string, err *config.FieldError) string {
+	msg := err.Path + " " + err.Message
+	switch {
+	case err.Override != "":
+		return fmt.Sprintf("%s: %s", err.Override, msg)
+	case err.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", path, err.Line, msg)
+	}
+	return fmt.Sprintf("%s: %s", path, msg)
+}
@@ -0,0 +1,360 @@
+package components
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+const (
+	archiveSidecarExt = ".json"
+	archivePartExt    = ".part"
+)
+
+// ArchiveSink copies snapshots into a local directory tree, typically a
+// mounted NAS share or USB drive, as <dir>/<yyyy>/<mm>/<dd>/<device id>/
+// <snapshot id><ext> next to a <snapshot id>.json metadata sidecar. Files
+// are written under a temporary name and renamed into place, the sidecar
+// first, so a clip is never visible half written or without metadata.
+//
+// The archive has its own retention: clips older than maxAge are removed,
+// then the oldest until the archive fits in maxBytes and the file system
+// has minFreeBytes free. Zero limits are disabled. Only clips laid out as
+// the sink stores them, with a sidecar, are counted and removed.
+type ArchiveSink struct {
+	logger       *slog.Logger
+	dir          string
+	maxRetries   int
+	maxBytes     int64
+	maxAge       time.Duration
+	minFreeBytes uint64
+	interval     time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type archiveSidecar struct {
+	ID         string            `json:"id"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Size       int64             `json:"size"`
+	Hash       string            `json:"hash"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	Duration   int               `json:"duration"`
+	DeviceID   string            `json:"device_id"`
+	DeviceName string            `json:"device_name"`
+	Metadata   map[string]string `json:"metadata"`
+}
+
+type archivedClip struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// NewArchiveSink archives into dir, which must already exist: it is not
+// created so that an unmounted drive fails uploads rather than filling the
+// local disk.
+func NewArchiveSink(
+	logger *slog.Logger,
+	dir string,
+	maxRetries int,
+	maxBytes int64,
+	maxAge time.Duration,
+	minFreeBytes uint64,
+	interval time.Duration,
+) (*ArchiveSink, error) {
+	dir = filepath.Clean(dir)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not access archive directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("archive path %q is not a directory", dir)
+	}
+	return &ArchiveSink{
+		logger:       logger,
+		dir:          dir,
+		maxRetries:   maxRetries,
+		maxBytes:     maxBytes,
+		maxAge:       maxAge,
+		minFreeBytes: minFreeBytes,
+		interval:     interval,
+		done:         make(chan struct{}),
+	}, nil
+}
+
+func (a *ArchiveSink) Name() string { return "archive" }
+
+func (a *ArchiveSink) Location() string { return a.dir }
+
+func (a *ArchiveSink) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+
+	go func() {
+		defer close(a.done)
+
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			a.enforce()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (a *ArchiveSink) Stop() error {
+	if a.cancel != nil {
+		a.cancel()
+		<-a.done
+	}
+	return nil
+}
+
+func (a *ArchiveSink) Upload(ctx context.Context, snapshot *uploader.Snapshot) error {
+	if _, err := os.Stat(snapshot.Path); err != nil {
+		return fmt.Errorf("could not stat snapshot: %w", err)
+	}
+
+	target := filepath.Join(
+		a.dir,
+		snapshot.Timestamp.UTC().Format("2006/01/02"),
+		snapshot.DeviceID,
+		snapshot.ID+filepath.Ext(snapshot.Path),
+	)
+	err := retry(ctx, a.logger, a.Name(), a.maxRetries, archiveRetryable, func() error {
+		return a.store(snapshot, target)
+	})
+	if err != nil {
+		return fmt.Errorf("could not archive %s: %w", target, err)
+	}
+	return nil
+}
+
+func (a *ArchiveSink) store(snapshot *uploader.Snapshot, target string) error {
+	if _, err := os.Stat(a.dir); err != nil {
+		return fmt.Errorf("archive directory unavailable: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return fmt.Errorf("could not create archive directory: %w", err)
+	}
+
+	// a manifest describes itself, and its name would collide with the sidecar
+	if snapshot.Metadata["kind"] == "manifest" {
+		if err := copyFileAtomic(snapshot.Path, target, snapshot.Timestamp); err != nil {
+			return fmt.Errorf("could not copy manifest: %w", err)
+		}
+		return nil
+	}
+
+	sidecar, err := json.MarshalIndent(archiveSidecar{
+		ID:         snapshot.ID,
+		Timestamp:  snapshot.Timestamp,
+		Size:       snapshot.Size,
+		Hash:       snapshot.Hash,
+		Width:      snapshot.Width,
+		Height:     snapshot.Height,
+		Duration:   snapshot.Duration,
+		DeviceID:   snapshot.DeviceID,
+		DeviceName: snapshot.DeviceName,
+		Metadata:   snapshot.Metadata,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode sidecar: %w", err)
+	}
+	if err := writeFileAtomic(sidecarPath(target), sidecar, 0o644); err != nil {
+		return fmt.Errorf("could not write sidecar: %w", err)
+	}
+
+	if err := copyFileAtomic(snapshot.Path, target, snapshot.Timestamp); err != nil {
+		return fmt.Errorf("could not copy snapshot: %w", err)
+	}
+	return nil
+}
+
+// copyFileAtomic copies src to a temporary file next to dst, syncs it and
+// renames it over dst. The copy gets modTime so retention ages clips by
+// capture rather than archive time.
+func copyFileAtomic(src, dst string, modTime time.Time) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+"*"+archivePartExt)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), modTime, modTime); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (a *ArchiveSink) enforce() {
+	if a.maxBytes == 0 && a.maxAge == 0 && a.minFreeBytes == 0 {
+		return
+	}
+
+	clips, total, err := a.scan()
+	if err != nil {
+		a.logger.Error("Failed to scan archive", "dir", a.dir, "error", err)
+		return
+	}
+	sort.Slice(clips, func(i, j int) bool { return clips[i].modTime.Before(clips[j].modTime) })
+
+	for len(clips) > 0 {
+		clip := clips[0]
+		var reason string
+		switch {
+		case a.maxAge > 0 && time.Since(clip.modTime) > a.maxAge:
+			reason = evictMaxAge
+		case a.maxBytes > 0 && total > a.maxBytes:
+			reason = evictMaxSize
+		case a.minFreeBytes > 0:
+			free, err := freeBytes(a.dir)
+			if err != nil {
+				a.logger.Error("Failed to read free disk space", "dir", a.dir, "error", err)
+				return
+			}
+			if free < a.minFreeBytes {
+				reason = evictMinFree
+			}
+		}
+		if reason == "" {
+			return
+		}
+
+		a.remove(clip, reason)
+		total -= clip.size
+		clips = clips[1:]
+	}
+}
+
+// scan lists archived clips and their total size. Only files laid out as
+// the sink stores clips, with a sidecar, are listed, so other files in the
+// directory are left alone. Clips being written are hidden under temporary
+// names and skipped.
+func (a *ArchiveSink) scan() ([]archivedClip, int64, error) {
+	var clips []archivedClip
+	var total int64
+	err := filepath.WalkDir(a.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if !d.Type().IsRegular() || strings.HasPrefix(name, ".") ||
+			strings.HasSuffix(name, archiveSidecarExt) || strings.HasSuffix(name, archivePartExt) ||
+			!a.archived(path) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		clips = append(clips, archivedClip{path: path, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	return clips, total, err
+}
+
+// archived reports whether path is where the sink stores a clip,
+// <yyyy>/<mm>/<dd>/<device id>/<snapshot id><ext>, and has its sidecar.
+func (a *ArchiveSink) archived(path string) bool {
+	rel, err := filepath.Rel(a.dir, path)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) != 5 {
+		return false
+	}
+	if _, err := time.Parse("2006/01/02", strings.Join(parts[:3], "/")); err != nil {
+		return false
+	}
+	_, err = os.Stat(sidecarPath(path))
+	return err == nil
+}
+
+func (a *ArchiveSink) remove(clip archivedClip, reason string) {
+	if err := os.Remove(clip.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		a.logger.Error("Failed to remove archived snapshot", "path", clip.path, "error", err)
+		return
+	}
+	if err := os.Remove(sidecarPath(clip.path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		a.logger.Warn("Failed to remove archived sidecar", "path", clip.path, "error", err)
+	}
+	if err := os.Remove(archivedManifestPath(clip.path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		a.logger.Warn("Failed to remove archived manifest", "path", clip.path, "error", err)
+	}
+
+	// drop emptied device and date directories, up to the archive root
+	for dir := filepath.Dir(clip.path); dir != a.dir && strings.HasPrefix(dir, a.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	a.logger.Info(
+		"Archived snapshot removed",
+		"path", clip.path,
+		"reason", reason,
+		"size_mb", fmt.Sprintf("%.2f", float64(clip.size)/(1024*1024)),
+		"age", time.Since(clip.modTime).Round(time.Second),
+	)
+}
+
+func sidecarPath(clipPath string) string {
+	return strings.TrimSuffix(clipPath, filepath.Ext(clipPath)) + archiveSidecarExt
+}
+
+// archivedManifestPath returns where the manifest of an archived clip is
+// stored: manifests are archived under the clip ID plus manifestIDSuffix.
+func archivedManifestPath(clipPath string) string {
+	return strings.TrimSuffix(clipPath, filepath.Ext(clipPath)) + manifestIDSuffix + archiveSidecarExt
+}
+
+// archiveRetryable retries any failure: the archive may come back, e.g.
+// after a NAS reconnects or space is freed. A missing snapshot file is
+// caught before the first attempt.
+func archiveRetryable(err error) bool {
+	return !errors.Is(err, context.Canceled)
+}
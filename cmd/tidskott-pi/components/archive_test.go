@@ -0,0 +1,63 @@
+package components
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveRetentionKeepsForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+
+	a, err := NewArchiveSink(discardLogger(), dir, 0, 0, 24*time.Hour, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := writeClip(t, t.TempDir(), "a", old)
+	snapshot.DeviceID = "pi"
+	if err := a.Upload(context.Background(), snapshot); err != nil {
+		t.Fatal(err)
+	}
+	archived := filepath.Join(dir, old.UTC().Format("2006/01/02"), "pi", "a.mp4")
+
+	// old files that only look like clips
+	foreign := []string{
+		filepath.Join(dir, "photos", "holiday.mp4"),
+		filepath.Join(dir, "backup.tar"),
+		filepath.Join(dir, old.UTC().Format("2006/01/02"), "pi", "b.mp4"), // no sidecar
+		filepath.Join(dir, "2024", "13", "01", "pi", "c.mp4"),             // not a date
+		filepath.Join(dir, "2024", "03", "01", "pi", "extra", "d.mp4"),    // too deep
+	}
+	for _, path := range foreign {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("not ours"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// c.mp4 has a sidecar, but is not in a date directory
+	if err := os.WriteFile(sidecarPath(foreign[3]), []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	a.enforce()
+
+	if _, err := os.Stat(archived); !os.IsNotExist(err) {
+		t.Errorf("expired clip %s not removed", archived)
+	}
+	if _, err := os.Stat(sidecarPath(archived)); !os.IsNotExist(err) {
+		t.Error("sidecar of the expired clip not removed")
+	}
+	for _, path := range foreign {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("foreign file %s removed: %v", path, err)
+		}
+	}
+}
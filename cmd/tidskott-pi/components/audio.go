@@ -0,0 +1,191 @@
+package components
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"github.com/alesr/tidskott-pi/pkg/audio"
+)
+
+const (
+	TriggerAudio = "audio"
+
+	AudioMetricRMS  = "rms"
+	AudioMetricPeak = "peak"
+
+	audioMaxBackoff = 30 * time.Second
+)
+
+// AudioMonitor measures the microphone level in fixed windows and
+// triggers a snapshot when it crosses the threshold. It runs its own
+// capture process, as the video pipeline has no audio to tap.
+type AudioMonitor struct {
+	logger     *slog.Logger
+	snapshots  *SnapshotHandler
+	events     *Events
+	device     string
+	sampleRate int
+	window     time.Duration
+	metric     string
+	gate       *audio.Gate
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewAudioMonitor(
+	logger *slog.Logger,
+	device string,
+	sampleRate int,
+	window time.Duration,
+	metric string,
+	thresholdDBFS, hysteresisDB float64,
+	cooldown time.Duration,
+	snapshots *SnapshotHandler,
+	events *Events,
+) *AudioMonitor {
+	return &AudioMonitor{
+		logger:     logger,
+		snapshots:  snapshots,
+		events:     events,
+		device:     device,
+		sampleRate: sampleRate,
+		window:     window,
+		metric:     metric,
+		gate:       audio.NewGate(thresholdDBFS, hysteresisDB, cooldown),
+		done:       make(chan struct{}),
+	}
+}
+
+func (a *AudioMonitor) Start(ctx context.Context) {
+	ctx, a.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(a.done)
+
+		backoff := time.Second
+		for {
+			started := time.Now()
+			err := a.capture(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if time.Since(started) > audioMaxBackoff {
+				backoff = time.Second
+			}
+
+			a.logger.Error("Audio capture stopped, restarting", "error", err, "in", backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, audioMaxBackoff)
+		}
+	}()
+}
+
+// Stop ends capture and waits for it to exit.
+func (a *AudioMonitor) Stop() {
+	a.cancel()
+	<-a.done
+}
+
+func (a *AudioMonitor) capture(ctx context.Context) error {
+	cmd := a.command(ctx)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("could not create stdout pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not start audio capture: %w", err)
+	}
+	defer cmd.Wait()
+
+	a.logger.Info("Audio monitor started", "device", a.device, "sample_rate", a.sampleRate, "pid", cmd.Process.Pid)
+
+	samplesPerWindow := int(int64(a.sampleRate) * a.window.Milliseconds() / 1000)
+	raw := make([]byte, samplesPerWindow*2)
+	samples := make([]int16, samplesPerWindow)
+	reader := bufio.NewReader(stdout)
+
+	for {
+		if _, err := io.ReadFull(reader, raw); err != nil {
+			return fmt.Errorf("could not read audio: %w", err)
+		}
+		for i := range samples {
+			samples[i] = int16(binary.LittleEndian.Uint16(raw[2*i:]))
+		}
+
+		rms, peak := audio.Levels(samples)
+		level := rms
+		if a.metric == AudioMetricPeak {
+			level = peak
+		}
+
+		if a.gate.Update(level, time.Now()) {
+			a.trigger(ctx, rms, peak)
+		}
+	}
+}
+
+func (a *AudioMonitor) trigger(ctx context.Context, rms, peak float64) {
+	metadata := map[string]string{
+		"audio_peak_dbfs": fmt.Sprintf("%.1f", peak),
+		"audio_rms_dbfs":  fmt.Sprintf("%.1f", rms),
+	}
+
+	a.logger.Info("Audio level exceeded threshold", "peak_dbfs", metadata["audio_peak_dbfs"], "rms_dbfs", metadata["audio_rms_dbfs"])
+	a.events.Publish(Event{
+		Type:    EventAudioTriggered,
+		Trigger: TriggerAudio,
+		Details: metadata,
+	})
+
+	// keep reading while the snapshot is requested so the pipe doesn't back up
+	go func() {
+		if err := a.snapshots.Trigger(ctx, TriggerAudio, metadata); err != nil {
+			a.logger.Error("Failed to trigger audio snapshot", "error", err)
+		}
+	}()
+}
+
+// command captures mono 16-bit little-endian PCM on stdout, with arecord on
+// the Pi and ffmpeg's avfoundation input on macOS.
+func (a *AudioMonitor) command(ctx context.Context) *exec.Cmd {
+	if runtime.GOOS == "darwin" {
+		device := a.device
+		if device == "default" {
+			device = "0"
+		}
+		return exec.CommandContext(
+			ctx,
+			"ffmpeg",
+			"-hide_banner",
+			"-loglevel", "error",
+			"-f", "avfoundation",
+			"-i", ":"+device,
+			"-ac", "1",
+			"-ar", fmt.Sprintf("%d", a.sampleRate),
+			"-f", "s16le",
+			"-",
+		)
+	}
+
+	return exec.CommandContext(
+		ctx,
+		"arecord",
+		"-q",
+		"-D", a.device,
+		"-f", "S16_LE",
+		"-c", "1",
+		"-r", fmt.Sprintf("%d", a.sampleRate),
+		"-t", "raw",
+	)
+}
@@ -0,0 +1,259 @@
+package components
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditActions maps the events recorded in the audit log to their actions.
+var auditActions = map[EventType]string{
+	EventSnapshotCreated: "created",
+	EventSnapshotHashed:  "hashed",
+	EventSnapshotQueued:  "queued",
+	EventUploadSucceeded: "uploaded",
+	EventUploadFailed:    "upload_failed",
+	EventSnapshotDropped: "dropped",
+	EventSnapshotDeleted: "deleted",
+	EventSnapshotEvicted: "evicted",
+}
+
+// AuditEntry is one line of the audit log.
+type AuditEntry struct {
+	Time       time.Time         `json:"time"`
+	Action     string            `json:"action"`
+	SnapshotID string            `json:"snapshot_id,omitempty"`
+	Path       string            `json:"path,omitempty"`
+	Size       int64             `json:"size,omitempty"`
+	Hash       string            `json:"hash,omitempty"`
+	Trigger    string            `json:"trigger,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// AuditLog appends the lifecycle of every snapshot to a JSONL file, so what
+// happened to a clip can be reconstructed after the fact. Once the file
+// reaches maxBytes it is rotated to <path>.1, <path>.2 and so on, keeping
+// maxFiles rotated files.
+type AuditLog struct {
+	logger   *slog.Logger
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewAuditLog(logger *slog.Logger, path string, maxBytes int64, maxFiles int, events *Events) (*AuditLog, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("could not create audit log directory: %w", err)
+		}
+	}
+
+	a := &AuditLog{
+		logger:   logger,
+		path:     path,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	events.Subscribe(a.record)
+	return a, nil
+}
+
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not stat audit log: %w", err)
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// record appends event if it is a snapshot lifecycle event. It writes
+// synchronously, so an entry is in the file before the next step of the
+// snapshot is.
+func (a *AuditLog) record(event Event) {
+	action, ok := auditActions[event.Type]
+	if !ok {
+		return
+	}
+
+	line, err := json.Marshal(AuditEntry{
+		Time:       event.Time.UTC(),
+		Action:     action,
+		SnapshotID: event.SnapshotID,
+		Path:       event.Path,
+		Size:       event.Size,
+		Hash:       event.Hash,
+		Trigger:    event.Trigger,
+		Error:      event.Error,
+		Details:    event.Details,
+	})
+	if err != nil {
+		a.logger.Error("Failed to encode audit entry", "action", action, "id", event.SnapshotID, "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return
+	}
+	if a.size > 0 && a.size+int64(len(line)) > a.maxBytes {
+		if err := a.rotate(); err != nil {
+			a.logger.Error("Failed to rotate audit log", "path", a.path, "error", err)
+			if a.file == nil {
+				return
+			}
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		a.logger.Error("Failed to write audit entry", "action", action, "id", event.SnapshotID, "error", err)
+	}
+}
+
+// rotate shifts the rotated files up by one, dropping the oldest, and
+// starts a new file. If the current file cannot be moved, it keeps growing.
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		a.logger.Warn("Failed to close audit log", "path", a.path, "error", err)
+	}
+	a.file = nil
+
+	for i := a.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(rotatedAuditPath(a.path, i), rotatedAuditPath(a.path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			a.logger.Warn("Failed to rotate audit log file", "path", rotatedAuditPath(a.path, i), "error", err)
+		}
+	}
+	renameErr := os.Rename(a.path, rotatedAuditPath(a.path, 1))
+	if err := a.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+func rotatedAuditPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// AuditQuery selects audit entries. Zero fields match everything.
+type AuditQuery struct {
+	// SnapshotID matches the entries of a snapshot, including those of its
+	// manifest and any entry about one of its files, e.g. an eviction
+	// recorded before evictions carried the snapshot ID.
+	SnapshotID string
+	Since      time.Time
+	Until      time.Time
+}
+
+// ReadAudit returns the entries of the audit log at path and its rotated
+// files that match query, oldest first. Lines that cannot be parsed, e.g. one
+// cut short by a power loss, are skipped.
+func ReadAudit(path string, maxFiles int, query AuditQuery) ([]AuditEntry, error) {
+	var files []string
+	for i := maxFiles; i >= 1; i-- {
+		files = append(files, rotatedAuditPath(path, i))
+	}
+	files = append(files, path)
+
+	// files of the snapshot, to match entries that only have a path
+	paths := make(map[string]bool)
+	if query.SnapshotID != "" {
+		err := scanAudit(files, func(entry AuditEntry) {
+			if auditEntryOf(entry, query.SnapshotID) && entry.Path != "" {
+				paths[entry.Path] = true
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []AuditEntry
+	err := scanAudit(files, func(entry AuditEntry) {
+		if !query.Since.IsZero() && entry.Time.Before(query.Since) {
+			return
+		}
+		if !query.Until.IsZero() && entry.Time.After(query.Until) {
+			return
+		}
+		if query.SnapshotID != "" && !auditEntryOf(entry, query.SnapshotID) && !paths[entry.Path] {
+			return
+		}
+		entries = append(entries, entry)
+	})
+	return entries, err
+}
+
+func auditEntryOf(entry AuditEntry, snapshotID string) bool {
+	return entry.SnapshotID == snapshotID || entry.SnapshotID == snapshotID+manifestIDSuffix
+}
+
+func scanAudit(files []string, fn func(AuditEntry)) error {
+	for _, file := range files {
+		f, err := os.Open(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not open audit log: %w", err)
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var entry AuditEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				continue
+			}
+			fn(entry)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", file, err)
+		}
+	}
+	return nil
+}
@@ -30,25 +30,10 @@ func NewVideoBuffer(
 		cameraFactory = raspberry.NewRaspberryPiCameraFactory(logger)
 	}
 
-	// TODO(alesr): move validation
-
-	// validate window duration
+	// the durations are checked by config.Validate
 	window := time.Duration(windowSeconds) * time.Second
-	if window < 5*time.Second {
-		return nil, fmt.Errorf("window duration must be at least 5 seconds, got %s", window)
-	}
-
-	// validate snapshot duration
 	snapshotDur := time.Duration(snapshotDuration) * time.Second
-	if snapshotDur < 1*time.Second {
-		return nil, fmt.Errorf("snapshot duration must be at least 1 second, got %s", snapshotDur)
-	}
-
-	// validate snapshot interval
 	snapshotIntervalDur := time.Duration(snapshotInterval) * time.Second
-	if snapshotIntervalDur < 1*time.Second {
-		return nil, fmt.Errorf("snapshot interval must be at least 1 second, got %s", snapshotIntervalDur)
-	}
 
 	bufferOpts := []buffer.Option{
 		buffer.WithVideoSource(cameraFactory),
@@ -0,0 +1,107 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+// recentUploads is how many uploaded hashes the Uploader remembers to skip
+// identical clips.
+const recentUploads = 1024
+
+// HubCheck asks the hub whether it already has a clip, by SHA-256, so
+// clips uploaded before a crash and replayed from the spool are not sent
+// again. The hub answers HEAD <url> with 200 if it has the clip and 404 if
+// not.
+type HubCheck struct {
+	client      *http.Client
+	urlTemplate string        // {sha256} is replaced by the hash
+	tokens      *TokenManager // nil without auth
+}
+
+func NewHubCheck(client *http.Client, urlTemplate string, tokens *TokenManager) *HubCheck {
+	return &HubCheck{
+		client:      withTimeout(client, 10*time.Second),
+		urlTemplate: urlTemplate,
+		tokens:      tokens,
+	}
+}
+
+func (c *HubCheck) Exists(ctx context.Context, hash string) (bool, error) {
+	if hash == "" {
+		return false, nil
+	}
+
+	target := strings.ReplaceAll(c.urlTemplate, "{sha256}", hash)
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+	if err != nil {
+		return false, fmt.Errorf("could not create request: %w", err)
+	}
+
+	var resp *http.Response
+	if c.tokens != nil {
+		resp, err = c.tokens.Do(ctx, c.client, req)
+	} else {
+		resp, err = c.client.Do(req)
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("existence check returned %s", resp.Status)
+}
+
+// hashSet is a set of hashes bounded to the most recently added.
+type hashSet struct {
+	max   int
+	set   map[string]bool
+	order []string
+}
+
+func newHashSet(max int) *hashSet {
+	return &hashSet{max: max, set: make(map[string]bool)}
+}
+
+func (s *hashSet) Add(hash string) {
+	if hash == "" || s.set[hash] {
+		return
+	}
+	if len(s.order) == s.max {
+		delete(s.set, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.set[hash] = true
+	s.order = append(s.order, hash)
+}
+
+func (s *hashSet) Has(hash string) bool { return s.set[hash] }
+
+// alreadyOnHub reports whether check finds snapshot on the hub. Check
+// failures are logged and treated as not found, so the clip is uploaded.
+func alreadyOnHub(ctx context.Context, logger *slog.Logger, check *HubCheck, snapshot *uploader.Snapshot) bool {
+	if check == nil {
+		return false
+	}
+	exists, err := check.Exists(ctx, snapshot.Hash)
+	if err != nil {
+		logger.Warn("Failed to check hub for snapshot, uploading", "id", snapshot.ID, "error", err)
+		return false
+	}
+	if exists {
+		logger.Info("Snapshot already on hub, skipping upload", "id", snapshot.ID, "hash", snapshot.Hash)
+	}
+	return exists
+}
@@ -0,0 +1,129 @@
+package components
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"filippo.io/age"
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+const (
+	// EncryptedExt is appended to the path of encrypted snapshots.
+	EncryptedExt = ".age"
+
+	encryptionScheme = "age-encryption.org/v1"
+)
+
+// Encryptor replaces snapshot files with copies encrypted with age to the
+// hub public key, so clips waiting for upload cannot be read off a stolen
+// device.
+type Encryptor struct {
+	recipient *age.X25519Recipient
+	keyID     string
+}
+
+// NewEncryptor encrypts to recipient, an age X25519 recipient (age1...).
+func NewEncryptor(recipient string) (*Encryptor, error) {
+	r, err := age.ParseX25519Recipient(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse recipient: %w", err)
+	}
+	sum := sha256.Sum256([]byte(r.String()))
+	return &Encryptor{recipient: r, keyID: hex.EncodeToString(sum[:8])}, nil
+}
+
+// Encrypt seals the snapshot file to <path>.age and points snapshot at the
+// sealed file. Hash and Size then describe the sealed file; the plaintext
+// ones are kept in the metadata with the scheme. The caller removes the
+// plaintext.
+func (e *Encryptor) Encrypt(snapshot *uploader.Snapshot) error {
+	src, err := os.Open(snapshot.Path)
+	if err != nil {
+		return fmt.Errorf("could not open snapshot: %w", err)
+	}
+	defer src.Close()
+
+	target := snapshot.Path + EncryptedExt
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*")
+	if err != nil {
+		return fmt.Errorf("could not create encrypted snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(tmp, hasher)}
+	w, err := age.Encrypt(counter, e.recipient)
+	if err == nil {
+		if _, err = io.Copy(w, src); err == nil {
+			err = w.Close()
+		}
+	}
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not encrypt snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write encrypted snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write encrypted snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return fmt.Errorf("could not write encrypted snapshot: %w", err)
+	}
+
+	e.seal(snapshot, target, hex.EncodeToString(hasher.Sum(nil)), counter.n)
+	return nil
+}
+
+// Adopt points snapshot at the sealed file an earlier run left next to it,
+// as Encrypt would, and reports whether there was one. Sealed files are
+// renamed into place once complete, so one that exists is whole.
+func (e *Encryptor) Adopt(snapshot *uploader.Snapshot) (bool, error) {
+	target := snapshot.Path + EncryptedExt
+	info, err := os.Stat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not stat encrypted snapshot: %w", err)
+	}
+	hash, err := calculateHash(target)
+	if err != nil {
+		return false, err
+	}
+	e.seal(snapshot, target, hash, info.Size())
+	return true, nil
+}
+
+// seal records the plaintext hash and size with the scheme and points
+// snapshot at the sealed file at path.
+func (e *Encryptor) seal(snapshot *uploader.Snapshot, path, hash string, size int64) {
+	snapshot.Metadata["encryption"] = encryptionScheme
+	snapshot.Metadata["encryption_key_id"] = e.keyID
+	snapshot.Metadata["plaintext_sha256"] = snapshot.Hash
+	snapshot.Metadata["plaintext_size"] = strconv.FormatInt(snapshot.Size, 10)
+	snapshot.Path = path
+	snapshot.Hash = hash
+	snapshot.Size = size
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
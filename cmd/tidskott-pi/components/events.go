@@ -0,0 +1,68 @@
+package components
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventSnapshotCreated   EventType = "snapshot_created"
+	EventSnapshotHashed    EventType = "snapshot_hashed" // the file to upload is final, e.g. encrypted
+	EventSnapshotQueued    EventType = "snapshot_queued"
+	EventSnapshotDeleted   EventType = "snapshot_deleted" // removed locally after upload
+	EventSnapshotDropped   EventType = "snapshot_dropped"
+	EventSnapshotEvicted   EventType = "snapshot_evicted"
+	EventUploadSucceeded   EventType = "upload_succeeded"
+	EventUploadFailed      EventType = "upload_failed"
+	EventServerUnreachable EventType = "server_unreachable"
+	EventTamperDetected    EventType = "tamper_detected"
+	EventTamperCleared     EventType = "tamper_cleared"
+	EventAudioTriggered    EventType = "audio_triggered"
+)
+
+type Event struct {
+	Type       EventType         `json:"type"`
+	Time       time.Time         `json:"time"`
+	DeviceID   string            `json:"device_id"`
+	SnapshotID string            `json:"snapshot_id,omitempty"`
+	Path       string            `json:"path,omitempty"`
+	Size       int64             `json:"size,omitempty"`
+	Hash       string            `json:"hash,omitempty"`
+	Trigger    string            `json:"trigger,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// Events fans snapshot lifecycle events out to subscribers.
+// Handlers are called synchronously and must not block.
+type Events struct {
+	deviceID string
+
+	mu       sync.RWMutex
+	handlers []func(Event)
+}
+
+func NewEvents(deviceID string) *Events { return &Events{deviceID: deviceID} }
+
+func (e *Events) Subscribe(handler func(Event)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.handlers = append(e.handlers, handler)
+}
+
+func (e *Events) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.DeviceID == "" {
+		event.DeviceID = e.deviceID
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, handler := range e.handlers {
+		handler(event)
+	}
+}
@@ -0,0 +1,38 @@
+package components
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const ffmpegTimeout = 10 * time.Second
+
+// extractKeyframe runs ffmpeg on the first video frame of path and returns
+// the encoded output. outputArgs select the filters and output format.
+func extractKeyframe(ctx context.Context, path string, outputArgs ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, ffmpegTimeout)
+	defer cancel()
+
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-i", path,
+		"-frames:v", "1",
+	}
+	args = append(args, outputArgs...)
+	args = append(args, "-")
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("could not extract frame: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
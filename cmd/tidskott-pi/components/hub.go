@@ -0,0 +1,197 @@
+package components
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/alesr/tidskott-pi/internal/pkg/errutil"
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+// hubStatusError is an unexpected response from the hub.
+type hubStatusError struct {
+	status int
+}
+
+func (e *hubStatusError) Error() string {
+	return fmt.Sprintf("hub returned %d %s", e.status, http.StatusText(e.status))
+}
+
+// HubSink uploads snapshots to the tidskott hub in a single multipart POST
+// to the upload endpoint: the clip in the file field, the snapshot details
+// and upload metadata as form fields. Requests go through the hub client,
+// so the [tls] settings, the shared access token and the bandwidth limit
+// apply to them as to the other hub requests.
+type HubSink struct {
+	logger     *slog.Logger
+	client     *http.Client
+	endpoint   string
+	tokens     *TokenManager // nil without auth
+	check      *HubCheck     // nil to upload without checking
+	maxRetries int
+}
+
+// NewHubSink returns a sink that authenticates with tokens from tokens, if
+// set.
+func NewHubSink(
+	logger *slog.Logger,
+	client *http.Client,
+	endpoint string,
+	maxRetries int,
+	tokens *TokenManager,
+	check *HubCheck,
+) *HubSink {
+	return &HubSink{
+		logger:     logger,
+		client:     newThrottledClient(client),
+		endpoint:   endpoint,
+		tokens:     tokens,
+		check:      check,
+		maxRetries: maxRetries,
+	}
+}
+
+func (h *HubSink) Name() string { return "hub" }
+
+func (h *HubSink) Location() string { return h.endpoint }
+
+// Upload posts snapshot to the hub, unless the hub already has it.
+func (h *HubSink) Upload(ctx context.Context, snapshot *uploader.Snapshot) error {
+	if alreadyOnHub(ctx, h.logger, h.check, snapshot) {
+		return nil
+	}
+
+	err := retry(ctx, h.logger, h.Name(), h.maxRetries, hubRetryable, func() error {
+		return h.post(ctx, snapshot)
+	})
+	if err != nil {
+		if errutil.IsConnRefused(err) {
+			h.logger.Error(
+				"Failed to connect to the server",
+				"endpoint", h.endpoint,
+				"error", err,
+				"hint", "Make sure the external hub server is running at the specified endpoint",
+			)
+		}
+		return fmt.Errorf("could not upload %s to the hub: %w", snapshot.ID, err)
+	}
+	return nil
+}
+
+func (h *HubSink) post(ctx context.Context, snapshot *uploader.Snapshot) error {
+	f, err := os.Open(snapshot.Path)
+	if err != nil {
+		return fmt.Errorf("could not open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat snapshot: %w", err)
+	}
+
+	// the form is built around the file rather than copied into memory with
+	// it, so the body can be replayed and its length is known up front
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	fields := hubMetadata(snapshot)
+	for _, k := range slices.Sorted(maps.Keys(fields)) {
+		if err := mw.WriteField(k, fields[k]); err != nil {
+			return fmt.Errorf("could not write form field: %w", err)
+		}
+	}
+	if _, err := mw.CreateFormFile("file", filepath.Base(snapshot.Path)); err != nil {
+		return fmt.Errorf("could not write form file: %w", err)
+	}
+	head := bytes.Clone(form.Bytes())
+	form.Reset()
+	if err := mw.Close(); err != nil {
+		return fmt.Errorf("could not write form: %w", err)
+	}
+	tail := form.Bytes()
+
+	body := func() io.ReadCloser {
+		return io.NopCloser(io.MultiReader(
+			bytes.NewReader(head),
+			io.NewSectionReader(f, 0, info.Size()),
+			bytes.NewReader(tail),
+		))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.endpoint, body())
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	req.GetBody = func() (io.ReadCloser, error) { return body(), nil }
+	req.ContentLength = int64(len(head)) + info.Size() + int64(len(tail))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var resp *http.Response
+	if h.tokens != nil {
+		resp, err = h.tokens.Do(ctx, h.client, req)
+	} else {
+		resp, err = h.client.Do(req)
+	}
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &hubStatusError{status: resp.StatusCode}
+	}
+	return nil
+}
+
+// hubMetadata returns the snapshot details and upload metadata the hub
+// receives with a clip. The details win over metadata of the same name.
+func hubMetadata(snapshot *uploader.Snapshot) map[string]string {
+	fields := map[string]string{
+		"id":          snapshot.ID,
+		"sha256":      snapshot.Hash,
+		"device_id":   snapshot.DeviceID,
+		"device_name": snapshot.DeviceName,
+		"timestamp":   snapshot.Timestamp.UTC().Format(time.RFC3339),
+		"width":       strconv.Itoa(snapshot.Width),
+		"height":      strconv.Itoa(snapshot.Height),
+		"duration":    strconv.Itoa(snapshot.Duration),
+	}
+	for k, v := range snapshot.Metadata {
+		if _, ok := fields[k]; !ok {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// hubRetryable retries server errors, throttling, timeouts and network
+// failures. A rejected token is renewed and retried once by the
+// TokenManager, so 401 is not retried here.
+func hubRetryable(err error) bool {
+	var statusErr *hubStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.status {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return true
+		}
+		return statusErr.status >= 500
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return false
+	}
+	return !errors.Is(err, context.Canceled)
+}
@@ -0,0 +1,98 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHubSinkUpload(t *testing.T) {
+	snapshot := writeClip(t, t.TempDir(), "a", time.Now())
+	clip, err := os.ReadFile(snapshot.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tokens, posts int
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /auth/token", func(w http.ResponseWriter, r *http.Request) {
+		tokens++
+		fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": 3600}`, tokens)
+	})
+	mux.HandleFunc("POST /upload", func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		switch {
+		case posts == 1:
+			// the hub rejects the first token, then fails once
+			http.Error(w, "expired", http.StatusUnauthorized)
+			return
+		case posts == 2:
+			if got := r.Header.Get("Authorization"); got != "Bearer token-2" {
+				t.Errorf("got Authorization %q after a rejected token, want Bearer token-2", got)
+			}
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("could not parse form: %v", err)
+			return
+		}
+		for field, want := range map[string]string{
+			"id":       snapshot.ID,
+			"sha256":   snapshot.Hash,
+			"trigger":  TriggerScheduled,
+			"priority": PriorityRoutine.String(),
+		} {
+			if got := r.FormValue(field); got != want {
+				t.Errorf("got %s %q, want %q", field, got, want)
+			}
+		}
+		f, header, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("no file: %v", err)
+			return
+		}
+		defer f.Close()
+		data, _ := io.ReadAll(f)
+		if header.Filename != "a.mp4" || string(data) != string(clip) {
+			t.Errorf("got file %q with %q, want a.mp4 with %q", header.Filename, data, clip)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	manager := NewTokenManager(discardLogger(), server.Client(), server.URL+"/auth/token", "id", "secret", nil, "")
+	sink := NewHubSink(discardLogger(), server.Client(), server.URL+"/upload", 1, manager, nil)
+	if err := sink.Upload(context.Background(), snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if posts != 3 {
+		t.Errorf("got %d posts, want 3", posts)
+	}
+}
+
+func TestHubSinkGivesUp(t *testing.T) {
+	snapshot := writeClip(t, t.TempDir(), "a", time.Now())
+
+	posts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		http.Error(w, "bad clip", http.StatusUnprocessableEntity)
+	}))
+	defer server.Close()
+
+	sink := NewHubSink(discardLogger(), server.Client(), server.URL+"/upload", 3, nil, nil)
+	if err := sink.Upload(context.Background(), snapshot); err == nil {
+		t.Fatal("upload rejected by the hub succeeded")
+	}
+	if posts != 1 {
+		t.Errorf("got %d posts, want 1: client errors are not retried", posts)
+	}
+}
@@ -0,0 +1,340 @@
+package components
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenExpiryMargin renews tokens this long before they expire.
+	tokenExpiryMargin = 30 * time.Second
+
+	tokenMinBackoff = time.Second
+	tokenMaxBackoff = time.Minute
+)
+
+// TokenState describes the current hub access token, for status output.
+type TokenState struct {
+	Valid       bool      `json:"valid"`
+	ExpiresAt   time.Time `json:"expires_at,omitzero"`
+	RefreshedAt time.Time `json:"refreshed_at,omitzero"`
+	Refreshes   int       `json:"refreshes"`
+	Scopes      []string  `json:"scopes,omitempty"`
+	Audience    string    `json:"audience,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// tokenFetch is a token request shared by the callers that need a token
+// while it runs.
+type tokenFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// TokenManager fetches and caches hub access tokens with the OAuth2 client
+// credentials grant, for the hub uploads and checks. Once started it
+// refreshes the token ahead of expiry, so requests do not wait for the
+// token endpoint.
+type TokenManager struct {
+	logger       *slog.Logger
+	client       *http.Client
+	endpoint     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	audience     string
+
+	mu          sync.Mutex
+	token       string
+	expiry      time.Time
+	refreshedAt time.Time
+	refreshes   int
+	lastErr     error
+	fetching    *tokenFetch // the fetch in progress, if any
+
+	// signals the refresher that the token was dropped
+	invalidated chan struct{}
+	cancel      context.CancelFunc
+	done        chan struct{}
+}
+
+func NewTokenManager(
+	logger *slog.Logger,
+	client *http.Client,
+	endpoint, clientID, clientSecret string,
+	scopes []string,
+	audience string,
+) *TokenManager {
+	return &TokenManager{
+		logger:       logger,
+		client:       withTimeout(client, 30*time.Second),
+		endpoint:     endpoint,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scopes:       scopes,
+		audience:     audience,
+		invalidated:  make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+}
+
+// Start refreshes the token in the background until Stop is called or ctx
+// is cancelled.
+func (t *TokenManager) Start(ctx context.Context) {
+	ctx, t.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(t.done)
+
+		backoff := tokenMinBackoff
+		for {
+			wait := t.untilRefresh()
+			if wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-t.invalidated:
+					timer.Stop()
+				case <-timer.C:
+				}
+			}
+
+			if _, err := t.refresh(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				t.logger.Warn("Failed to refresh hub token", "error", err, "retry_in", backoff)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				backoff = min(backoff*2, tokenMaxBackoff)
+				continue
+			}
+			backoff = tokenMinBackoff
+		}
+	}()
+}
+
+func (t *TokenManager) Stop() {
+	t.cancel()
+	<-t.done
+}
+
+// untilRefresh returns how long the current token can still be used, less
+// the renewal margin; tokens without expiry are refreshed only when
+// invalidated.
+func (t *TokenManager) untilRefresh() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case t.token == "":
+		return 0
+	case t.expiry.IsZero():
+		return time.Duration(1<<63 - 1)
+	default:
+		return time.Until(t.expiry) - t.margin()
+	}
+}
+
+// margin is tokenExpiryMargin, or a tenth of the token lifetime for
+// short-lived tokens.
+func (t *TokenManager) margin() time.Duration {
+	return min(tokenExpiryMargin, t.expiry.Sub(t.refreshedAt)/10)
+}
+
+// Token returns a cached token, fetching a new one when it is about to
+// expire.
+func (t *TokenManager) Token(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	if t.fresh() {
+		defer t.mu.Unlock()
+		return t.token, nil
+	}
+	t.mu.Unlock()
+	return t.refresh(ctx)
+}
+
+// fresh reports whether the cached token can be used without renewing it.
+// t.mu must be held.
+func (t *TokenManager) fresh() bool {
+	return t.token != "" && (t.expiry.IsZero() || time.Until(t.expiry) > t.margin())
+}
+
+// Invalidate drops the cached token, e.g. after the hub rejected it.
+func (t *TokenManager) Invalidate() {
+	t.mu.Lock()
+	t.token = ""
+	t.mu.Unlock()
+
+	select {
+	case t.invalidated <- struct{}{}:
+	default:
+	}
+}
+
+// Do sends req with the access token. If the hub answers 401, the token is
+// fetched again and the request sent once more, provided its body can be
+// replayed.
+func (t *TokenManager) Do(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	token, err := t.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		t.Invalidate()
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	t.Invalidate()
+	if token, err = t.Token(ctx); err != nil {
+		return nil, err
+	}
+	retry := req.Clone(ctx)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, fmt.Errorf("could not replay request body: %w", err)
+		}
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+	return client.Do(retry)
+}
+
+func (t *TokenManager) State() TokenState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := TokenState{
+		Valid:       t.token != "" && (t.expiry.IsZero() || time.Now().Before(t.expiry)),
+		ExpiresAt:   t.expiry,
+		RefreshedAt: t.refreshedAt,
+		Refreshes:   t.refreshes,
+		Scopes:      t.scopes,
+		Audience:    t.audience,
+	}
+	if t.lastErr != nil {
+		state.LastError = t.lastErr.Error()
+	}
+	return state
+}
+
+// refresh fetches a new token. Concurrent callers share one request, which
+// runs without holding t.mu so the cached state can still be read.
+func (t *TokenManager) refresh(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	for t.fetching != nil {
+		f := t.fetching
+		t.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-f.done:
+		}
+		// a fetch given up by its caller is not a failure of the others
+		if f.err != nil && !errors.Is(f.err, context.Canceled) && !errors.Is(f.err, context.DeadlineExceeded) {
+			return "", f.err
+		}
+		t.mu.Lock()
+	}
+	// another caller may have refreshed while we waited
+	if t.fresh() {
+		defer t.mu.Unlock()
+		return t.token, nil
+	}
+	f := &tokenFetch{done: make(chan struct{})}
+	t.fetching = f
+	t.mu.Unlock()
+
+	token, expiresIn, err := t.fetch(ctx)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fetching = nil
+	f.err = err
+	close(f.done)
+	if err != nil {
+		t.lastErr = err
+		return "", err
+	}
+
+	now := time.Now()
+	t.token = token
+	t.refreshedAt = now
+	t.expiry = time.Time{}
+	if expiresIn > 0 {
+		t.expiry = now.Add(expiresIn)
+	}
+	t.refreshes++
+	t.lastErr = nil
+	t.logger.Debug("Refreshed hub token", "expires_in", expiresIn)
+	return t.token, nil
+}
+
+func (t *TokenManager) fetch(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {t.clientID},
+		"client_secret": {t.clientSecret},
+	}
+	if len(t.scopes) > 0 {
+		form.Set("scope", strings.Join(t.scopes, " "))
+	}
+	if t.audience != "" {
+		form.Set("audience", t.audience)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("could not create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("could not request token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", 0, fmt.Errorf("could not decode token response: %w", err)
+	}
+	if body.AccessToken == "" {
+		return "", 0, errors.New("token response has no access_token")
+	}
+	return body.AccessToken, time.Duration(body.ExpiresIn) * time.Second, nil
+}
+
+// HubURL resolves path, e.g. the auth endpoint, against the hub: paths are
+// relative to the upload endpoint without its /upload suffix.
+func HubURL(uploadEndpoint, path string) string {
+	if before, ok := strings.CutSuffix(uploadEndpoint, "/upload"); ok {
+		return before + path
+	}
+	return uploadEndpoint + path
+}
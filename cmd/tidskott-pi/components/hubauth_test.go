@@ -0,0 +1,114 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenManagerSharesFetch(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		<-release
+		fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": 3600}`, n)
+	}))
+	defer server.Close()
+
+	manager := NewTokenManager(discardLogger(), server.Client(), server.URL, "id", "secret", nil, "")
+
+	const callers = 5
+	tokens := make(chan string, callers)
+	var wg sync.WaitGroup
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := manager.Token(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			tokens <- token
+		}()
+	}
+
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// the state stays readable while the token is being fetched
+	stated := make(chan TokenState)
+	go func() { stated <- manager.State() }()
+	select {
+	case state := <-stated:
+		if state.Valid {
+			t.Error("token valid before it was fetched")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("State blocked by the token fetch")
+	}
+
+	close(release)
+	wg.Wait()
+	close(tokens)
+	for token := range tokens {
+		if token != "token-1" {
+			t.Errorf("got %q, want the shared token-1", token)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("got %d token requests, want 1", n)
+	}
+}
+
+func TestTokenManagerCancelledFetch(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm() // a disconnect is only noticed once the body is read
+		if requests.Add(1) == 1 {
+			<-r.Context().Done() // the first caller gives up
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "token", "expires_in": 3600}`)
+	}))
+	defer server.Close()
+
+	manager := NewTokenManager(discardLogger(), server.Client(), server.URL, "id", "secret", nil, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := manager.Token(ctx)
+		first <- err
+	}()
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	second := make(chan string, 1)
+	go func() {
+		token, err := manager.Token(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		second <- token
+	}()
+	cancel()
+
+	if err := <-first; err == nil {
+		t.Error("cancelled caller got a token")
+	}
+	select {
+	case token := <-second:
+		if token != "token" {
+			t.Errorf("got %q, want a token fetched again", token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting caller did not fetch the token itself")
+	}
+}
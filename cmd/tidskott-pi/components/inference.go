@@ -0,0 +1,208 @@
+package components
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+const (
+	InferenceModeHTTP = "http"
+	InferenceModeExec = "exec"
+
+	InferenceInputKeyframe = "keyframe"
+	InferenceInputClip     = "clip"
+)
+
+var _ Analyzer = (*Inference)(nil)
+
+type InferenceLabel struct {
+	Label      string  `json:"label"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Inference sends snapshots to a local object detector and attaches the
+// returned labels to the upload metadata. The detector receives either the
+// first frame as JPEG or the whole clip, as an HTTP POST body or on the
+// stdin of a command, and answers with {"labels": [{"label", "confidence"}]}.
+type Inference struct {
+	logger        *slog.Logger
+	client        *http.Client
+	mode          string
+	endpoint      string
+	command       []string
+	input         string
+	timeout       time.Duration
+	minConfidence float64
+	labels        []string
+	dropUnmatched bool
+}
+
+func NewInference(
+	logger *slog.Logger,
+	mode, endpoint string,
+	command []string,
+	input string,
+	timeout time.Duration,
+	minConfidence float64,
+	labels []string,
+	dropUnmatched bool,
+) (*Inference, error) {
+	switch mode {
+	case InferenceModeHTTP:
+		if endpoint == "" {
+			return nil, fmt.Errorf("inference endpoint is required in %s mode", mode)
+		}
+	case InferenceModeExec:
+		if len(command) == 0 {
+			return nil, fmt.Errorf("inference command is required in %s mode", mode)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported inference mode %q", mode)
+	}
+
+	return &Inference{
+		logger:        logger,
+		client:        &http.Client{},
+		mode:          mode,
+		endpoint:      endpoint,
+		command:       command,
+		input:         input,
+		timeout:       timeout,
+		minConfidence: minConfidence,
+		labels:        labels,
+		dropUnmatched: dropUnmatched,
+	}, nil
+}
+
+func (inf *Inference) Name() string { return "inference" }
+
+// Analyze returns ErrDropSnapshot for scheduled snapshots without any of the
+// configured labels when dropping is enabled. Triggered snapshots are always kept.
+func (inf *Inference) Analyze(ctx context.Context, snapshot *uploader.Snapshot) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, inf.timeout)
+	defer cancel()
+
+	body, contentType, err := inf.payload(ctx, snapshot.Path)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := body.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	var output []byte
+	switch inf.mode {
+	case InferenceModeHTTP:
+		output, err = inf.post(ctx, snapshot, body, contentType)
+	case InferenceModeExec:
+		output, err = inf.exec(ctx, snapshot, body)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Labels []InferenceLabel `json:"labels"`
+	}
+	if err := json.Unmarshal(output, &resp); err != nil {
+		return nil, fmt.Errorf("could not decode inference response: %w", err)
+	}
+
+	var found []InferenceLabel
+	for _, l := range resp.Labels {
+		if l.Confidence >= inf.minConfidence {
+			found = append(found, l)
+		}
+	}
+
+	encoded, err := json.Marshal(found)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode labels: %w", err)
+	}
+
+	names := make([]string, len(found))
+	for i, l := range found {
+		names[i] = l.Label
+	}
+	metadata := map[string]string{
+		"labels":    strings.Join(names, ","),
+		"inference": string(encoded),
+	}
+	inf.logger.Debug("Snapshot classified", "id", snapshot.ID, "labels", metadata["labels"])
+
+	if inf.dropUnmatched && len(inf.labels) > 0 && snapshot.Metadata["trigger"] == TriggerScheduled &&
+		!slices.ContainsFunc(names, func(name string) bool { return slices.Contains(inf.labels, name) }) {
+		return metadata, ErrDropSnapshot
+	}
+	return metadata, nil
+}
+
+func (inf *Inference) payload(ctx context.Context, path string) (io.Reader, string, error) {
+	if inf.input == InferenceInputClip {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not open snapshot: %w", err)
+		}
+		return file, "application/octet-stream", nil
+	}
+
+	frame, err := extractKeyframe(ctx, path, "-f", "image2", "-c:v", "mjpeg")
+	if err != nil {
+		return nil, "", err
+	}
+	return bytes.NewReader(frame), "image/jpeg", nil
+}
+
+func (inf *Inference) post(ctx context.Context, snapshot *uploader.Snapshot, body io.Reader, contentType string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, inf.endpoint, body)
+	if err != nil {
+		return nil, fmt.Errorf("could not create inference request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Snapshot-ID", snapshot.ID)
+
+	resp, err := inf.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach inference endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	output, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read inference response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inference endpoint returned %s", resp.Status)
+	}
+	return output, nil
+}
+
+func (inf *Inference) exec(ctx context.Context, snapshot *uploader.Snapshot, stdin io.Reader) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, inf.command[0], inf.command[1:]...)
+	cmd.Stdin = stdin
+	cmd.Stderr = &stderr
+	cmd.Env = append(
+		os.Environ(),
+		"TIDSKOTT_SNAPSHOT_ID="+snapshot.ID,
+		"TIDSKOTT_SNAPSHOT_PATH="+snapshot.Path,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("inference command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
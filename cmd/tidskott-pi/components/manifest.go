@@ -0,0 +1,258 @@
+package components
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+const (
+	manifestVersion = 1
+
+	// appended to the clip snapshot ID and path for its manifest
+	manifestIDSuffix   = ".manifest"
+	manifestPathSuffix = ".manifest.json"
+)
+
+// CameraSettings are the recording settings stated in manifests.
+type CameraSettings struct {
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	FPS     int    `json:"fps"`
+	Bitrate int    `json:"bitrate"`
+	Codec   string `json:"codec"`
+}
+
+// Manifest states where and how a clip was recorded. Each manifest holds
+// the hash of the previous one, so removing or reordering manifests breaks
+// the chain.
+type Manifest struct {
+	Version    int               `json:"version"`
+	Sequence   uint64            `json:"sequence"`
+	Previous   string            `json:"previous"` // hex SHA-256 of the previous manifest, "" for the first
+	SnapshotID string            `json:"snapshot_id"`
+	SHA256     string            `json:"sha256"`
+	Size       int64             `json:"size"`
+	DeviceID   string            `json:"device_id"`
+	DeviceName string            `json:"device_name"`
+	StartTime  time.Time         `json:"start_time"`
+	EndTime    time.Time         `json:"end_time"`
+	CreatedAt  time.Time         `json:"created_at"`
+	Camera     CameraSettings    `json:"camera"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	PublicKey  string            `json:"public_key"`
+}
+
+// SignedManifest is the manifest file: the manifest and the Ed25519
+// signature of its bytes exactly as they appear in the file.
+type SignedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+}
+
+type manifestChain struct {
+	Sequence uint64 `json:"sequence"`
+	Hash     string `json:"hash"`
+}
+
+// ManifestSigner signs a manifest for every clip with the device key and
+// keeps the head of the chain in chainFile, so the chain survives restarts.
+type ManifestSigner struct {
+	key        ed25519.PrivateKey
+	chainFile  string
+	deviceID   string
+	deviceName string
+	camera     CameraSettings
+
+	chain manifestChain
+}
+
+// NewManifestSigner signs with the Ed25519 key in keyFile, generating it
+// if the file does not exist.
+func NewManifestSigner(keyFile, chainFile, deviceID, deviceName string, camera CameraSettings) (*ManifestSigner, error) {
+	key, err := loadOrCreateSigningKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ManifestSigner{
+		key:        key,
+		chainFile:  chainFile,
+		deviceID:   deviceID,
+		deviceName: deviceName,
+		camera:     camera,
+	}
+	data, err := os.ReadFile(chainFile)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &s.chain); err != nil {
+			return nil, fmt.Errorf("could not parse manifest chain: %w", err)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("could not read manifest chain: %w", err)
+	}
+	return s, nil
+}
+
+// PublicKey returns the base64 device public key, to register with the hub.
+func (s *ManifestSigner) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+}
+
+// Sign writes the signed manifest of snapshot next to it, advances the
+// chain and returns the manifest as a snapshot to upload alongside the clip.
+// It must be called before the clip is encrypted, so the manifest states the
+// hash of the recording itself.
+func (s *ManifestSigner) Sign(snapshot *uploader.Snapshot, start, end time.Time) (*uploader.Snapshot, error) {
+	next := s.chain.Sequence + 1
+	manifest, err := json.Marshal(Manifest{
+		Version:    manifestVersion,
+		Sequence:   next,
+		Previous:   s.chain.Hash,
+		SnapshotID: snapshot.ID,
+		SHA256:     snapshot.Hash,
+		Size:       snapshot.Size,
+		DeviceID:   s.deviceID,
+		DeviceName: s.deviceName,
+		StartTime:  start.UTC(),
+		EndTime:    end.UTC(),
+		CreatedAt:  time.Now().UTC(),
+		Camera:     s.camera,
+		Metadata:   snapshot.Metadata,
+		PublicKey:  s.PublicKey(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not encode manifest: %w", err)
+	}
+
+	// not indented: that would re-indent the signed manifest bytes
+	signed, err := json.Marshal(SignedManifest{
+		Manifest:  manifest,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, manifest)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not encode signed manifest: %w", err)
+	}
+
+	path := snapshot.Path + manifestPathSuffix
+	if err := writeFileAtomic(path, signed, 0o644); err != nil {
+		return nil, fmt.Errorf("could not write manifest: %w", err)
+	}
+
+	sum := sha256.Sum256(manifest)
+	chain := manifestChain{Sequence: next, Hash: hex.EncodeToString(sum[:])}
+	data, err := json.Marshal(chain)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode manifest chain: %w", err)
+	}
+	if err := writeFileAtomic(s.chainFile, data, 0o600); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("could not save manifest chain: %w", err)
+	}
+	s.chain = chain
+
+	return manifestSnapshot(snapshot, path, signed, next), nil
+}
+
+// Load returns the manifest signed for snapshot before a restart, and the
+// snapshot metadata it states, or nil if none was signed. The chain has
+// already advanced past that manifest, so signing snapshot again would put
+// it in the chain twice.
+func (s *ManifestSigner) Load(snapshot *uploader.Snapshot) (*uploader.Snapshot, map[string]string, error) {
+	path := snapshot.Path + manifestPathSuffix
+	signed, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read manifest: %w", err)
+	}
+
+	var file SignedManifest
+	if err := json.Unmarshal(signed, &file); err != nil {
+		return nil, nil, fmt.Errorf("could not parse manifest: %w", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(file.Manifest, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("could not parse manifest: %w", err)
+	}
+	if manifest.SnapshotID != snapshot.ID || manifest.SHA256 != snapshot.Hash {
+		return nil, nil, fmt.Errorf("manifest %s is not that of snapshot %s", path, snapshot.ID)
+	}
+	return manifestSnapshot(snapshot, path, signed, manifest.Sequence), manifest.Metadata, nil
+}
+
+// manifestSnapshot describes the manifest file at path, holding signed, for
+// upload alongside snapshot.
+func manifestSnapshot(snapshot *uploader.Snapshot, path string, signed []byte, sequence uint64) *uploader.Snapshot {
+	fileSum := sha256.Sum256(signed)
+	return &uploader.Snapshot{
+		ID:        snapshot.ID + manifestIDSuffix,
+		Path:      path,
+		Timestamp: snapshot.Timestamp,
+		Size:      int64(len(signed)),
+		Hash:      hex.EncodeToString(fileSum[:]),
+		Metadata: map[string]string{
+			"kind":              "manifest",
+			"snapshot_id":       snapshot.ID,
+			"manifest_sequence": fmt.Sprintf("%d", sequence),
+			"trigger":           snapshot.Metadata["trigger"],
+			"priority":          snapshot.Metadata["priority"],
+		},
+		DeviceID:   snapshot.DeviceID,
+		DeviceName: snapshot.DeviceName,
+	}
+}
+
+func loadOrCreateSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM key found in %s", path)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse signing key: %w", err)
+		}
+		key, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an Ed25519 key", path)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("could not read signing key: %w", err)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate signing key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode signing key: %w", err)
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("could not create signing key directory: %w", err)
+		}
+	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, fmt.Errorf("could not write signing key: %w", err)
+	}
+	return key, nil
+}
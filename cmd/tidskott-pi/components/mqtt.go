@@ -0,0 +1,325 @@
+package components
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/alesr/tidskott-pi/pkg/mqtt"
+)
+
+const (
+	TriggerMQTT = "mqtt"
+
+	mqttStatusOnline  = "online"
+	mqttStatusOffline = "offline"
+
+	mqttCommandSnapshot = "snapshot"
+	mqttCommandPause    = "pause"
+	mqttCommandResume   = "resume"
+	mqttCommandStats    = "stats"
+	mqttCommandStatus   = "status"
+
+	mqttMaxBackoff = 30 * time.Second
+	mqttAckTimeout = 10 * time.Second
+)
+
+// MQTT connects the device to a broker: it listens for commands on
+// <prefix>/<device>/command, publishes events on <prefix>/<device>/events
+// and keeps a retained online/offline status on <prefix>/<device>/status.
+// Upload statistics and the device status are published on
+// <prefix>/<device>/stats and <prefix>/<device>/info on request.
+type MQTT struct {
+	logger    *slog.Logger
+	opts      mqtt.Options
+	qos       byte
+	deviceID  string
+	snapshots *SnapshotHandler
+	results   *Results
+	tokens    *TokenManager // nil without hub auth
+
+	commandTopic string
+	eventsTopic  string
+	statusTopic  string
+	statsTopic   string
+	infoTopic    string
+
+	outbox  chan mqtt.Message
+	pending []mqtt.Message // QoS 1 messages not acknowledged, sent again on reconnect
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func NewMQTT(
+	logger *slog.Logger,
+	broker, clientID, username, password, topicPrefix, deviceID string,
+	qos int,
+	keepAlive time.Duration,
+	snapshots *SnapshotHandler,
+	results *Results,
+	tokens *TokenManager,
+	events *Events,
+) *MQTT {
+	if clientID == "" {
+		clientID = deviceID
+	}
+
+	base := strings.TrimSuffix(topicPrefix, "/") + "/" + deviceID
+	m := &MQTT{
+		logger:       logger,
+		qos:          byte(qos),
+		deviceID:     deviceID,
+		snapshots:    snapshots,
+		results:      results,
+		tokens:       tokens,
+		commandTopic: base + "/command",
+		eventsTopic:  base + "/events",
+		statusTopic:  base + "/status",
+		statsTopic:   base + "/stats",
+		infoTopic:    base + "/info",
+		outbox:       make(chan mqtt.Message, 64),
+		done:         make(chan struct{}),
+	}
+	m.opts = mqtt.Options{
+		Broker:    broker,
+		ClientID:  clientID,
+		Username:  username,
+		Password:  password,
+		KeepAlive: keepAlive,
+		Will: &mqtt.Message{
+			Topic:   m.statusTopic,
+			Payload: []byte(mqttStatusOffline),
+			QoS:     m.qos,
+			Retain:  true,
+		},
+	}
+
+	events.Subscribe(m.publishEvent)
+	return m
+}
+
+func (m *MQTT) Start(ctx context.Context) {
+	ctx, m.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(m.done)
+
+		backoff := time.Second
+		for {
+			connected := m.session(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if connected {
+				backoff = time.Second
+			}
+
+			m.logger.Info("Reconnecting to MQTT broker", "in", backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, mqttMaxBackoff)
+		}
+	}()
+}
+
+// Stop waits for the client to publish its offline status and disconnect.
+func (m *MQTT) Stop() {
+	m.cancel()
+	<-m.done
+}
+
+// session runs a single broker connection until it drops or ctx is done.
+// It reports whether the connection was established.
+func (m *MQTT) session(ctx context.Context) bool {
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	client, err := mqtt.Dial(dialCtx, m.logger, m.opts)
+	cancel()
+	if err != nil {
+		m.logger.Error("Failed to connect to MQTT broker", "broker", m.opts.Broker, "error", err)
+		return false
+	}
+
+	if err := client.Subscribe(ctx, m.commandTopic, m.qos, func(msg mqtt.Message) {
+		go m.handleCommand(ctx, msg)
+	}); err != nil {
+		m.logger.Error("Failed to subscribe to command topic", "topic", m.commandTopic, "error", err)
+		client.Disconnect()
+		// not a usable session: back off as if the connection failed
+		return false
+	}
+
+	if err := m.publishStatus(ctx, client, mqttStatusOnline); err != nil {
+		m.logger.Error("Failed to publish online status", "error", err)
+	}
+	m.logger.Info("Connected to MQTT broker", "broker", m.opts.Broker, "commands", m.commandTopic)
+
+	pending := m.pending
+	m.pending = nil
+	for _, msg := range pending {
+		msg.Dup = true
+		m.publish(ctx, client, msg)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// the offline status is published after ctx is done
+			offlineCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mqttAckTimeout)
+			if err := m.publishStatus(offlineCtx, client, mqttStatusOffline); err != nil {
+				m.logger.Warn("Failed to publish offline status", "error", err)
+			}
+			cancel()
+			client.Disconnect()
+			return true
+
+		case <-client.Done():
+			m.logger.Warn("MQTT connection lost", "error", client.Err())
+			return true
+
+		case msg := <-m.outbox:
+			m.publish(ctx, client, msg)
+		}
+	}
+}
+
+// publish sends msg, keeping it to send again on the next connection if the
+// broker does not acknowledge it. Only as many messages as fit in the outbox
+// are kept.
+func (m *MQTT) publish(ctx context.Context, client *mqtt.Client, msg mqtt.Message) {
+	ackCtx, cancel := context.WithTimeout(ctx, mqttAckTimeout)
+	defer cancel()
+
+	err := client.Publish(ackCtx, msg)
+	if err == nil {
+		return
+	}
+	m.logger.Warn("Failed to publish MQTT message", "topic", msg.Topic, "error", err)
+	if msg.QoS == 0 || ctx.Err() != nil {
+		return
+	}
+	if len(m.pending) == cap(m.outbox) {
+		m.logger.Warn("Too many unacknowledged MQTT messages, dropping oldest", "topic", m.pending[0].Topic)
+		m.pending = m.pending[1:]
+	}
+	m.pending = append(m.pending, msg)
+}
+
+func (m *MQTT) publishStatus(ctx context.Context, client *mqtt.Client, status string) error {
+	ackCtx, cancel := context.WithTimeout(ctx, mqttAckTimeout)
+	defer cancel()
+	return client.Publish(ackCtx, mqtt.Message{
+		Topic:   m.statusTopic,
+		Payload: []byte(status),
+		QoS:     m.qos,
+		Retain:  true,
+	})
+}
+
+func (m *MQTT) publishEvent(event Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		m.logger.Error("Failed to encode event", "type", event.Type, "error", err)
+		return
+	}
+
+	select {
+	case m.outbox <- mqtt.Message{Topic: m.eventsTopic, Payload: payload, QoS: m.qos}:
+	default:
+		m.logger.Warn("MQTT outbox full, dropping event", "type", event.Type, "id", event.SnapshotID)
+	}
+}
+
+func (m *MQTT) publishStats() {
+	payload, err := json.Marshal(m.results.Stats())
+	if err != nil {
+		m.logger.Error("Failed to encode upload stats", "error", err)
+		return
+	}
+
+	select {
+	case m.outbox <- mqtt.Message{Topic: m.statsTopic, Payload: payload, QoS: m.qos}:
+	default:
+		m.logger.Warn("MQTT outbox full, dropping stats")
+	}
+}
+
+// DeviceStatus is published in reply to the status command. Snapshot is
+// the upload state of the snapshot the command asked about, if it is known.
+type DeviceStatus struct {
+	DeviceID  string         `json:"device_id"`
+	Paused    bool           `json:"paused"`
+	Snapshots int            `json:"snapshots"`
+	Uploads   UploadStats    `json:"uploads"`
+	Token     *TokenState    `json:"token,omitempty"`
+	Snapshot  *SnapshotState `json:"snapshot,omitempty"`
+}
+
+func (m *MQTT) publishInfo(snapshotID string) {
+	status := DeviceStatus{
+		DeviceID:  m.deviceID,
+		Paused:    m.snapshots.Paused(),
+		Snapshots: m.snapshots.Count(),
+		Uploads:   m.results.Stats(),
+	}
+	if state, ok := m.results.State(snapshotID); ok {
+		status.Snapshot = &state
+	}
+	if m.tokens != nil {
+		state := m.tokens.State()
+		status.Token = &state
+	}
+
+	payload, err := json.Marshal(status)
+	if err != nil {
+		m.logger.Error("Failed to encode device status", "error", err)
+		return
+	}
+
+	select {
+	case m.outbox <- mqtt.Message{Topic: m.infoTopic, Payload: payload, QoS: m.qos}:
+	default:
+		m.logger.Warn("MQTT outbox full, dropping status")
+	}
+}
+
+// handleCommand accepts either a bare command ("snapshot") or a JSON
+// object such as {"command": "snapshot"}. The status command takes the
+// snapshot to report on in "snapshot_id".
+func (m *MQTT) handleCommand(ctx context.Context, msg mqtt.Message) {
+	command := strings.TrimSpace(string(msg.Payload))
+	var snapshotID string
+	if strings.HasPrefix(command, "{") {
+		var body struct {
+			Command    string `json:"command"`
+			SnapshotID string `json:"snapshot_id"`
+		}
+		if err := json.Unmarshal(msg.Payload, &body); err != nil {
+			m.logger.Warn("Ignoring malformed MQTT command", "payload", command, "error", err)
+			return
+		}
+		command, snapshotID = body.Command, body.SnapshotID
+	}
+
+	m.logger.Info("Received MQTT command", "command", command)
+
+	switch strings.ToLower(command) {
+	case mqttCommandSnapshot:
+		if err := m.snapshots.Trigger(ctx, TriggerMQTT, nil); err != nil {
+			m.logger.Error("Failed to trigger snapshot", "error", err)
+		}
+	case mqttCommandPause:
+		m.snapshots.Pause()
+	case mqttCommandResume:
+		m.snapshots.Resume()
+	case mqttCommandStats:
+		m.publishStats()
+	case mqttCommandStatus:
+		m.publishInfo(snapshotID)
+	default:
+		m.logger.Warn("Unknown MQTT command", "command", command)
+	}
+}
@@ -0,0 +1,114 @@
+package components
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+)
+
+// NewHubTLSConfig returns the TLS settings for connections to the hub: the
+// device presents certFile/keyFile when the hub asks for a client
+// certificate, the hub must chain to caFile instead of the system roots,
+// and, with pins set, one certificate of the hub chain must have one of the
+// given base64 SHA-256 subject public key hashes. Every argument is optional.
+func NewHubTLSConfig(certFile, keyFile, caFile string, pins []string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(pins) > 0 {
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			// the verified chains include the root, which the hub does not send
+			chains := append([][]*x509.Certificate{cs.PeerCertificates}, cs.VerifiedChains...)
+			for _, chain := range chains {
+				for _, cert := range chain {
+					if slices.Contains(pins, spkiHash(cert)) {
+						return nil
+					}
+				}
+			}
+			return errors.New("hub certificate does not match any pinned key")
+		}
+	}
+	return tlsConfig, nil
+}
+
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// NewHubClient returns a client that connects to the hosts of hubURLs with
+// tlsConfig and refuses plain HTTP to them. Requests to other hosts, e.g.
+// redirects, go out with the default transport.
+func NewHubClient(tlsConfig *tls.Config, hubURLs ...string) (*http.Client, error) {
+	base, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("default transport is not an *http.Transport")
+	}
+
+	hosts := make(map[string]bool)
+	for _, hubURL := range hubURLs {
+		u, err := url.Parse(hubURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse hub URL: %w", err)
+		}
+		hosts[u.Hostname()] = true
+	}
+
+	hub := base.Clone()
+	hub.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: &hubTransport{hosts: hosts, hub: hub, base: base}}, nil
+}
+
+// withTimeout returns a copy of client with the given overall timeout.
+func withTimeout(client *http.Client, timeout time.Duration) *http.Client {
+	c := *client
+	c.Timeout = timeout
+	return &c
+}
+
+type hubTransport struct {
+	hosts map[string]bool
+	hub   http.RoundTripper
+	base  http.RoundTripper
+}
+
+func (t *hubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.hosts[req.URL.Hostname()] {
+		return t.base.RoundTrip(req)
+	}
+	if req.URL.Scheme != "https" {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("refusing plain %s request to the hub with TLS configured", req.URL.Scheme)
+	}
+	return t.hub.RoundTrip(req)
+}
@@ -0,0 +1,57 @@
+package components
+
+import "github.com/alesr/tidskott-uploader/pkg/uploader"
+
+// Priority orders snapshots in the upload queue. Anything above
+// PriorityRoutine skips upload windows and the bandwidth limit.
+type Priority int
+
+const (
+	PriorityRoutine   Priority = iota // scheduled snapshots
+	PriorityTriggered                 // raised by detectors: tamper, audio
+	PriorityManual                    // explicitly requested, e.g. over MQTT
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityManual:
+		return "manual"
+	case PriorityTriggered:
+		return "triggered"
+	default:
+		return "routine"
+	}
+}
+
+func parsePriority(s string) (Priority, bool) {
+	switch s {
+	case "manual":
+		return PriorityManual, true
+	case "triggered":
+		return PriorityTriggered, true
+	case "routine":
+		return PriorityRoutine, true
+	default:
+		return PriorityRoutine, false
+	}
+}
+
+func priorityForTrigger(trigger string) Priority {
+	switch trigger {
+	case TriggerScheduled, "":
+		return PriorityRoutine
+	case TriggerMQTT:
+		return PriorityManual
+	default:
+		return PriorityTriggered
+	}
+}
+
+// snapshotPriority reads the priority recorded in the snapshot metadata,
+// falling back to its trigger when none is recorded.
+func snapshotPriority(snapshot *uploader.Snapshot) Priority {
+	if p, ok := parsePriority(snapshot.Metadata["priority"]); ok {
+		return p
+	}
+	return priorityForTrigger(snapshot.Metadata["trigger"])
+}
@@ -0,0 +1,65 @@
+package components
+
+import "time"
+
+const (
+	// requestTimeout is how long a snapshot request waits for its snapshot
+	// before it is dropped, so a lost snapshot cannot hand its trigger to
+	// a later one.
+	requestTimeout = 30 * time.Second
+
+	// requestSlack allows for a clip ending on the last frame captured
+	// before the request.
+	requestSlack = time.Second
+)
+
+type snapshotRequest struct {
+	trigger  string
+	metadata map[string]string
+	at       time.Time
+}
+
+// snapshotRequests pairs requested snapshots with the snapshots the buffer
+// produces. The buffer does not say which request a snapshot answers, and
+// also produces snapshots nobody requested, so a request is matched with
+// the first snapshot whose clip reaches the time of the request.
+type snapshotRequests struct {
+	pending []snapshotRequest // oldest first
+}
+
+func (r *snapshotRequests) add(req snapshotRequest) {
+	r.pending = append(r.pending, req)
+}
+
+// cancel removes req, whose snapshot could not be requested.
+func (r *snapshotRequests) cancel(req snapshotRequest) {
+	for i, p := range r.pending {
+		if p.at.Equal(req.at) && p.trigger == req.trigger {
+			r.pending = append(r.pending[:i], r.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// match returns the oldest request answered by a clip ending at end, or a
+// scheduled request if there is none. Requests older than requestTimeout
+// at now are dropped and returned as expired.
+func (r *snapshotRequests) match(end, now time.Time) (req snapshotRequest, expired []snapshotRequest) {
+	kept := r.pending[:0]
+	matched := false
+	for _, p := range r.pending {
+		switch {
+		case now.Sub(p.at) > requestTimeout:
+			expired = append(expired, p)
+		case !matched && !end.Add(requestSlack).Before(p.at):
+			req, matched = p, true
+		default:
+			kept = append(kept, p)
+		}
+	}
+	r.pending = kept
+	if !matched {
+		req = snapshotRequest{trigger: TriggerScheduled}
+	}
+	return req, expired
+}
@@ -0,0 +1,100 @@
+package components
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotRequestsMatch(t *testing.T) {
+	t0 := time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+	at := func(s int) time.Time { return t0.Add(time.Duration(s) * time.Second) }
+
+	type snapshot struct {
+		end, now    int
+		wantTrigger string
+		wantExpired int
+	}
+	tests := []struct {
+		name      string
+		requests  []snapshotRequest
+		snapshots []snapshot
+	}{
+		{
+			name:     "requested snapshot",
+			requests: []snapshotRequest{{trigger: TriggerMQTT, at: at(0)}},
+			snapshots: []snapshot{
+				{end: 1, now: 2, wantTrigger: TriggerMQTT},
+				{end: 10, now: 11, wantTrigger: TriggerScheduled},
+			},
+		},
+		{
+			name:     "clip ending on the last frame before the request",
+			requests: []snapshotRequest{{trigger: TriggerAudio, at: at(10)}},
+			snapshots: []snapshot{
+				{end: 9, now: 11, wantTrigger: TriggerAudio},
+			},
+		},
+		{
+			name:     "unrequested snapshot recorded before the request",
+			requests: []snapshotRequest{{trigger: TriggerTamper, at: at(10)}},
+			snapshots: []snapshot{
+				{end: 5, now: 10, wantTrigger: TriggerScheduled},
+				{end: 11, now: 12, wantTrigger: TriggerTamper},
+			},
+		},
+		{
+			name: "lost snapshot does not shift later triggers",
+			requests: []snapshotRequest{
+				{trigger: TriggerMQTT, at: at(0)},
+				{trigger: TriggerAudio, at: at(100)},
+			},
+			snapshots: []snapshot{
+				{end: 101, now: 102, wantTrigger: TriggerAudio, wantExpired: 1},
+				{end: 200, now: 201, wantTrigger: TriggerScheduled},
+			},
+		},
+		{
+			name: "requests in order",
+			requests: []snapshotRequest{
+				{trigger: TriggerMQTT, at: at(0)},
+				{trigger: TriggerAudio, at: at(1)},
+			},
+			snapshots: []snapshot{
+				{end: 2, now: 3, wantTrigger: TriggerMQTT},
+				{end: 3, now: 4, wantTrigger: TriggerAudio},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r snapshotRequests
+			for _, req := range tt.requests {
+				r.add(req)
+			}
+			for i, s := range tt.snapshots {
+				req, expired := r.match(at(s.end), at(s.now))
+				if req.trigger != s.wantTrigger {
+					t.Errorf("snapshot %d: got trigger %q, want %q", i, req.trigger, s.wantTrigger)
+				}
+				if len(expired) != s.wantExpired {
+					t.Errorf("snapshot %d: got %d expired requests, want %d", i, len(expired), s.wantExpired)
+				}
+			}
+		})
+	}
+}
+
+func TestSnapshotRequestsCancel(t *testing.T) {
+	now := time.Now()
+	var r snapshotRequests
+	first := snapshotRequest{trigger: TriggerMQTT, at: now}
+	second := snapshotRequest{trigger: TriggerAudio, at: now.Add(time.Millisecond)}
+	r.add(first)
+	r.add(second)
+
+	r.cancel(first)
+	if req, _ := r.match(now.Add(time.Second), now.Add(time.Second)); req.trigger != TriggerAudio {
+		t.Errorf("got trigger %q, want %q", req.trigger, TriggerAudio)
+	}
+}
@@ -0,0 +1,224 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	UploadStatusSucceeded = "succeeded"
+	UploadStatusDuplicate = "duplicate"
+	UploadStatusFailed    = "failed"
+
+	// maxSnapshotStates bounds how many snapshots Results keeps the state of.
+	maxSnapshotStates = 1000
+)
+
+var (
+	latencyBuckets    = []float64{1, 5, 15, 60, 300, 900, 3600}                    // seconds
+	throughputBuckets = []float64{64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20} // bytes per second
+)
+
+// Histogram counts observations in buckets with the given upper bounds,
+// plus a last bucket for anything larger.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []int64   `json:"counts"`
+	Sum    float64   `json:"sum"`
+	Count  int64     `json:"count"`
+}
+
+func newHistogram(bounds []float64) Histogram {
+	return Histogram{Bounds: bounds, Counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *Histogram) observe(v float64) {
+	i := 0
+	for i < len(h.Bounds) && v > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Sum += v
+	h.Count++
+}
+
+func (h Histogram) clone() Histogram {
+	h.Counts = append([]int64(nil), h.Counts...)
+	return h
+}
+
+// UploadStats summarises upload results since start.
+type UploadStats struct {
+	Succeeded  int64     `json:"succeeded"`
+	Duplicates int64     `json:"duplicates"`
+	Failed     int64     `json:"failed"`
+	Bytes      int64     `json:"bytes"`
+	Latency    Histogram `json:"latency_seconds"`
+	Throughput Histogram `json:"throughput_bytes_per_second"`
+	Since      time.Time `json:"since"`
+}
+
+// SnapshotState is the latest upload outcome of a snapshot. Failed
+// snapshots may still be retried from the spool.
+type SnapshotState struct {
+	ID         string        `json:"id"`
+	Status     string        `json:"status"`
+	Attempts   int           `json:"attempts"`
+	Error      string        `json:"error,omitempty"`
+	Latency    time.Duration `json:"latency"`
+	FinishedAt time.Time     `json:"finished_at"`
+}
+
+// Results consumes upload results for the lifetime of the process, keeps
+// counters, latency and throughput histograms and the latest state of
+// recent snapshots, and hands every result to its subscribers. Subscribers
+// are called synchronously and must not block.
+type Results struct {
+	logger   *slog.Logger
+	uploader *Uploader
+
+	mu       sync.RWMutex
+	stats    UploadStats
+	states   map[string]*SnapshotState
+	order    []string
+	handlers []func(UploadResult)
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewResults(logger *slog.Logger, uploader *Uploader) *Results {
+	return &Results{
+		logger:   logger,
+		uploader: uploader,
+		stats: UploadStats{
+			Latency:    newHistogram(latencyBuckets),
+			Throughput: newHistogram(throughputBuckets),
+			Since:      time.Now(),
+		},
+		states: make(map[string]*SnapshotState),
+		done:   make(chan struct{}),
+	}
+}
+
+func (r *Results) Subscribe(handler func(UploadResult)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers = append(r.handlers, handler)
+}
+
+func (r *Results) Start(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(r.done)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case result := <-r.uploader.Results():
+				r.record(result)
+
+				r.mu.RLock()
+				handlers := r.handlers
+				r.mu.RUnlock()
+				for _, handler := range handlers {
+					handler(result)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops the consumer and logs a summary.
+func (r *Results) Stop() {
+	r.cancel()
+	<-r.done
+
+	stats := r.Stats()
+	r.logger.Info(
+		"Upload summary",
+		"succeeded", stats.Succeeded,
+		"duplicates", stats.Duplicates,
+		"failed", stats.Failed,
+		"uploaded_mb", fmt.Sprintf("%.2f", float64(stats.Bytes)/(1024*1024)),
+	)
+}
+
+// Stats returns a copy of the counters and histograms.
+func (r *Results) Stats() UploadStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stats := r.stats
+	stats.Latency = stats.Latency.clone()
+	stats.Throughput = stats.Throughput.clone()
+	return stats
+}
+
+// State returns the latest state of a recent snapshot.
+func (r *Results) State(id string) (SnapshotState, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	state, ok := r.states[id]
+	if !ok {
+		return SnapshotState{}, false
+	}
+	return *state, true
+}
+
+func (r *Results) record(result UploadResult) {
+	now := time.Now()
+	var latency time.Duration
+	if !result.QueuedAt.IsZero() {
+		latency = now.Sub(result.QueuedAt)
+	}
+
+	status := UploadStatusFailed
+	switch {
+	case result.Duplicate:
+		status = UploadStatusDuplicate
+	case result.Success:
+		status = UploadStatusSucceeded
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch status {
+	case UploadStatusSucceeded:
+		r.stats.Succeeded++
+		r.stats.Bytes += result.Snapshot.Size
+		r.stats.Latency.observe(latency.Seconds())
+		if result.Speed > 0 {
+			r.stats.Throughput.observe(result.Speed)
+		}
+	case UploadStatusDuplicate:
+		r.stats.Duplicates++
+	default:
+		r.stats.Failed++
+	}
+
+	state, ok := r.states[result.Snapshot.ID]
+	if !ok {
+		if len(r.order) == maxSnapshotStates {
+			delete(r.states, r.order[0])
+			r.order = r.order[1:]
+		}
+		state = &SnapshotState{ID: result.Snapshot.ID}
+		r.states[state.ID] = state
+		r.order = append(r.order, state.ID)
+	}
+	state.Status = status
+	state.Attempts++
+	state.Error = ""
+	if result.Error != nil {
+		state.Error = result.Error.Error()
+	}
+	state.Latency = latency
+	state.FinishedAt = now
+}
@@ -0,0 +1,113 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+func TestHistogramObserve(t *testing.T) {
+	h := newHistogram([]float64{1, 10})
+	for _, v := range []float64{0.5, 1, 2, 10, 11, 100} {
+		h.observe(v)
+	}
+	if fmt.Sprint(h.Counts) != "[2 2 2]" || h.Count != 6 || h.Sum != 124.5 {
+		t.Errorf("got counts %v, count %d, sum %v; want [2 2 2], 6, 124.5", h.Counts, h.Count, h.Sum)
+	}
+
+	clone := h.clone()
+	clone.observe(0)
+	if h.Counts[0] != 2 {
+		t.Error("observing a clone changed the original")
+	}
+}
+
+func TestResultsRecord(t *testing.T) {
+	r := NewResults(discardLogger(), nil)
+	queued := time.Now().Add(-2 * time.Second)
+	a := &uploader.Snapshot{ID: "a", Size: 100}
+	b := &uploader.Snapshot{ID: "b", Size: 50}
+
+	r.record(UploadResult{Snapshot: a, Error: errors.New("timeout"), QueuedAt: queued})
+	r.record(UploadResult{Snapshot: a, Success: true, Speed: 1 << 20, QueuedAt: queued})
+	r.record(UploadResult{Snapshot: b, Success: true, Duplicate: true, QueuedAt: queued})
+
+	stats := r.Stats()
+	if stats.Succeeded != 1 || stats.Failed != 1 || stats.Duplicates != 1 || stats.Bytes != 100 {
+		t.Errorf("got %+v, want 1 succeeded, 1 failed, 1 duplicate, 100 bytes", stats)
+	}
+	if stats.Latency.Count != 1 || stats.Latency.Counts[1] != 1 {
+		t.Errorf("got latency %+v, want one upload in the 1-5s bucket", stats.Latency)
+	}
+	if stats.Throughput.Count != 1 {
+		t.Errorf("got throughput %+v, want one observation", stats.Throughput)
+	}
+
+	tests := []struct {
+		id       string
+		status   string
+		attempts int
+	}{
+		{id: "a", status: UploadStatusSucceeded, attempts: 2},
+		{id: "b", status: UploadStatusDuplicate, attempts: 1},
+	}
+	for _, tt := range tests {
+		state, ok := r.State(tt.id)
+		if !ok {
+			t.Fatalf("no state for %s", tt.id)
+		}
+		if state.Status != tt.status || state.Attempts != tt.attempts || state.Error != "" {
+			t.Errorf("got %+v, want %s after %d attempts, no error", state, tt.status, tt.attempts)
+		}
+		if state.Latency < 2*time.Second {
+			t.Errorf("got latency %v for %s, want from queueing", state.Latency, tt.id)
+		}
+	}
+	if _, ok := r.State("unknown"); ok {
+		t.Error("state for a snapshot without results")
+	}
+}
+
+func TestResultsStateBound(t *testing.T) {
+	r := NewResults(discardLogger(), nil)
+	for i := range maxSnapshotStates + 1 {
+		r.record(UploadResult{Snapshot: &uploader.Snapshot{ID: fmt.Sprint(i)}, Success: true})
+	}
+	if _, ok := r.State("0"); ok {
+		t.Error("oldest state kept past the bound")
+	}
+	if _, ok := r.State(fmt.Sprint(maxSnapshotStates)); !ok {
+		t.Error("newest state missing")
+	}
+	if len(r.states) != maxSnapshotStates || len(r.order) != maxSnapshotStates {
+		t.Errorf("got %d states in %d order entries, want %d", len(r.states), len(r.order), maxSnapshotStates)
+	}
+}
+
+func TestResultsSubscribers(t *testing.T) {
+	u := &Uploader{results: make(chan UploadResult)}
+	r := NewResults(discardLogger(), u)
+
+	got := make(chan SnapshotState, 1)
+	r.Subscribe(func(result UploadResult) {
+		// the result is recorded before subscribers see it
+		state, _ := r.State(result.Snapshot.ID)
+		got <- state
+	})
+	r.Start(context.Background())
+	defer r.Stop()
+
+	u.results <- UploadResult{Snapshot: &uploader.Snapshot{ID: "a"}, Error: errors.New("refused")}
+	select {
+	case state := <-got:
+		if state.Status != UploadStatusFailed || state.Error != "refused" {
+			t.Errorf("got %+v, want the failure recorded", state)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber not called")
+	}
+}
@@ -0,0 +1,313 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+const (
+	evictMaxAge  = "max_age"
+	evictMaxSize = "max_size"
+	evictMinFree = "min_free"
+
+	// files written this recently may still be open by the camera or buffer
+	retentionMinFileAge = time.Minute
+)
+
+// Retention keeps the snapshot directory within size, age and free-space
+// limits by deleting snapshot files, lowest priority and oldest first.
+// Zero limits are disabled. The ID and priority of a file come from the
+// snapshot events of this run or, for older files, from the spool.
+type Retention struct {
+	logger       *slog.Logger
+	events       *Events
+	spool        *Spool // nil without a spool
+	maxBytes     int64
+	maxAge       time.Duration
+	minFreeBytes uint64
+	interval     time.Duration
+
+	mu       sync.Mutex
+	dirs     map[string]bool
+	suffixes map[string]bool             // of the snapshot files seen this run, e.g. ".mp4"
+	known    map[string]retainedSnapshot // by path, for snapshots seen this run
+
+	kick   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type retainedSnapshot struct {
+	id       string
+	priority Priority
+}
+
+type retainedFile struct {
+	retainedSnapshot
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// NewRetention watches dir, or, if dir is empty, the directories snapshots
+// are created in.
+func NewRetention(
+	logger *slog.Logger,
+	dir string,
+	maxBytes int64,
+	maxAge time.Duration,
+	minFreeBytes uint64,
+	interval time.Duration,
+	events *Events,
+	spool *Spool,
+) *Retention {
+	r := &Retention{
+		logger:       logger,
+		events:       events,
+		spool:        spool,
+		maxBytes:     maxBytes,
+		maxAge:       maxAge,
+		minFreeBytes: minFreeBytes,
+		interval:     interval,
+		dirs:         make(map[string]bool),
+		suffixes:     make(map[string]bool),
+		known:        make(map[string]retainedSnapshot),
+		kick:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	if dir != "" {
+		r.dirs[dir] = true
+	}
+
+	events.Subscribe(r.observe)
+	return r
+}
+
+func (r *Retention) Start(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-r.kick:
+			}
+			r.enforce()
+		}
+	}()
+}
+
+// Stop stops the manager and waits for it to exit.
+func (r *Retention) Stop() {
+	r.cancel()
+	<-r.done
+}
+
+func (r *Retention) observe(event Event) {
+	if event.Type != EventSnapshotCreated || event.Path == "" {
+		return
+	}
+
+	r.mu.Lock()
+	r.dirs[filepath.Dir(event.Path)] = true
+	if ext := filepath.Ext(event.Path); ext != "" {
+		r.suffixes[ext] = true
+		r.suffixes[ext+EncryptedExt] = true // the clip may be replaced by an encrypted copy
+	}
+	snapshot := retainedSnapshot{id: event.SnapshotID, priority: priorityForTrigger(event.Trigger)}
+	r.known[event.Path] = snapshot
+	r.known[event.Path+EncryptedExt] = snapshot
+	r.mu.Unlock()
+
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Retention) enforce() {
+	files, total := r.scan()
+	if len(files) == 0 {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].priority != files[j].priority {
+			return files[i].priority < files[j].priority
+		}
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	remaining := files[:0]
+	for _, f := range files {
+		if r.maxAge > 0 && time.Since(f.modTime) > r.maxAge {
+			if r.evict(f, evictMaxAge) {
+				total -= f.size
+			}
+			continue
+		}
+		remaining = append(remaining, f)
+	}
+	files = remaining
+
+	for r.maxBytes > 0 && total > r.maxBytes && len(files) > 0 {
+		if r.evict(files[0], evictMaxSize) {
+			total -= files[0].size
+		}
+		files = files[1:]
+	}
+
+	if r.minFreeBytes == 0 {
+		return
+	}
+	for len(files) > 0 {
+		free, err := freeBytes(filepath.Dir(files[0].path))
+		if err != nil {
+			r.logger.Error("Failed to read free disk space", "error", err)
+			return
+		}
+		if free >= r.minFreeBytes {
+			return
+		}
+		r.evict(files[0], evictMinFree)
+		files = files[1:]
+	}
+}
+
+// scan lists snapshot files old enough to be safely removed, and the total
+// size of all snapshot files. Only files with the extension of a snapshot seen
+// this run are snapshot files, so nothing is listed until the first snapshot.
+func (r *Retention) scan() ([]retainedFile, int64) {
+	var spooled map[string]*uploader.Snapshot
+	if r.spool != nil {
+		var err error
+		if spooled, err = r.spool.Files(); err != nil {
+			r.logger.Warn("Failed to read spool, evicting without spooled priorities", "error", err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.suffixes) == 0 {
+		return nil, 0
+	}
+
+	var files []retainedFile
+	var total int64
+	seen := make(map[string]bool)
+	for dir := range r.dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			r.logger.Warn("Failed to read snapshot directory", "dir", dir, "error", err)
+			continue
+		}
+
+		for _, e := range entries {
+			suffix := r.snapshotSuffix(e.Name())
+			if !e.Type().IsRegular() || suffix == "" {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+
+			path := filepath.Join(dir, e.Name())
+			seen[path] = true
+
+			total += info.Size()
+			if time.Since(info.ModTime()) < retentionMinFileAge {
+				continue
+			}
+
+			snapshot, ok := r.known[path]
+			if !ok {
+				snapshot.id = strings.TrimSuffix(e.Name(), suffix)
+				if s := spooled[path]; s != nil {
+					snapshot = retainedSnapshot{id: s.ID, priority: snapshotPriority(s)}
+				}
+			}
+			files = append(files, retainedFile{
+				retainedSnapshot: snapshot,
+				path:             path,
+				size:             info.Size(),
+				modTime:          info.ModTime(),
+			})
+		}
+	}
+
+	// forget snapshots removed since, e.g. after upload
+	for path := range r.known {
+		if !seen[path] {
+			delete(r.known, path)
+		}
+	}
+	return files, total
+}
+
+// snapshotSuffix returns the longest snapshot suffix name ends with, or ""
+// if it is not a snapshot file.
+func (r *Retention) snapshotSuffix(name string) string {
+	var longest string
+	for suffix := range r.suffixes {
+		if strings.HasSuffix(name, suffix) && len(suffix) > len(longest) {
+			longest = suffix
+		}
+	}
+	return longest
+}
+
+func (r *Retention) evict(f retainedFile, reason string) bool {
+	if err := os.Remove(f.path); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			r.logger.Error("Failed to evict snapshot", "path", f.path, "error", err)
+		}
+		return false
+	}
+
+	r.mu.Lock()
+	delete(r.known, f.path)
+	r.mu.Unlock()
+
+	r.logger.Warn(
+		"Snapshot evicted",
+		"id", f.id,
+		"path", f.path,
+		"reason", reason,
+		"size_mb", fmt.Sprintf("%.2f", float64(f.size)/(1024*1024)),
+		"age", time.Since(f.modTime).Round(time.Second),
+	)
+	r.events.Publish(Event{
+		Type:       EventSnapshotEvicted,
+		SnapshotID: f.id,
+		Path:       f.path,
+		Size:       f.size,
+		Details:    map[string]string{"reason": reason},
+	})
+	return true
+}
+
+func freeBytes(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,99 @@
+package components
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+// TestRetentionAfterRestart checks that files of a previous run keep the
+// ID and priority they were spooled with.
+func TestRetentionAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := NewSpool(discardLogger(), filepath.Join(dir, "spool"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	write := func(name string, modTime time.Time) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, 100), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	triggered := write("clip-a.mp4", old)
+	write("clip-b.mp4", old.Add(time.Minute))
+	write("notes.txt", old)
+	if err := spool.Add(&uploader.Snapshot{
+		ID:       "a",
+		Path:     triggered,
+		Metadata: map[string]string{"trigger": TriggerAudio, "priority": PriorityTriggered.String()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	events := NewEvents("device")
+	var evicted []Event
+	events.Subscribe(func(e Event) {
+		if e.Type == EventSnapshotEvicted {
+			evicted = append(evicted, e)
+		}
+	})
+
+	r := NewRetention(discardLogger(), dir, 150, 0, 0, time.Hour, events, spool)
+	events.Publish(Event{Type: EventSnapshotCreated, SnapshotID: "c", Path: write("c.mp4", time.Now()), Trigger: TriggerScheduled})
+
+	// 300 bytes of snapshots, of which only the new one may stay: the
+	// routine clip goes first though it is newer
+	r.enforce()
+	if len(evicted) != 2 || evicted[0].SnapshotID != "clip-b" || evicted[1].SnapshotID != "a" {
+		t.Fatalf("got evictions %+v, want clip-b then a", evicted)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("other file evicted: %v", err)
+	}
+}
+
+func TestRetentionOrder(t *testing.T) {
+	dir := t.TempDir()
+	events := NewEvents("device")
+	var evicted []string
+	events.Subscribe(func(e Event) {
+		if e.Type == EventSnapshotEvicted {
+			evicted = append(evicted, e.SnapshotID)
+		}
+	})
+	r := NewRetention(discardLogger(), dir, 250, 0, 0, time.Hour, events, nil)
+
+	old := time.Now().Add(-2 * time.Hour)
+	for i, s := range []struct{ id, trigger string }{
+		{"oldest-triggered", TriggerTamper},
+		{"old-routine", TriggerScheduled},
+		{"manual", TriggerMQTT},
+		{"new-routine", TriggerScheduled},
+	} {
+		path := filepath.Join(dir, s.id+".mp4")
+		if err := os.WriteFile(path, make([]byte, 100), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		events.Publish(Event{Type: EventSnapshotCreated, SnapshotID: s.id, Path: path, Trigger: s.trigger})
+		modTime := old.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r.enforce()
+	if want := []string{"old-routine", "new-routine"}; !slices.Equal(evicted, want) {
+		t.Errorf("got evictions %v, want %v", evicted, want)
+	}
+}
@@ -0,0 +1,153 @@
+package components
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/alesr/tidskott-pi/pkg/s3"
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+// S3Sink stores snapshots as objects in an S3-compatible bucket, keyed as
+// <prefix><device id>/<yyyy>/<mm>/<dd>/<snapshot id><ext>. The snapshot
+// metadata becomes object metadata.
+type S3Sink struct {
+	logger     *slog.Logger
+	client     *s3.Client
+	bucket     string
+	prefix     string
+	maxRetries int
+}
+
+func NewS3Sink(
+	logger *slog.Logger,
+	endpoint, region, bucket, prefix string,
+	accessKeyID, secretAccessKey, sessionToken string,
+	pathStyle bool,
+	partSize int64,
+	maxRetries int,
+) (*S3Sink, error) {
+	client, err := s3.New(s3.Config{
+		Endpoint:        endpoint,
+		Region:          region,
+		Bucket:          bucket,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		SessionToken:    sessionToken,
+		PathStyle:       pathStyle,
+		PartSize:        partSize,
+	}, newThrottledClient(&http.Client{}))
+	if err != nil {
+		return nil, fmt.Errorf("could not create s3 client: %w", err)
+	}
+	return &S3Sink{
+		logger:     logger,
+		client:     client,
+		bucket:     bucket,
+		prefix:     prefix,
+		maxRetries: maxRetries,
+	}, nil
+}
+
+// Upload stores snapshot, retrying transient failures with backoff.
+func (s *S3Sink) Upload(ctx context.Context, snapshot *uploader.Snapshot) error {
+	key := s.objectKey(snapshot)
+
+	metadata, dropped := s3Metadata(snapshot)
+	if len(dropped) > 0 {
+		s.logger.Warn("Leaving out S3 metadata over the size limit", "id", snapshot.ID, "keys", dropped)
+	}
+
+	err := retry(ctx, s.logger, s.Name(), s.maxRetries, s3Retryable, func() error {
+		return s.client.UploadFile(ctx, key, snapshot.Path, contentTypeFor(snapshot.Path), metadata)
+	})
+	if err != nil {
+		return fmt.Errorf("could not upload %s to s3: %w", key, err)
+	}
+	return nil
+}
+
+// s3Metadata returns the object metadata of snapshot and the upload
+// metadata keys left out of it. S3 refuses objects with more than
+// s3.MaxMetadataSize of metadata, so the largest upload metadata values,
+// e.g. inference results, are left out until it fits and their keys listed
+// in metadata_truncated. The snapshot details are always kept.
+func s3Metadata(snapshot *uploader.Snapshot) (map[string]string, []string) {
+	metadata := make(map[string]string, len(snapshot.Metadata)+3)
+	maps.Copy(metadata, snapshot.Metadata)
+	metadata["sha256"] = snapshot.Hash
+	metadata["device_id"] = snapshot.DeviceID
+	metadata["device_name"] = snapshot.DeviceName
+	if s3.MetadataSize(metadata) <= s3.MaxMetadataSize {
+		return metadata, nil
+	}
+
+	var keys []string
+	for k := range snapshot.Metadata {
+		if k != "sha256" && k != "device_id" && k != "device_name" {
+			keys = append(keys, k)
+		}
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(metadata[b]), len(metadata[a])), cmp.Compare(a, b))
+	})
+
+	var dropped []string
+	for _, k := range keys {
+		delete(metadata, k)
+		dropped = append(dropped, k)
+		metadata["metadata_truncated"] = strings.Join(dropped, ",")
+		if s3.MetadataSize(metadata) <= s3.MaxMetadataSize {
+			break
+		}
+	}
+	return metadata, dropped
+}
+
+func (s *S3Sink) Name() string { return "s3" }
+
+func (s *S3Sink) Location() string { return "s3://" + s.bucket + "/" + s.prefix }
+
+func (s *S3Sink) objectKey(snapshot *uploader.Snapshot) string {
+	return s.prefix + snapshotKey(snapshot)
+}
+
+// s3Retryable treats service errors by status, local file errors as
+// permanent and everything else (network errors, timeouts) as transient.
+func s3Retryable(err error) bool {
+	var s3Err *s3.Error
+	if errors.As(err, &s3Err) {
+		return s3Err.Retryable()
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return false
+	}
+	return !errors.Is(err, context.Canceled)
+}
+
+func contentTypeFor(p string) string {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".mp4":
+		return "video/mp4"
+	case ".ts":
+		return "video/mp2t"
+	case ".mkv":
+		return "video/x-matroska"
+	case ".h264", ".264":
+		return "video/h264"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	default:
+		return "application/octet-stream"
+	}
+}
@@ -0,0 +1,78 @@
+package components
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/alesr/tidskott-pi/pkg/s3"
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+func TestS3Metadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     []string // keys left out
+	}{
+		{
+			name:     "fits",
+			metadata: map[string]string{"trigger": "scheduled", "labels": "person,car"},
+		},
+		{
+			name: "largest left out",
+			metadata: map[string]string{
+				"trigger":   "scheduled",
+				"labels":    "person,car",
+				"inference": strings.Repeat("x", 2000),
+			},
+			want: []string{"inference"},
+		},
+		{
+			name: "several left out",
+			metadata: map[string]string{
+				"trigger": "scheduled",
+				"a":       strings.Repeat("a", 1200),
+				"b":       strings.Repeat("b", 1200),
+				"c":       strings.Repeat("c", 1200),
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "encoded size counts",
+			metadata: map[string]string{
+				"trigger": "scheduled",
+				"note":    strings.Repeat("ö", 400), // 800 bytes, 2400 encoded
+			},
+			want: []string{"note"},
+		},
+		{
+			name:     "snapshot details over metadata",
+			metadata: map[string]string{"sha256": strings.Repeat("x", 3000)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot := &uploader.Snapshot{ID: "a", Hash: "hash", DeviceID: "pi", DeviceName: "front door", Metadata: tt.metadata}
+
+			metadata, dropped := s3Metadata(snapshot)
+			if fmt.Sprint(dropped) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v left out, want %v", dropped, tt.want)
+			}
+			if size := s3.MetadataSize(metadata); size > s3.MaxMetadataSize {
+				t.Errorf("got %d bytes of metadata, want at most %d", size, s3.MaxMetadataSize)
+			}
+			if metadata["sha256"] != "hash" || metadata["device_id"] != "pi" || metadata["device_name"] != "front door" {
+				t.Errorf("snapshot details missing from %v", metadata)
+			}
+			if got := metadata["metadata_truncated"]; got != strings.Join(tt.want, ",") {
+				t.Errorf("got metadata_truncated %q, want %q", got, strings.Join(tt.want, ","))
+			}
+			for k, v := range tt.metadata {
+				if _, ok := metadata[k]; ok && k != "sha256" && metadata[k] != v {
+					t.Errorf("%s changed", k)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package components
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+// SFTPSink copies snapshots to an SFTP server with the OpenSSH sftp client
+// in batch mode, so authentication must be key based. Clips land in
+// <dir>/<device id>/<yyyy>/<mm>/<dd>/ and are renamed into place once
+// complete.
+type SFTPSink struct {
+	logger       *slog.Logger
+	host         string
+	port         int
+	user         string
+	identityFile string
+	dir          string
+	maxRetries   int
+}
+
+func NewSFTPSink(logger *slog.Logger, host string, port int, user, identityFile, dir string, maxRetries int) (*SFTPSink, error) {
+	if _, err := exec.LookPath("sftp"); err != nil {
+		return nil, fmt.Errorf("sftp client not found: %w", err)
+	}
+	return &SFTPSink{
+		logger:       logger,
+		host:         host,
+		port:         port,
+		user:         user,
+		identityFile: identityFile,
+		dir:          dir,
+		maxRetries:   maxRetries,
+	}, nil
+}
+
+func (s *SFTPSink) Name() string { return "sftp" }
+
+func (s *SFTPSink) Location() string {
+	return fmt.Sprintf("sftp://%s@%s:%d/%s", s.user, s.host, s.port, strings.TrimPrefix(s.dir, "/"))
+}
+
+func (s *SFTPSink) Upload(ctx context.Context, snapshot *uploader.Snapshot) error {
+	if _, err := os.Stat(snapshot.Path); err != nil {
+		return fmt.Errorf("could not stat snapshot: %w", err)
+	}
+
+	remote := path.Join(s.dir, snapshotKey(snapshot))
+	err := retry(ctx, s.logger, s.Name(), s.maxRetries, sftpRetryable, func() error {
+		// sftp reads the clip itself and is told how fast to send it
+		limit := externalUploadLimit(ctx, snapshot.Size)
+		return s.run(ctx, s.batch(snapshot.Path, remote), limit)
+	})
+	if err != nil {
+		return fmt.Errorf("could not upload %s over sftp: %w", remote, err)
+	}
+	return nil
+}
+
+// batch builds the sftp commands for one upload. Commands prefixed with -
+// may fail: directories may exist and the target may not.
+func (s *SFTPSink) batch(local, remote string) string {
+	var b strings.Builder
+	var dir string
+	for _, part := range strings.Split(path.Dir(remote), "/") {
+		if part == "" {
+			dir = "/"
+			continue
+		}
+		dir = path.Join(dir, part)
+		fmt.Fprintf(&b, "-mkdir %s\n", sftpQuote(dir))
+	}
+
+	tmp := remote + ".part"
+	fmt.Fprintf(&b, "put %s %s\n", sftpQuote(local), sftpQuote(tmp))
+	fmt.Fprintf(&b, "-rm %s\n", sftpQuote(remote))
+	fmt.Fprintf(&b, "rename %s %s\n", sftpQuote(tmp), sftpQuote(remote))
+	return b.String()
+}
+
+// run runs batch with sftp, sending at most limit bytes per second unless
+// limit is 0.
+func (s *SFTPSink) run(ctx context.Context, batch string, limit float64) error {
+	cmd := exec.CommandContext(ctx, "sftp", s.args(limit)...)
+	cmd.Stdin = strings.NewReader(batch)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *SFTPSink) args(limit float64) []string {
+	args := []string{
+		"-b", "-",
+		"-o", "BatchMode=yes",
+		"-P", strconv.Itoa(s.port),
+	}
+	if limit > 0 {
+		// sftp takes the limit in Kbit/s
+		args = append(args, "-l", strconv.FormatInt(max(1, int64(limit*8/1000)), 10))
+	}
+	if s.identityFile != "" {
+		args = append(args, "-i", s.identityFile)
+	}
+	return append(args, s.user+"@"+s.host)
+}
+
+func sftpQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+func sftpRetryable(err error) bool {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return false
+	}
+	return !errors.Is(err, context.Canceled)
+}
@@ -0,0 +1,43 @@
+package components
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestSFTPLimit(t *testing.T) {
+	s := &SFTPSink{host: "backup", port: 22, user: "pi"}
+	limiter := newTokenBucket(125000, 125000) // 1 Mbit/s
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		wantArgs []string // -l arguments, nil for none
+	}{
+		{name: "unlimited", ctx: context.Background()},
+		{name: "routine", ctx: withUploadThrottle(context.Background(), limiter, PriorityRoutine), wantArgs: []string{"-l", "1000"}},
+		{name: "triggered", ctx: withUploadThrottle(context.Background(), limiter, PriorityTriggered)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := s.args(externalUploadLimit(tt.ctx, 1000))
+			i := slices.Index(args, "-l")
+			var got []string
+			if i >= 0 {
+				got = args[i : i+2]
+			}
+			if !slices.Equal(got, tt.wantArgs) {
+				t.Errorf("got %v in %v, want %v", got, args, tt.wantArgs)
+			}
+		})
+	}
+
+	// the bytes count against the limit either way
+	limiter.mu.Lock()
+	tokens := limiter.tokens
+	limiter.mu.Unlock()
+	if tokens > 125000-2000+100 {
+		t.Errorf("got %.0f tokens left, want the 2000 sent by limited uploads spent", tokens)
+	}
+}
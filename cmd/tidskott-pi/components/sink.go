@@ -0,0 +1,90 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+const sinkMaxBackoff = 30 * time.Second
+
+// Sink is an upload destination. Each sink owns its retry policy: Upload
+// returns once the snapshot is stored or has failed for good.
+type Sink interface {
+	Name() string
+	// Location describes where snapshots go, for logs and events.
+	Location() string
+	Upload(ctx context.Context, snapshot *uploader.Snapshot) error
+}
+
+// sinkStarter is implemented by sinks that run background work between
+// Start and Stop.
+type sinkStarter interface {
+	Start() error
+	Stop() error
+}
+
+// DeletePolicy decides which sinks must succeed before a snapshot counts as
+// uploaded, and so may be deleted locally and removed from the spool.
+type DeletePolicy int
+
+const (
+	DeleteWhenAll DeletePolicy = iota // every sink stored the snapshot
+	DeleteWhenAny                     // at least one sink stored it
+)
+
+func ParseDeletePolicy(s string) (DeletePolicy, error) {
+	switch s {
+	case "all", "":
+		return DeleteWhenAll, nil
+	case "any":
+		return DeleteWhenAny, nil
+	default:
+		return DeleteWhenAll, fmt.Errorf("invalid delete policy %q", s)
+	}
+}
+
+func (p DeletePolicy) satisfied(delivered, total int) bool {
+	if p == DeleteWhenAny {
+		return delivered > 0
+	}
+	return delivered == total
+}
+
+// snapshotKey is the relative path a snapshot is stored under by sinks
+// that organise clips in a tree: <device id>/<yyyy>/<mm>/<dd>/<id><ext>.
+func snapshotKey(snapshot *uploader.Snapshot) string {
+	return path.Join(
+		snapshot.DeviceID,
+		snapshot.Timestamp.UTC().Format("2006/01/02"),
+		snapshot.ID+filepath.Ext(snapshot.Path),
+	)
+}
+
+// retry calls fn until it succeeds, fails with an error retryable rejects or
+// maxRetries retries are used up, backing off exponentially in between.
+func retry(ctx context.Context, logger *slog.Logger, sink string, maxRetries int, retryable func(error) bool, fn func() error) error {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if attempt >= maxRetries || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		logger.Warn("Upload failed, retrying", "sink", sink, "attempt", attempt+1, "in", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, sinkMaxBackoff)
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"os"
 	"sync"
 	"time"
@@ -16,9 +18,26 @@ import (
 	"github.com/alesr/tidskott-uploader/pkg/uploader"
 )
 
+// TriggerScheduled marks snapshots requested by the interval scheduler,
+// or produced by the buffer without an explicit request.
+const TriggerScheduled = "scheduled"
+
+// ErrDropSnapshot is returned by an Analyzer, possibly alongside metadata,
+// when the snapshot should be discarded instead of uploaded.
+var ErrDropSnapshot = errors.New("snapshot dropped by analyzer")
+
+// Analyzer inspects a snapshot before it is queued for upload and returns
+// metadata to attach to it.
+type Analyzer interface {
+	Name() string
+	Analyze(ctx context.Context, snapshot *uploader.Snapshot) (map[string]string, error)
+}
+
 type SnapshotHandler struct {
 	buffer           *VideoBuffer
 	uploader         *Uploader
+	events           *Events
+	spool            *Spool
 	snapshotInterval time.Duration
 	deviceID         string
 	deviceName       string
@@ -28,13 +47,27 @@ type SnapshotHandler struct {
 
 	logger *slog.Logger
 
-	mu    sync.Mutex
-	count int
+	analyzers []Analyzer
+	encryptor *Encryptor      // nil to upload clips as recorded
+	signer    *ManifestSigner // nil to upload clips without manifests
+
+	mu       sync.Mutex
+	count    int
+	paused   bool
+	requests snapshotRequests
+
+	// signals the scheduler that snapshotInterval changed
+	rescheduled chan struct{}
+
+	// serializes snapshot requests so they are queued in request order
+	requestMu sync.Mutex
 }
 
 func NewSnapshotHandler(
 	buffer *VideoBuffer,
 	uploader *Uploader,
+	events *Events,
+	spool *Spool,
 	snapshotInterval time.Duration,
 	deviceID, deviceName string,
 	authEnabled bool,
@@ -44,6 +77,8 @@ func NewSnapshotHandler(
 	return &SnapshotHandler{
 		buffer:           buffer,
 		uploader:         uploader,
+		events:           events,
+		spool:            spool,
 		snapshotInterval: snapshotInterval,
 		deviceID:         deviceID,
 		deviceName:       deviceName,
@@ -51,13 +86,51 @@ func NewSnapshotHandler(
 		width:            width,
 		height:           height,
 		logger:           logger,
+		rescheduled:      make(chan struct{}, 1),
 	}
 }
 
 func (sh *SnapshotHandler) Start(ctx context.Context) {
 	sh.startScheduler(ctx)
 	sh.startProcessor(ctx)
-	sh.startResultLogger(ctx)
+	sh.startReplayer(ctx)
+}
+
+// AddAnalyzer registers an analyzer. Analyzers run in registration order
+// and must be added before Start.
+func (sh *SnapshotHandler) AddAnalyzer(analyzer Analyzer) {
+	sh.analyzers = append(sh.analyzers, analyzer)
+}
+
+// SetEncryptor makes the handler encrypt snapshots once analyzed, before
+// they are spooled and queued. It must be set before Start.
+func (sh *SnapshotHandler) SetEncryptor(encryptor *Encryptor) {
+	sh.encryptor = encryptor
+}
+
+// SetManifestSigner makes the handler sign a manifest for every snapshot it
+// uploads and upload it alongside. It must be set before Start.
+func (sh *SnapshotHandler) SetManifestSigner(signer *ManifestSigner) {
+	sh.signer = signer
+}
+
+// SetSnapshotInterval changes the interval between scheduled snapshots.
+// The next snapshot is due one interval from now.
+func (sh *SnapshotHandler) SetSnapshotInterval(interval time.Duration) {
+	sh.mu.Lock()
+	sh.snapshotInterval = interval
+	sh.mu.Unlock()
+
+	select {
+	case sh.rescheduled <- struct{}{}:
+	default:
+	}
+}
+
+func (sh *SnapshotHandler) interval() time.Duration {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.snapshotInterval
 }
 
 func (sh *SnapshotHandler) Count() int {
@@ -66,21 +139,107 @@ func (sh *SnapshotHandler) Count() int {
 	return sh.count
 }
 
+// Trigger requests an out-of-schedule snapshot. The reason and metadata
+// are recorded in the upload metadata of the resulting snapshot.
+func (sh *SnapshotHandler) Trigger(ctx context.Context, reason string, metadata map[string]string) error {
+	sh.logger.Info("Snapshot triggered", "trigger", reason)
+	return sh.requestSnapshot(ctx, snapshotRequest{trigger: reason, metadata: metadata})
+}
+
+// Pause stops scheduled snapshots. Triggered snapshots are still taken.
+func (sh *SnapshotHandler) Pause() {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.paused = true
+}
+
+func (sh *SnapshotHandler) Resume() {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.paused = false
+}
+
+func (sh *SnapshotHandler) Paused() bool {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.paused
+}
+
+func (sh *SnapshotHandler) requestSnapshot(ctx context.Context, req snapshotRequest) error {
+	sh.requestMu.Lock()
+	defer sh.requestMu.Unlock()
+
+	req.at = time.Now()
+	sh.mu.Lock()
+	sh.requests.add(req)
+	sh.mu.Unlock()
+
+	if err := sh.buffer.GetSnapshot(ctx); err != nil {
+		sh.mu.Lock()
+		sh.requests.cancel(req)
+		sh.mu.Unlock()
+		return fmt.Errorf("could not request snapshot: %w", err)
+	}
+	return nil
+}
+
+// requestFor returns the request snapshot answers, or a scheduled one for
+// snapshots nobody requested.
+func (sh *SnapshotHandler) requestFor(snapshot *buffer.Snapshot) snapshotRequest {
+	now := time.Now()
+	end := snapshot.EndTime
+	if end.IsZero() {
+		end = snapshot.Timestamp
+	}
+	if end.IsZero() {
+		end = now
+	}
+
+	sh.mu.Lock()
+	req, expired := sh.requests.match(end, now)
+	sh.mu.Unlock()
+
+	for _, e := range expired {
+		sh.logger.Warn("Requested snapshot never arrived", "trigger", e.trigger, "requested_at", e.at)
+	}
+	return req
+}
+
+func (sh *SnapshotHandler) emit(event Event) { sh.events.Publish(event) }
+
+func (sh *SnapshotHandler) emitUnreachable(snapshotID string, err error) {
+	sh.emit(Event{
+		Type:       EventServerUnreachable,
+		SnapshotID: snapshotID,
+		Error:      err.Error(),
+		Details:    map[string]string{"endpoint": sh.uploader.Endpoint()},
+	})
+}
+
 func (sh *SnapshotHandler) startScheduler(ctx context.Context) {
-	if sh.snapshotInterval <= 0 {
-		sh.logger.Warn("Snapshot interval disabled", "interval", sh.snapshotInterval)
+	interval := sh.interval()
+	if interval <= 0 {
+		sh.logger.Warn("Snapshot interval disabled", "interval", interval)
 		return
 	}
 
-	ticker := time.NewTicker(sh.snapshotInterval)
+	ticker := time.NewTicker(interval)
 	go func() {
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				return
+			case <-sh.rescheduled:
+				if interval := sh.interval(); interval > 0 {
+					ticker.Reset(interval)
+				}
 			case <-ticker.C:
-				if err := sh.buffer.GetSnapshot(ctx); err != nil {
+				if sh.Paused() {
+					sh.logger.Debug("Scheduler paused, skipping snapshot")
+					continue
+				}
+				if err := sh.requestSnapshot(ctx, snapshotRequest{trigger: TriggerScheduled}); err != nil {
 					sh.logger.Error("Failed to request snapshot", "error", err)
 				} else {
 					sh.logger.Debug("Snapshot requested")
@@ -97,49 +256,85 @@ func (sh *SnapshotHandler) startProcessor(ctx context.Context) {
 			case <-ctx.Done():
 				return
 			case snapshot := <-sh.buffer.Snapshots():
-				sh.processSnapshot(snapshot)
+				sh.processSnapshot(ctx, snapshot)
 			}
 		}
 	}()
 }
 
-func (sh *SnapshotHandler) startResultLogger(ctx context.Context) {
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case result := <-sh.uploader.Results():
-				if result.Success {
-					sh.logger.Info(
-						"Upload successful",
-						"id", result.Snapshot.ID,
-						"size_mb", fmt.Sprintf("%.2f", float64(result.Snapshot.Size)/(1024*1024)),
-						"speed_kbps", fmt.Sprintf("%.2f", result.Speed/1024),
-						"auth_enabled", sh.authEnabled,
-					)
-					return
-				}
-
-				sh.logger.Error(
-					"Upload failed",
-					"id", result.Snapshot.ID,
-					"error", result.Error,
-				)
-
-				if result.Error != nil && errutil.IsConnRefused(result.Error) {
-					sh.logger.Error(
-						"Server connection lost",
-						"endpoint", sh.uploader.endpoint,
-						"hint", "Make sure the external hub server is running at the specified endpoint")
-				}
-
+// HandleResult logs an upload result, settles the snapshot in the spool and
+// emits the matching event. It is meant to be subscribed to Results.
+func (sh *SnapshotHandler) HandleResult(result UploadResult) {
+	if result.Success {
+		if !result.Duplicate {
+			sh.logger.Info(
+				"Upload successful",
+				"id", result.Snapshot.ID,
+				"size_mb", fmt.Sprintf("%.2f", float64(result.Snapshot.Size)/(1024*1024)),
+				"speed_kbps", fmt.Sprintf("%.2f", result.Speed/1024),
+				"auth_enabled", sh.authEnabled,
+			)
+		}
+		if sh.spool != nil {
+			if err := sh.spool.Done(result.Snapshot.ID); err != nil {
+				sh.logger.Error("Failed to remove snapshot from spool", "id", result.Snapshot.ID, "error", err)
 			}
 		}
-	}()
+		event := Event{
+			Type:       EventUploadSucceeded,
+			SnapshotID: result.Snapshot.ID,
+			Path:       result.Snapshot.Path,
+			Size:       result.Snapshot.Size,
+			Hash:       result.Snapshot.Hash,
+		}
+		if result.Duplicate {
+			event.Details = map[string]string{"duplicate": "true"}
+		}
+		sh.emit(event)
+
+		if result.Deleted {
+			sh.emit(Event{
+				Type:       EventSnapshotDeleted,
+				SnapshotID: result.Snapshot.ID,
+				Path:       result.Snapshot.Path,
+				Hash:       result.Snapshot.Hash,
+			})
+		}
+		return
+	}
+
+	sh.logger.Error(
+		"Upload failed",
+		"id", result.Snapshot.ID,
+		"error", result.Error,
+	)
+	if sh.spool != nil {
+		sh.spool.Failed(result.Snapshot.ID)
+	} else {
+		// retried only from the spool
+		sh.uploader.Forget(result.Snapshot.ID)
+	}
+
+	event := Event{
+		Type:       EventUploadFailed,
+		SnapshotID: result.Snapshot.ID,
+		Path:       result.Snapshot.Path,
+	}
+	if result.Error != nil {
+		event.Error = result.Error.Error()
+	}
+	sh.emit(event)
+
+	if result.Error != nil && errutil.IsConnRefused(result.Error) {
+		sh.logger.Error(
+			"Server connection lost",
+			"endpoint", sh.uploader.Endpoint(),
+			"hint", "Make sure the external hub server is running at the specified endpoint")
+		sh.emitUnreachable(result.Snapshot.ID, result.Error)
+	}
 }
 
-func (sh *SnapshotHandler) processSnapshot(snapshot *buffer.Snapshot) {
+func (sh *SnapshotHandler) processSnapshot(ctx context.Context, snapshot *buffer.Snapshot) {
 	if snapshot == nil || snapshot.VideoPath == "" {
 		sh.logger.Error("Empty snapshot received")
 		return
@@ -158,6 +353,8 @@ func (sh *SnapshotHandler) processSnapshot(snapshot *buffer.Snapshot) {
 	}
 
 	duration := int(snapshot.EndTime.Sub(snapshot.StartTime).Seconds())
+	req := sh.requestFor(snapshot)
+	trigger := req.trigger
 
 	sh.mu.Lock()
 	sh.count++
@@ -170,7 +367,16 @@ func (sh *SnapshotHandler) processSnapshot(snapshot *buffer.Snapshot) {
 		"id", snapshot.ID,
 		"path", snapshot.VideoPath,
 		"size_mb", fmt.Sprintf("%.2f", float64(fileInfo.Size())/(1024*1024)),
+		"trigger", trigger,
 	)
+	sh.emit(Event{
+		Type:       EventSnapshotCreated,
+		SnapshotID: snapshot.ID,
+		Path:       snapshot.VideoPath,
+		Size:       fileInfo.Size(),
+		Hash:       hash,
+		Trigger:    trigger,
+	})
 
 	metadata := map[string]string{
 		"width":        fmt.Sprintf("%d", sh.width),
@@ -181,7 +387,10 @@ func (sh *SnapshotHandler) processSnapshot(snapshot *buffer.Snapshot) {
 		"device_id":    sh.deviceID,
 		"device_name":  sh.deviceName,
 		"auth_enabled": fmt.Sprintf("%v", sh.authEnabled),
+		"trigger":      trigger,
+		"priority":     priorityForTrigger(trigger).String(),
 	}
+	maps.Copy(metadata, req.metadata)
 
 	uploadSnapshot := &uploader.Snapshot{
 		ID:         snapshot.ID,
@@ -197,18 +406,256 @@ func (sh *SnapshotHandler) processSnapshot(snapshot *buffer.Snapshot) {
 		DeviceName: sh.deviceName,
 	}
 
-	if err := sh.uploader.QueueSnapshot(uploadSnapshot); err != nil {
+	// record the snapshot before it is prepared, so it is not lost if the
+	// device restarts in between
+	if sh.spool != nil {
+		if err := sh.spool.Record(uploadSnapshot, snapshot.StartTime, snapshot.EndTime); err != nil {
+			sh.logger.Error("Failed to spool snapshot", "id", uploadSnapshot.ID, "error", err)
+		}
+	}
+	sh.prepare(ctx, uploadSnapshot, snapshot.StartTime, snapshot.EndTime)
+}
+
+// prepare analyses, signs and encrypts uploadSnapshot, recorded between start
+// and end, then spools and queues it and its manifest.
+func (sh *SnapshotHandler) prepare(ctx context.Context, uploadSnapshot *uploader.Snapshot, start, end time.Time) {
+	if !sh.analyze(ctx, uploadSnapshot) {
+		sh.dropSnapshot(uploadSnapshot, nil)
+		return
+	}
+
+	// sign before encrypting, so the manifest states the hash of the recording
+	var manifest *uploader.Snapshot
+	if sh.signer != nil {
+		var err error
+		manifest, err = sh.signer.Sign(uploadSnapshot, start, end)
+		if err != nil {
+			sh.logger.Error("Failed to sign snapshot manifest", "id", uploadSnapshot.ID, "error", err)
+		} else {
+			// the chain has advanced, so the manifest must be uploaded even
+			// if the clip is lost from here on
+			sh.spoolSnapshot(manifest)
+		}
+	}
+	sh.seal(uploadSnapshot, manifest, false)
+}
+
+// resume prepares a snapshot recorded before a restart without repeating
+// what the previous run finished: a manifest signed for it is reused rather
+// than signed again, which would put the clip in the chain twice, and so
+// is its analysis. A clip that was sealed already is not encrypted again.
+func (sh *SnapshotHandler) resume(ctx context.Context, item SpoolItem) {
+	snapshot := item.Snapshot
+	if sh.signer == nil {
+		sh.prepare(ctx, snapshot, item.StartTime, item.EndTime)
+		return
+	}
+
+	manifest, metadata, err := sh.signer.Load(snapshot)
+	if err != nil {
+		sh.logger.Warn("Failed to load snapshot manifest, signing it again", "id", snapshot.ID, "error", err)
+	}
+	if manifest == nil {
+		sh.prepare(ctx, snapshot, item.StartTime, item.EndTime)
+		return
+	}
+
+	sh.logger.Info("Resuming signed snapshot", "id", snapshot.ID, "manifest_sequence", manifest.Metadata["manifest_sequence"])
+	maps.Copy(snapshot.Metadata, metadata)
+	if sh.spool != nil && sh.spool.Has(manifest.ID) {
+		// queued by the replayer like any other spooled snapshot
+		snapshot.Metadata["manifest_id"] = manifest.ID
+		manifest = nil
+	} else {
+		sh.spoolSnapshot(manifest)
+	}
+	sh.seal(snapshot, manifest, true)
+}
+
+// seal encrypts uploadSnapshot, then spools and queues it and queues its
+// manifest, if any. With resumed set, a sealed file left by an earlier run
+// is used as is.
+func (sh *SnapshotHandler) seal(uploadSnapshot, manifest *uploader.Snapshot, resumed bool) {
+	if manifest != nil {
+		uploadSnapshot.Metadata["manifest_id"] = manifest.ID
+	}
+
+	upload := true
+	plaintext := uploadSnapshot.Path
+	if sh.encryptor != nil {
+		var sealed bool
+		var err error
+		if resumed {
+			sealed, err = sh.encryptor.Adopt(uploadSnapshot)
+		}
+		if err == nil && !sealed {
+			err = sh.encryptor.Encrypt(uploadSnapshot)
+		}
+		if err != nil {
+			// the plaintext must not stay on the device in place of the sealed copy
+			sh.logger.Error("Failed to encrypt snapshot, deleting it", "id", uploadSnapshot.ID, "error", err)
+			upload = false
+			sh.dropSnapshot(uploadSnapshot, err)
+		}
+	}
+	if upload {
+		sh.spoolAndQueue(uploadSnapshot)
+		// the plaintext is kept until the spool points at the sealed file
+		if uploadSnapshot.Path != plaintext {
+			if err := os.Remove(plaintext); err != nil && !errors.Is(err, os.ErrNotExist) {
+				sh.logger.Error("Failed to remove plaintext snapshot", "path", plaintext, "error", err)
+			}
+		}
+	}
+	// the manifest is uploaded even without its clip, to keep the chain whole
+	if manifest != nil {
+		sh.queueSnapshot(manifest)
+	}
+}
+
+// spoolAndQueue records the final hash of snapshot, spools it and queues
+// it for upload.
+func (sh *SnapshotHandler) spoolAndQueue(snapshot *uploader.Snapshot) {
+	sh.spoolSnapshot(snapshot)
+	sh.queueSnapshot(snapshot)
+}
+
+// spoolSnapshot records the final hash of snapshot and spools it.
+func (sh *SnapshotHandler) spoolSnapshot(snapshot *uploader.Snapshot) {
+	event := Event{
+		Type:       EventSnapshotHashed,
+		SnapshotID: snapshot.ID,
+		Path:       snapshot.Path,
+		Size:       snapshot.Size,
+		Hash:       snapshot.Hash,
+		Trigger:    snapshot.Metadata["trigger"],
+	}
+	if plaintext := snapshot.Metadata["plaintext_sha256"]; plaintext != "" {
+		event.Details = map[string]string{"plaintext_sha256": plaintext}
+	}
+	sh.emit(event)
+
+	if sh.spool != nil {
+		if err := sh.spool.Add(snapshot); err != nil {
+			sh.logger.Error("Failed to spool snapshot", "id", snapshot.ID, "error", err)
+		}
+	}
+}
+
+func (sh *SnapshotHandler) queueSnapshot(snapshot *uploader.Snapshot) {
+	if err := sh.uploader.QueueSnapshot(snapshot); err != nil {
 		sh.logger.Warn("Failed to queue snapshot for upload", "error", err)
+		if sh.spool != nil {
+			sh.spool.Failed(snapshot.ID)
+		}
 		if errutil.IsConnRefused(err) {
 			sh.logger.Error(
 				"Cannot connect to server",
-				"endpoint", sh.uploader.endpoint,
+				"endpoint", sh.uploader.Endpoint(),
 				"hint", "Make sure the external hub server is running at the specified endpoint",
 			)
+			sh.emitUnreachable(snapshot.ID, err)
 		}
 		return
 	}
-	sh.logger.Debug("Queued snapshot for upload", "id", uploadSnapshot.ID)
+	sh.logger.Debug("Queued snapshot for upload", "id", snapshot.ID)
+	sh.emit(Event{
+		Type:       EventSnapshotQueued,
+		SnapshotID: snapshot.ID,
+		Path:       snapshot.Path,
+		Size:       snapshot.Size,
+		Hash:       snapshot.Hash,
+		Trigger:    snapshot.Metadata["trigger"],
+	})
+}
+
+// startReplayer re-queues spooled snapshots left over from a previous run
+// and, periodically, those whose upload failed.
+func (sh *SnapshotHandler) startReplayer(ctx context.Context) {
+	if sh.spool == nil {
+		return
+	}
+
+	go func() {
+		sh.replay(ctx)
+
+		ticker := time.NewTicker(sh.spool.retryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sh.replay(ctx)
+			}
+		}
+	}()
+}
+
+// replay prepares the pending snapshots in the spool and queues the others.
+func (sh *SnapshotHandler) replay(ctx context.Context) {
+	due, err := sh.spool.Due()
+	if err != nil {
+		sh.logger.Error("Failed to read spool", "error", err)
+		return
+	}
+	if len(due) > 0 {
+		sh.logger.Info("Replaying spooled snapshots", "count", len(due))
+	}
+	// pending clips first, so their manifests are still on disk when
+	// resumed rather than uploaded and deleted
+	for _, item := range due {
+		if item.Pending {
+			sh.resume(ctx, item)
+		}
+	}
+	for _, item := range due {
+		if !item.Pending {
+			sh.queueSnapshot(item.Snapshot)
+		}
+	}
+}
+
+// analyze runs the analyzers and reports whether the snapshot should be uploaded.
+// A failing analyzer doesn't stop the snapshot.
+func (sh *SnapshotHandler) analyze(ctx context.Context, snapshot *uploader.Snapshot) bool {
+	for _, analyzer := range sh.analyzers {
+		metadata, err := analyzer.Analyze(ctx, snapshot)
+		maps.Copy(snapshot.Metadata, metadata)
+		if errors.Is(err, ErrDropSnapshot) {
+			sh.logger.Info("Snapshot dropped", "analyzer", analyzer.Name(), "id", snapshot.ID)
+			return false
+		}
+		if err != nil {
+			sh.logger.Warn("Snapshot analysis failed", "analyzer", analyzer.Name(), "id", snapshot.ID, "error", err)
+		}
+	}
+	return true
+}
+
+// dropSnapshot deletes snapshot without uploading it, because an analyzer
+// dropped it or, with err set, because it could not be prepared.
+func (sh *SnapshotHandler) dropSnapshot(snapshot *uploader.Snapshot, err error) {
+	if err := os.Remove(snapshot.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		sh.logger.Warn("Failed to remove dropped snapshot", "path", snapshot.Path, "error", err)
+	}
+	if sh.spool != nil {
+		if err := sh.spool.Done(snapshot.ID); err != nil {
+			sh.logger.Error("Failed to remove snapshot from spool", "id", snapshot.ID, "error", err)
+		}
+	}
+	event := Event{
+		Type:       EventSnapshotDropped,
+		SnapshotID: snapshot.ID,
+		Path:       snapshot.Path,
+		Hash:       snapshot.Hash,
+		Trigger:    snapshot.Metadata["trigger"],
+		Details:    snapshot.Metadata,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	sh.emit(event)
 }
 
 func calculateHash(path string) (string, error) {
@@ -0,0 +1,278 @@
+package components
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+const spoolExt = ".json"
+
+// Spool persists every snapshot as one JSON file per snapshot, so uploads
+// survive restarts and failed queueing. A snapshot is recorded as pending as
+// soon as its file is known, and updated once it is prepared for upload, i.e.
+// analysed, signed and encrypted. Entries are removed only once an upload is
+// confirmed, or the snapshot is dropped.
+type Spool struct {
+	logger        *slog.Logger
+	dir           string
+	retryInterval time.Duration
+
+	mu       sync.Mutex
+	inFlight map[string]bool
+	failedAt map[string]time.Time
+}
+
+type spoolEntry struct {
+	ID         string            `json:"id"`
+	Path       string            `json:"path"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Size       int64             `json:"size"`
+	Hash       string            `json:"hash"`
+	Metadata   map[string]string `json:"metadata"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	Duration   int               `json:"duration"`
+	DeviceID   string            `json:"device_id"`
+	DeviceName string            `json:"device_name"`
+	SpooledAt  time.Time         `json:"spooled_at"`
+
+	// pending entries are prepared again before they are uploaded
+	Pending   bool      `json:"pending,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+// SpoolItem is a spooled snapshot. Pending items were not prepared for
+// upload yet; StartTime and EndTime are those of their recording.
+type SpoolItem struct {
+	Snapshot  *uploader.Snapshot
+	Pending   bool
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+func NewSpool(logger *slog.Logger, dir string, retryInterval time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create spool directory: %w", err)
+	}
+	return &Spool{
+		logger:        logger,
+		dir:           dir,
+		retryInterval: retryInterval,
+		inFlight:      make(map[string]bool),
+		failedAt:      make(map[string]time.Time),
+	}, nil
+}
+
+// Record records snapshot as pending and marks it in flight.
+func (s *Spool) Record(snapshot *uploader.Snapshot, start, end time.Time) error {
+	return s.write(snapshot, true, start, end)
+}
+
+// Add records snapshot, prepared for upload, and marks it in flight.
+func (s *Spool) Add(snapshot *uploader.Snapshot) error {
+	return s.write(snapshot, false, time.Time{}, time.Time{})
+}
+
+func (s *Spool) write(snapshot *uploader.Snapshot, pending bool, start, end time.Time) error {
+	entry := spoolEntry{
+		ID:         snapshot.ID,
+		Path:       snapshot.Path,
+		Timestamp:  snapshot.Timestamp,
+		Size:       snapshot.Size,
+		Hash:       snapshot.Hash,
+		Metadata:   snapshot.Metadata,
+		Width:      snapshot.Width,
+		Height:     snapshot.Height,
+		Duration:   snapshot.Duration,
+		DeviceID:   snapshot.DeviceID,
+		DeviceName: snapshot.DeviceName,
+		SpooledAt:  time.Now(),
+		Pending:    pending,
+		StartTime:  start,
+		EndTime:    end,
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("could not encode spool entry: %w", err)
+	}
+	if err := writeFileAtomic(s.entryPath(snapshot.ID), data, 0o600); err != nil {
+		return fmt.Errorf("could not write spool entry: %w", err)
+	}
+
+	s.mu.Lock()
+	s.inFlight[snapshot.ID] = true
+	delete(s.failedAt, snapshot.ID)
+	s.mu.Unlock()
+	return nil
+}
+
+// Done removes the entry after a confirmed upload.
+func (s *Spool) Done(id string) error {
+	s.mu.Lock()
+	delete(s.inFlight, id)
+	delete(s.failedAt, id)
+	s.mu.Unlock()
+
+	if err := os.Remove(s.entryPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove spool entry: %w", err)
+	}
+	return nil
+}
+
+// Has reports whether snapshot id is spooled.
+func (s *Spool) Has(id string) bool {
+	_, err := os.Stat(s.entryPath(id))
+	return err == nil
+}
+
+// Failed makes the entry eligible for a retry after the retry interval.
+func (s *Spool) Failed(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, id)
+	s.failedAt[id] = time.Now()
+}
+
+// Due returns the entries that are neither in flight nor waiting out a
+// recent failure, oldest first, and marks them in flight. Entries whose
+// snapshot file is gone are discarded.
+func (s *Spool) Due() ([]SpoolItem, error) {
+	entries, err := s.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []SpoolItem
+	for path, entry := range entries {
+		if s.inFlight[entry.ID] {
+			continue
+		}
+		if failed, ok := s.failedAt[entry.ID]; ok && time.Since(failed) < s.retryInterval {
+			continue
+		}
+
+		if _, err := os.Stat(entry.Path); err != nil {
+			s.logger.Warn("Discarding spool entry without snapshot file", "id", entry.ID, "path", entry.Path, "error", err)
+			os.Remove(path)
+			delete(s.failedAt, entry.ID)
+			continue
+		}
+
+		s.inFlight[entry.ID] = true
+		due = append(due, SpoolItem{
+			Snapshot: &uploader.Snapshot{
+				ID:         entry.ID,
+				Path:       entry.Path,
+				Timestamp:  entry.Timestamp,
+				Size:       entry.Size,
+				Hash:       entry.Hash,
+				Metadata:   entry.Metadata,
+				Width:      entry.Width,
+				Height:     entry.Height,
+				Duration:   entry.Duration,
+				DeviceID:   entry.DeviceID,
+				DeviceName: entry.DeviceName,
+			},
+			Pending:   entry.Pending,
+			StartTime: entry.StartTime,
+			EndTime:   entry.EndTime,
+		})
+	}
+
+	sort.Slice(due, func(i, j int) bool { return due[i].Snapshot.Timestamp.Before(due[j].Snapshot.Timestamp) })
+	return due, nil
+}
+
+// Files returns the spooled snapshots by the path of their file, with the
+// ID and metadata they were spooled with.
+func (s *Spool) Files() (map[string]*uploader.Snapshot, error) {
+	entries, err := s.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*uploader.Snapshot, len(entries))
+	for _, entry := range entries {
+		files[entry.Path] = &uploader.Snapshot{ID: entry.ID, Path: entry.Path, Metadata: entry.Metadata}
+	}
+	return files, nil
+}
+
+// entries reads the spool entries by the path of their entry file.
+// Corrupt entries are discarded.
+func (s *Spool) entries() (map[string]spoolEntry, error) {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read spool directory: %w", err)
+	}
+
+	entries := make(map[string]spoolEntry, len(dirEntries))
+	for _, e := range dirEntries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), spoolExt) {
+			continue
+		}
+
+		path := filepath.Join(s.dir, e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			s.logger.Warn("Failed to read spool entry", "path", path, "error", err)
+			continue
+		}
+
+		var entry spoolEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			s.logger.Warn("Discarding corrupt spool entry", "path", path, "error", err)
+			os.Remove(path)
+			continue
+		}
+		entries[path] = entry
+	}
+	return entries, nil
+}
+
+func (s *Spool) entryPath(id string) string {
+	return filepath.Join(s.dir, url.PathEscape(id)+spoolExt)
+}
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it
+// and renames it into place, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
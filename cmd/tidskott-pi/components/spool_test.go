@@ -0,0 +1,309 @@
+package components
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+func discardLogger() *slog.Logger { return slog.New(slog.NewTextHandler(io.Discard, nil)) }
+
+// writeClip writes a clip to dir and returns it as a snapshot.
+func writeClip(t *testing.T, dir, id string, ts time.Time) *uploader.Snapshot {
+	t.Helper()
+
+	path := filepath.Join(dir, id+".mp4")
+	data := []byte("clip " + id)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := calculateHash(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &uploader.Snapshot{
+		ID:        id,
+		Path:      path,
+		Timestamp: ts,
+		Size:      int64(len(data)),
+		Hash:      hash,
+		Metadata:  map[string]string{"trigger": TriggerScheduled, "priority": PriorityRoutine.String()},
+	}
+}
+
+func dueIDs(t *testing.T, s *Spool) map[string]bool {
+	t.Helper()
+
+	due, err := s.Due()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]bool, len(due))
+	for _, item := range due {
+		ids[item.Snapshot.ID] = item.Pending
+	}
+	return ids
+}
+
+func TestSpoolTransitions(t *testing.T) {
+	dir := t.TempDir()
+	spoolDir := filepath.Join(dir, "spool")
+	s, err := NewSpool(discardLogger(), spoolDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := writeClip(t, dir, "a", time.Now())
+
+	if err := s.Record(snapshot, time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if ids := dueIDs(t, s); len(ids) != 0 {
+		t.Fatalf("recorded snapshot in flight is due: %v", ids)
+	}
+
+	s.Failed(snapshot.ID)
+	if pending, ok := dueIDs(t, s)["a"]; !ok || !pending {
+		t.Fatalf("failed recorded snapshot: got due %t pending %t, want a pending snapshot", ok, pending)
+	}
+	if ids := dueIDs(t, s); len(ids) != 0 {
+		t.Fatalf("snapshot returned by Due is due again: %v", ids)
+	}
+
+	if err := s.Add(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	s.Failed(snapshot.ID)
+	if pending, ok := dueIDs(t, s)["a"]; !ok || pending {
+		t.Fatalf("failed prepared snapshot: got due %t pending %t, want a prepared snapshot", ok, pending)
+	}
+
+	if err := s.Done(snapshot.ID); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(snapshot.ID) {
+		t.Error("entry kept after Done")
+	}
+	s.Failed(snapshot.ID)
+	if ids := dueIDs(t, s); len(ids) != 0 {
+		t.Errorf("done snapshot is due: %v", ids)
+	}
+}
+
+func TestSpoolRetryInterval(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSpool(discardLogger(), filepath.Join(dir, "spool"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := writeClip(t, dir, "a", time.Now())
+	if err := s.Add(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Failed(snapshot.ID)
+	if ids := dueIDs(t, s); len(ids) != 0 {
+		t.Errorf("snapshot due before the retry interval: %v", ids)
+	}
+}
+
+func TestSpoolAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	spoolDir := filepath.Join(dir, "spool")
+	s, err := NewSpool(discardLogger(), spoolDir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	newer := writeClip(t, dir, "newer", now)
+	older := writeClip(t, dir, "older", now.Add(-time.Minute))
+	gone := writeClip(t, dir, "gone", now)
+	for _, snapshot := range []*uploader.Snapshot{newer, gone} {
+		if err := s.Add(snapshot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Record(older, now, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(gone.Path); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := filepath.Join(spoolDir, "corrupt"+spoolExt)
+	if err := os.WriteFile(corrupt, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// everything was in flight before the restart
+	s, err = NewSpool(discardLogger(), spoolDir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	due, err := s.Due()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 2 || due[0].Snapshot.ID != "older" || due[1].Snapshot.ID != "newer" {
+		t.Fatalf("got %d due snapshots, want older then newer", len(due))
+	}
+	if !due[0].Pending || due[1].Pending {
+		t.Errorf("got pending %t %t, want true false", due[0].Pending, due[1].Pending)
+	}
+	if due[1].Snapshot.Hash != newer.Hash || due[1].Snapshot.Metadata["trigger"] != TriggerScheduled {
+		t.Errorf("spooled snapshot not restored: %+v", due[1].Snapshot)
+	}
+
+	for _, path := range []string{corrupt, s.entryPath("gone")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s not discarded", filepath.Base(path))
+		}
+	}
+}
+
+type nopSink struct{}
+
+func (nopSink) Name() string                                     { return "nop" }
+func (nopSink) Location() string                                 { return "nowhere" }
+func (nopSink) Upload(context.Context, *uploader.Snapshot) error { return nil }
+
+// replayDevice is a device with a spool, manifests and encryption in dir.
+// A new one over the same dir is the same device after a restart.
+type replayDevice struct {
+	handler  *SnapshotHandler
+	uploader *Uploader
+	spool    *Spool
+	signer   *ManifestSigner
+}
+
+func newReplayDevice(t *testing.T, dir string, identity *age.X25519Identity) *replayDevice {
+	t.Helper()
+
+	spool, err := NewSpool(discardLogger(), filepath.Join(dir, "spool"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := NewUploader(discardLogger(), []Sink{nopSink{}}, DeleteWhenAll, 1, false, 0, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewManifestSigner(filepath.Join(dir, "device.key"), filepath.Join(dir, "chain.json"), "device", "Device", CameraSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor, err := NewEncryptor(identity.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewSnapshotHandler(nil, up, NewEvents("device"), spool, 0, "device", "Device", false, 640, 480, discardLogger())
+	handler.SetManifestSigner(signer)
+	handler.SetEncryptor(encryptor)
+	return &replayDevice{handler: handler, uploader: up, spool: spool, signer: signer}
+}
+
+func (d *replayDevice) queued() map[string]*uploader.Snapshot {
+	d.uploader.mu.Lock()
+	defer d.uploader.mu.Unlock()
+
+	queued := make(map[string]*uploader.Snapshot, len(d.uploader.queue))
+	for _, q := range d.uploader.queue {
+		queued[q.snapshot.ID] = q.snapshot
+	}
+	return queued
+}
+
+func TestReplayPendingSnapshot(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// how far the device got with a recorded clip before it restarted
+	tests := []struct {
+		name   string
+		signed bool
+		sealed bool
+	}{
+		{"recorded", false, false},
+		{"signed", true, false},
+		{"sealed", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			before := newReplayDevice(t, dir, identity)
+			clip := writeClip(t, dir, "clip", time.Now())
+			plaintext := clip.Path
+			if err := before.spool.Record(clip, time.Now(), time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			var sealed []byte
+			if tt.signed {
+				manifest, err := before.signer.Sign(clip, time.Now(), time.Now())
+				if err != nil {
+					t.Fatal(err)
+				}
+				before.handler.spoolSnapshot(manifest)
+			}
+			if tt.sealed {
+				copied := *clip
+				copied.Metadata = map[string]string{}
+				if err := before.handler.encryptor.Encrypt(&copied); err != nil {
+					t.Fatal(err)
+				}
+				sealed, err = os.ReadFile(copied.Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			after := newReplayDevice(t, dir, identity)
+			after.handler.replay(context.Background())
+
+			if seq := after.signer.chain.Sequence; seq != 1 {
+				t.Errorf("chain at sequence %d, want 1: the clip was signed again", seq)
+			}
+			queued := after.queued()
+			if len(queued) != 2 {
+				t.Fatalf("got %d queued snapshots, want the clip and its manifest", len(queued))
+			}
+			manifest := queued["clip"+manifestIDSuffix]
+			if manifest == nil || manifest.Metadata["manifest_sequence"] != "1" {
+				t.Fatalf("got manifest %+v, want sequence 1", manifest)
+			}
+
+			got := queued["clip"]
+			if got == nil || got.Path != plaintext+EncryptedExt || got.Metadata["manifest_id"] != manifest.ID {
+				t.Fatalf("got clip %+v, want the sealed clip with its manifest", got)
+			}
+			if got.Metadata["plaintext_sha256"] != clip.Hash {
+				t.Errorf("got plaintext hash %s, want %s", got.Metadata["plaintext_sha256"], clip.Hash)
+			}
+			data, err := os.ReadFile(got.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hash, _ := calculateHash(got.Path); hash != got.Hash {
+				t.Errorf("queued hash %s is not that of the sealed file", got.Hash)
+			}
+			if tt.sealed && !bytes.Equal(data, sealed) {
+				t.Error("sealed clip encrypted again")
+			}
+			if _, err := os.Stat(plaintext); !os.IsNotExist(err) {
+				t.Error("plaintext kept after sealing")
+			}
+
+			if due := dueIDs(t, newReplayDevice(t, dir, identity).spool); len(due) != 2 || due["clip"] {
+				t.Errorf("got spool %v, want the prepared clip and its manifest", due)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/alesr/tidskott-pi/pkg/tamper"
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+const (
+	// frames are downscaled before analysis; detail beyond this
+	// doesn't change the outcome and costs CPU on the Pi
+	tamperFrameWidth  = 320
+	tamperFrameHeight = 240
+
+	TriggerTamper = "tamper"
+)
+
+var _ Analyzer = (*TamperDetector)(nil)
+
+// TamperDetector checks the first frame of every snapshot for a covered
+// lens, lost focus or a moved camera. When a new alert is raised it emits
+// an event and, optionally, triggers an extra snapshot.
+type TamperDetector struct {
+	logger    *slog.Logger
+	snapshots *SnapshotHandler
+	events    *Events
+	trigger   bool
+
+	mu       sync.Mutex
+	detector *tamper.Detector
+	active   []tamper.Alert
+}
+
+func NewTamperDetector(
+	logger *slog.Logger,
+	minBrightness, minContrast, defocusRatio, minSimilarity float64,
+	triggerSnapshot bool,
+	snapshots *SnapshotHandler,
+	events *Events,
+) *TamperDetector {
+	return &TamperDetector{
+		logger:    logger,
+		snapshots: snapshots,
+		events:    events,
+		trigger:   triggerSnapshot,
+		detector: tamper.NewDetector(tamper.Thresholds{
+			MinBrightness: minBrightness,
+			MinContrast:   minContrast,
+			DefocusRatio:  defocusRatio,
+			MinSimilarity: minSimilarity,
+		}),
+	}
+}
+
+func (t *TamperDetector) Name() string { return "tamper" }
+
+func (t *TamperDetector) Analyze(ctx context.Context, snapshot *uploader.Snapshot) (map[string]string, error) {
+	frame, err := extractFrame(ctx, snapshot.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	result := t.detector.Analyze(frame)
+	raised, cleared := diffAlerts(t.active, result.Alerts)
+	t.active = result.Alerts
+	t.mu.Unlock()
+
+	metadata := map[string]string{
+		"tamper_brightness": fmt.Sprintf("%.1f", result.Brightness),
+		"tamper_sharpness":  fmt.Sprintf("%.1f", result.Sharpness),
+		"tamper_similarity": fmt.Sprintf("%.3f", result.Similarity),
+	}
+	if len(result.Alerts) > 0 {
+		metadata["tamper_alerts"] = joinAlerts(result.Alerts)
+	}
+
+	if len(raised) > 0 {
+		t.logger.Warn("Camera tamper detected", "alerts", joinAlerts(raised), "id", snapshot.ID)
+		t.events.Publish(Event{
+			Type:       EventTamperDetected,
+			SnapshotID: snapshot.ID,
+			Details:    metadata,
+		})
+		if t.trigger {
+			// processing runs on the snapshot pipeline, so don't wait for the request
+			go func() {
+				if err := t.snapshots.Trigger(ctx, TriggerTamper, nil); err != nil {
+					t.logger.Error("Failed to trigger tamper snapshot", "error", err)
+				}
+			}()
+		}
+	}
+	if result.Rebased {
+		t.logger.Info("Camera view steady after moving, using it as the new reference", "id", snapshot.ID)
+	}
+	if len(cleared) > 0 && len(result.Alerts) == 0 {
+		t.logger.Info("Camera tamper cleared", "alerts", joinAlerts(cleared), "id", snapshot.ID)
+		t.events.Publish(Event{
+			Type:       EventTamperCleared,
+			SnapshotID: snapshot.ID,
+			Details:    metadata,
+		})
+	}
+	return metadata, nil
+}
+
+// extractFrame decodes the first video frame of path as a downscaled
+// grayscale image.
+func extractFrame(ctx context.Context, path string) (*tamper.Frame, error) {
+	pix, err := extractKeyframe(
+		ctx,
+		path,
+		"-vf", fmt.Sprintf("scale=%d:%d", tamperFrameWidth, tamperFrameHeight),
+		"-pix_fmt", "gray",
+		"-f", "rawvideo",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	frame, err := tamper.NewFrame(tamperFrameWidth, tamperFrameHeight, pix)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode frame: %w", err)
+	}
+	return frame, nil
+}
+
+func diffAlerts(before, after []tamper.Alert) (raised, cleared []tamper.Alert) {
+	for _, a := range after {
+		if !slices.Contains(before, a) {
+			raised = append(raised, a)
+		}
+	}
+	for _, a := range before {
+		if !slices.Contains(after, a) {
+			cleared = append(cleared, a)
+		}
+	}
+	return raised, cleared
+}
+
+func joinAlerts(alerts []tamper.Alert) string {
+	names := make([]string, len(alerts))
+	for i, a := range alerts {
+		names[i] = string(a)
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,108 @@
+package components
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+type uploadThrottleKey struct{}
+
+// uploadThrottle is the share of the upload bandwidth limit an upload runs
+// under. Routine uploads wait for tokens; higher priorities only spend them,
+// so they run at link speed and slow the routine ones down instead.
+type uploadThrottle struct {
+	limiter *tokenBucket
+	wait    bool
+}
+
+// withUploadThrottle returns a context under which request bodies sent with a
+// throttledTransport and uploads charged with chargeUpload are limited by
+// limiter. A nil limiter leaves ctx unlimited.
+func withUploadThrottle(ctx context.Context, limiter *tokenBucket, priority Priority) context.Context {
+	if limiter == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, uploadThrottleKey{}, uploadThrottle{limiter: limiter, wait: priority <= PriorityRoutine})
+}
+
+// chargeUpload charges n uploaded bytes to the bandwidth limit of ctx, if
+// any, waiting for them in routine uploads.
+func chargeUpload(ctx context.Context, n int64) error {
+	t, ok := ctx.Value(uploadThrottleKey{}).(uploadThrottle)
+	if !ok || n <= 0 {
+		return nil
+	}
+	if !t.wait {
+		t.limiter.Take(float64(n))
+		return nil
+	}
+	return t.limiter.Wait(ctx, float64(n))
+}
+
+// externalUploadLimit charges n bytes that another process, e.g. sftp, is
+// about to send, and returns the rate in bytes per second to limit that
+// process to, or 0 to let it run at link speed. The bytes are spent without
+// waiting, since the process paces itself, but still slow down the routine
+// uploads sent through a throttledTransport.
+func externalUploadLimit(ctx context.Context, n int64) float64 {
+	t, ok := ctx.Value(uploadThrottleKey{}).(uploadThrottle)
+	if !ok {
+		return 0
+	}
+	t.limiter.Take(float64(n))
+	if !t.wait {
+		return 0
+	}
+	return t.limiter.rate
+}
+
+// throttledTransport limits request bodies to the upload throttle of the
+// request context, so the limit holds while a clip is being sent rather than
+// only between clips.
+type throttledTransport struct {
+	base http.RoundTripper
+}
+
+func newThrottledClient(base *http.Client) *http.Client {
+	c := *base
+	transport := c.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	c.Transport = &throttledTransport{base: transport}
+	return &c
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.Context().Value(uploadThrottleKey{}) == nil {
+		return t.base.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	r.Body = &throttledBody{ctx: req.Context(), body: req.Body}
+	return t.base.RoundTrip(r)
+}
+
+// throttledMaxRead bounds each read so the bytes of a single read never
+// cost more than a fraction of a second of a typical limit.
+const throttledMaxRead = 32 << 10
+
+type throttledBody struct {
+	ctx  context.Context
+	body io.ReadCloser
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if len(p) > throttledMaxRead {
+		p = p[:throttledMaxRead]
+	}
+	n, err := b.body.Read(p)
+	if n > 0 {
+		if werr := chargeUpload(b.ctx, int64(n)); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (b *throttledBody) Close() error { return b.body.Close() }
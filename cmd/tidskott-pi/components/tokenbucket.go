@@ -0,0 +1,72 @@
+package components
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket refills at rate tokens per second up to burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Wait blocks until n tokens are available or ctx is done. Requests larger
+// than the burst are served a burst at a time.
+func (b *tokenBucket) Wait(ctx context.Context, n float64) error {
+	for n > 0 {
+		chunk := min(n, b.burst)
+		if err := b.wait(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+func (b *tokenBucket) wait(ctx context.Context, n float64) error {
+	b.mu.Lock()
+	b.refill()
+	b.tokens -= n
+	deficit := -b.tokens
+	b.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens += n
+		b.mu.Unlock()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Take spends n tokens without waiting, possibly leaving a deficit that
+// later callers of Wait pay for. The deficit is capped at one burst.
+func (b *tokenBucket) Take(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.tokens = max(b.tokens-n, -b.burst)
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
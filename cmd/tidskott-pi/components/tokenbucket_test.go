@@ -0,0 +1,72 @@
+package components
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketWait(t *testing.T) {
+	tests := []struct {
+		name  string
+		taken float64 // spent with Take first
+		n     float64
+		min   time.Duration
+		max   time.Duration
+	}{
+		{name: "within burst", n: 100, max: 20 * time.Millisecond},
+		{name: "beyond burst", n: 150, min: 40 * time.Millisecond, max: 150 * time.Millisecond},
+		{name: "several bursts", n: 250, min: 140 * time.Millisecond, max: 300 * time.Millisecond},
+		{name: "after take", taken: 100, n: 50, min: 40 * time.Millisecond, max: 150 * time.Millisecond},
+		{name: "deficit capped at one burst", taken: 10000, n: 1, min: 90 * time.Millisecond, max: 250 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(1000, 100)
+			b.Take(tt.taken)
+
+			start := time.Now()
+			if err := b.Wait(context.Background(), tt.n); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < tt.min || elapsed > tt.max {
+				t.Errorf("waited %v, want %v to %v", elapsed, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestTokenBucketCancel(t *testing.T) {
+	b := newTokenBucket(1000, 100)
+	b.Take(100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.Wait(ctx, 100); err == nil {
+		t.Fatal("Wait returned before its tokens were available")
+	}
+
+	// the cancelled request is refunded, so only the Take is owed
+	b.mu.Lock()
+	b.refill()
+	tokens := b.tokens
+	b.mu.Unlock()
+	if tokens < 0 || tokens > 30 {
+		t.Errorf("got %.0f tokens after a cancelled wait, want the ~10 refilled since", tokens)
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	b := newTokenBucket(1000, 100)
+	b.Take(100)
+	b.last = b.last.Add(-time.Second) // a second passes
+
+	b.mu.Lock()
+	b.refill()
+	tokens := b.tokens
+	b.mu.Unlock()
+	if math.Abs(tokens-100) > 1 {
+		t.Errorf("got %.0f tokens, want refills capped at the burst of 100", tokens)
+	}
+}
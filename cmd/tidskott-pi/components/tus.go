@@ -0,0 +1,342 @@
+package components
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+const (
+	tusVersion = "1.0.0"
+
+	// servers expire incomplete uploads; older state is not worth resuming
+	tusStateMaxAge = 7 * 24 * time.Hour
+)
+
+// tusStatusError is an unexpected response from the tus server.
+type tusStatusError struct {
+	method string
+	status int
+}
+
+func (e *tusStatusError) Error() string {
+	return fmt.Sprintf("%s returned %d %s", e.method, e.status, http.StatusText(e.status))
+}
+
+// TusSink uploads snapshots to the hub with the tus resumable upload
+// protocol, in chunks. The upload URL is persisted in stateDir under the
+// snapshot SHA-256, so an interrupted upload resumes from the offset the
+// server acknowledged, both on retry and after a restart.
+type TusSink struct {
+	logger     *slog.Logger
+	client     *http.Client
+	endpoint   *url.URL
+	tokens     *TokenManager // nil without auth
+	check      *HubCheck     // nil to upload without checking
+	chunkSize  int64
+	stateDir   string
+	maxRetries int
+}
+
+type tusState struct {
+	URL       string    `json:"url"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NewTusSink returns a sink that authenticates with tokens from tokens, if
+// set.
+func NewTusSink(
+	logger *slog.Logger,
+	client *http.Client,
+	endpoint string,
+	chunkSize int64,
+	stateDir string,
+	maxRetries int,
+	tokens *TokenManager,
+	check *HubCheck,
+) (*TusSink, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse tus endpoint: %w", err)
+	}
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create tus state directory: %w", err)
+	}
+
+	t := &TusSink{
+		logger:     logger,
+		client:     newThrottledClient(client),
+		endpoint:   u,
+		tokens:     tokens,
+		chunkSize:  chunkSize,
+		stateDir:   stateDir,
+		maxRetries: maxRetries,
+		check:      check,
+	}
+	t.pruneState()
+	return t, nil
+}
+
+func (t *TusSink) Name() string { return "tus" }
+
+func (t *TusSink) Location() string { return t.endpoint.String() }
+
+func (t *TusSink) Upload(ctx context.Context, snapshot *uploader.Snapshot) error {
+	if _, err := os.Stat(snapshot.Path); err != nil {
+		return fmt.Errorf("could not stat snapshot: %w", err)
+	}
+	if alreadyOnHub(ctx, t.logger, t.check, snapshot) {
+		os.Remove(t.statePath(snapshot.Hash))
+		return nil
+	}
+
+	err := retry(ctx, t.logger, t.Name(), t.maxRetries, t.retryable, func() error {
+		return t.upload(ctx, snapshot)
+	})
+	if err != nil {
+		return fmt.Errorf("could not upload %s with tus: %w", snapshot.ID, err)
+	}
+
+	if err := os.Remove(t.statePath(snapshot.Hash)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		t.logger.Warn("Failed to remove tus upload state", "id", snapshot.ID, "error", err)
+	}
+	return nil
+}
+
+// upload creates the upload, or finds where the previous attempt stopped,
+// and sends the rest of the file.
+func (t *TusSink) upload(ctx context.Context, snapshot *uploader.Snapshot) error {
+	state, _ := t.loadState(snapshot.Hash)
+
+	var offset int64
+	if state.URL != "" && state.Size == snapshot.Size {
+		off, err := t.head(ctx, state.URL)
+		switch {
+		case err == nil:
+			offset = off
+			t.logger.Info("Resuming upload", "id", snapshot.ID, "offset", offset, "size", snapshot.Size)
+		case isTusGone(err):
+			state.URL = ""
+		default:
+			return err
+		}
+	} else {
+		state.URL = ""
+	}
+
+	if state.URL == "" {
+		location, err := t.create(ctx, snapshot)
+		if err != nil {
+			return err
+		}
+		state = tusState{URL: location, Size: snapshot.Size, CreatedAt: time.Now()}
+		if err := t.saveState(snapshot.Hash, state); err != nil {
+			t.logger.Warn("Failed to save tus upload state", "id", snapshot.ID, "error", err)
+		}
+	}
+
+	f, err := os.Open(snapshot.Path)
+	if err != nil {
+		return fmt.Errorf("could not open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	for offset < snapshot.Size {
+		n := min(t.chunkSize, snapshot.Size-offset)
+		next, err := t.patch(ctx, state.URL, f, offset, n)
+		if err != nil {
+			if isTusGone(err) {
+				// the server dropped the upload; start over on the next attempt
+				os.Remove(t.statePath(snapshot.Hash))
+			}
+			return err
+		}
+		offset = next
+	}
+	return nil
+}
+
+func (t *TusSink) create(ctx context.Context, snapshot *uploader.Snapshot) (string, error) {
+	resp, err := t.do(ctx, http.MethodPost, t.endpoint.String(), nil, func(req *http.Request) {
+		req.Header.Set("Upload-Length", strconv.FormatInt(snapshot.Size, 10))
+		req.Header.Set("Upload-Metadata", tusMetadata(snapshot))
+	})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", &tusStatusError{method: http.MethodPost, status: resp.StatusCode}
+	}
+	location, err := t.endpoint.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return "", errors.New("tus server returned no upload location")
+	}
+	return location.String(), nil
+}
+
+func (t *TusSink) head(ctx context.Context, uploadURL string) (int64, error) {
+	resp, err := t.do(ctx, http.MethodHead, uploadURL, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return 0, &tusStatusError{method: http.MethodHead, status: resp.StatusCode}
+	}
+	return parseUploadOffset(resp)
+}
+
+// patch sends n bytes of f from offset.
+func (t *TusSink) patch(ctx context.Context, uploadURL string, f io.ReaderAt, offset, n int64) (int64, error) {
+	resp, err := t.do(ctx, http.MethodPatch, uploadURL, io.NewSectionReader(f, offset, n), func(req *http.Request) {
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(f, offset, n)), nil
+		}
+		req.ContentLength = n
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return 0, &tusStatusError{method: http.MethodPatch, status: resp.StatusCode}
+	}
+	next, err := parseUploadOffset(resp)
+	if err != nil {
+		return 0, err
+	}
+	if next <= offset {
+		return 0, fmt.Errorf("tus server did not advance offset %d", offset)
+	}
+	return next, nil
+}
+
+func (t *TusSink) do(ctx context.Context, method, target string, body io.Reader, prepare func(*http.Request)) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	if prepare != nil {
+		prepare(req)
+	}
+
+	if t.tokens != nil {
+		return t.tokens.Do(ctx, t.client, req)
+	}
+	return t.client.Do(req)
+}
+
+func (t *TusSink) statePath(hash string) string {
+	return filepath.Join(t.stateDir, hash+".json")
+}
+
+func (t *TusSink) loadState(hash string) (tusState, error) {
+	var state tusState
+	data, err := os.ReadFile(t.statePath(hash))
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func (t *TusSink) saveState(hash string, state tusState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.statePath(hash), data, 0o600)
+}
+
+// pruneState removes state for uploads too old to resume.
+func (t *TusSink) pruneState() {
+	entries, err := os.ReadDir(t.stateDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || time.Since(info.ModTime()) < tusStateMaxAge {
+			continue
+		}
+		os.Remove(filepath.Join(t.stateDir, e.Name()))
+	}
+}
+
+func parseUploadOffset(resp *http.Response) (int64, error) {
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid Upload-Offset %q", resp.Header.Get("Upload-Offset"))
+	}
+	return offset, nil
+}
+
+// tusMetadata encodes the snapshot details and upload metadata as a tus
+// Upload-Metadata header: comma separated keys and base64 values.
+func tusMetadata(snapshot *uploader.Snapshot) string {
+	pairs := hubMetadata(snapshot)
+	pairs["filename"] = filepath.Base(snapshot.Path)
+
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + " " + base64.StdEncoding.EncodeToString([]byte(pairs[k]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// isTusGone reports whether the server no longer knows the upload.
+func isTusGone(err error) bool {
+	var statusErr *tusStatusError
+	return errors.As(err, &statusErr) && (statusErr.status == http.StatusNotFound || statusErr.status == http.StatusGone)
+}
+
+// retryable retries server errors, throttling, offset conflicts, lost
+// uploads and network failures, and, with a token manager that fetches a
+// new token on the next attempt, expired tokens.
+func (t *TusSink) retryable(err error) bool {
+	var statusErr *tusStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.status {
+		case http.StatusConflict, http.StatusLocked, http.StatusTooManyRequests,
+			http.StatusNotFound, http.StatusGone:
+			return true
+		case http.StatusUnauthorized:
+			return t.tokens != nil
+		}
+		return statusErr.status >= 500
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return false
+	}
+	return !errors.Is(err, context.Canceled)
+}
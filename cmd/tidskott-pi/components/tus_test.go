@@ -0,0 +1,244 @@
+package components
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+// tusServer is a minimal tus server keeping uploads in memory.
+type tusServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	uploads map[string][]byte
+	sizes   map[string]int64
+	created int
+	offsets []int64 // Upload-Offset of every PATCH
+
+	// cutAfter, if set, makes the next PATCH store only that many bytes and
+	// fail, as if the connection dropped
+	cutAfter int
+}
+
+func newTusServer(t *testing.T) *tusServer {
+	s := &tusServer{uploads: make(map[string][]byte), sizes: make(map[string]int64)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *tusServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		http.Error(w, "unsupported version", http.StatusPreconditionFailed)
+		return
+	}
+
+	if r.Method == http.MethodPost && r.URL.Path == "/files" {
+		size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad Upload-Length", http.StatusBadRequest)
+			return
+		}
+		s.created++
+		path := fmt.Sprintf("/files/%d", s.created)
+		s.uploads[path] = nil
+		s.sizes[path] = size
+		w.Header().Set("Location", path)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	data, ok := s.uploads[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset != int64(len(data)) {
+			http.Error(w, "offset mismatch", http.StatusConflict)
+			return
+		}
+		s.offsets = append(s.offsets, offset)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.cutAfter > 0 {
+			s.uploads[r.URL.Path] = append(data, body[:s.cutAfter]...)
+			s.cutAfter = 0
+			http.Error(w, "connection lost", http.StatusBadGateway)
+			return
+		}
+		s.uploads[r.URL.Path] = append(data, body...)
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(s.uploads[r.URL.Path])))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// forget drops every upload, as a server expiring them would.
+func (s *tusServer) forget() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.uploads)
+}
+
+// completed returns the data of the uploads that reached their length.
+func (s *tusServer) completed() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var done [][]byte
+	for path, data := range s.uploads {
+		if int64(len(data)) == s.sizes[path] {
+			done = append(done, data)
+		}
+	}
+	return done
+}
+
+func writeTusClip(t *testing.T) (*uploader.Snapshot, []byte) {
+	t.Helper()
+
+	snapshot := writeClip(t, t.TempDir(), "a", time.Now())
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	if err := os.WriteFile(snapshot.Path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Size = int64(len(data))
+	return snapshot, data
+}
+
+func newTestTusSink(t *testing.T, server *tusServer, stateDir string, maxRetries int) *TusSink {
+	t.Helper()
+
+	sink, err := NewTusSink(discardLogger(), server.Client(), server.URL+"/files", 400, stateDir, maxRetries, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func TestTusResumesAfterPartialPatch(t *testing.T) {
+	server := newTusServer(t)
+	snapshot, data := writeTusClip(t)
+	stateDir := t.TempDir()
+	ctx := context.Background()
+
+	// the first chunk goes through, the second is cut after 150 bytes and
+	// the attempt given up
+	first := newTestTusSink(t, server, stateDir, 0)
+	wrapped := first.client.Transport
+	first.client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodPatch && req.Header.Get("Upload-Offset") == "400" {
+			server.mu.Lock()
+			server.cutAfter = 150
+			server.mu.Unlock()
+		}
+		return wrapped.RoundTrip(req)
+	})
+	if err := first.Upload(ctx, snapshot); err == nil {
+		t.Fatal("upload succeeded through a dropped connection")
+	}
+
+	// a new sink, as after a restart, continues from what the server has
+	second := newTestTusSink(t, server, stateDir, 0)
+	if err := second.Upload(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	done := server.completed()
+	if len(done) != 1 || !bytes.Equal(done[0], data) {
+		t.Fatalf("got %d complete uploads, want the clip once", len(done))
+	}
+	if server.created != 1 {
+		t.Errorf("created %d uploads, want 1", server.created)
+	}
+	want := []int64{0, 400, 550, 950}
+	if fmt.Sprint(server.offsets) != fmt.Sprint(want) {
+		t.Errorf("got PATCH offsets %v, want %v", server.offsets, want)
+	}
+	if _, err := os.Stat(second.statePath(snapshot.Hash)); !os.IsNotExist(err) {
+		t.Error("upload state left behind after the upload completed")
+	}
+}
+
+func TestTusRestartsForgottenUpload(t *testing.T) {
+	server := newTusServer(t)
+	snapshot, data := writeTusClip(t)
+	stateDir := t.TempDir()
+	ctx := context.Background()
+
+	server.cutAfter = 100
+	first := newTestTusSink(t, server, stateDir, 0)
+	if err := first.Upload(ctx, snapshot); err == nil {
+		t.Fatal("upload succeeded through a dropped connection")
+	}
+
+	// the server expired the upload; HEAD answers 404
+	server.forget()
+	second := newTestTusSink(t, server, stateDir, 0)
+	if err := second.Upload(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	done := server.completed()
+	if len(done) != 1 || !bytes.Equal(done[0], data) {
+		t.Fatalf("got %d complete uploads, want the clip once", len(done))
+	}
+	if server.created != 2 {
+		t.Errorf("created %d uploads, want a new one after the 404", server.created)
+	}
+}
+
+func TestTusRetryable(t *testing.T) {
+	manager := NewTokenManager(discardLogger(), http.DefaultClient, "http://localhost/auth/token", "id", "secret", nil, "")
+	tests := []struct {
+		name   string
+		tokens *TokenManager
+		err    error
+		want   bool
+	}{
+		{name: "server error", err: &tusStatusError{status: http.StatusBadGateway}, want: true},
+		{name: "conflict", err: &tusStatusError{status: http.StatusConflict}, want: true},
+		{name: "gone", err: &tusStatusError{status: http.StatusGone}, want: true},
+		{name: "bad request", err: &tusStatusError{status: http.StatusBadRequest}, want: false},
+		{name: "unauthorized without tokens", err: &tusStatusError{status: http.StatusUnauthorized}, want: false},
+		{name: "unauthorized with tokens", tokens: manager, err: &tusStatusError{status: http.StatusUnauthorized}, want: true},
+		{name: "missing file", err: &os.PathError{Op: "open", Path: "a.mp4", Err: os.ErrNotExist}, want: false},
+		{name: "cancelled", err: context.Canceled, want: false},
+		{name: "network", err: io.ErrUnexpectedEOF, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &TusSink{tokens: tt.tokens}
+			if got := sink.retryable(tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
@@ -1,78 +1,529 @@
 package components
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"os"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/alesr/tidskott-pi/internal/pkg/errutil"
 	"github.com/alesr/tidskott-uploader/pkg/uploader"
 )
 
+// windowRecheckInterval bounds how long routine snapshots wait after an
+// upload window opens.
+const windowRecheckInterval = time.Minute
+
+var ErrUploaderStopped = errors.New("uploader stopped")
+
+// sinkSet is a set of sinks together with the uploads using it, so a
+// replaced set is only stopped once those uploads finish.
+type sinkSet struct {
+	sinks []Sink
+	inUse sync.WaitGroup
+}
+
+type queuedSnapshot struct {
+	snapshot   *uploader.Snapshot
+	priority   Priority
+	queuedAt   time.Time
+	duplicates []*uploader.Snapshot // other snapshots of the same clip, settled with it
+}
+
+type UploadResult struct {
+	Snapshot  *uploader.Snapshot
+	Success   bool
+	Duplicate bool // an identical clip was uploaded already, nothing was sent
+	Deleted   bool // the local file was deleted after the upload
+	Error     error
+	Speed     float64   // bytes per second
+	QueuedAt  time.Time // when the snapshot was first queued
+}
+
+// Uploader sends snapshots to one or more sinks, highest priority first.
+// Routine snapshots are held until an upload window is open and are sent no
+// faster than the bandwidth limit; higher priorities are handed over
+// immediately and sent at link speed, though their bytes still count against
+// the limit. Waiting snapshots gain one priority level per aging interval so
+// routine uploads are not starved by a stream of triggered ones.
+//
+// A snapshot is uploaded to all sinks in parallel and counts as uploaded
+// once the delete policy is satisfied. When a retry follows a partial
+// failure, only the sinks that have not stored it yet are tried again.
+//
+// Clips are deduplicated by hash: a clip already queued is not queued
+// again, one identical to a clip being uploaded waits for that upload, and
+// one identical to a recently uploaded clip succeeds without being sent.
 type Uploader struct {
-	logger   *slog.Logger
-	uploader *uploader.Uploader
-	endpoint string
+	logger            *slog.Logger
+	policy            DeletePolicy
+	maxConcurrent     int
+	deleteAfterUpload bool
+
+	sinksMu  sync.Mutex
+	sinks    *sinkSet
+	retiring sync.WaitGroup // replaced sink sets waiting to be stopped
+
+	mu        sync.Mutex
+	endpoint  string
+	limiter   *tokenBucket
+	windows   []uploadWindow
+	aging     time.Duration
+	queue     []queuedSnapshot
+	delivered map[string]map[string]bool // snapshot ID -> sink names
+	active    map[string]bool            // hashes being uploaded
+	uploaded  *hashSet
+	stopped   bool
+
+	wake    chan struct{}
+	slots   chan struct{} // one per upload in progress
+	results chan UploadResult
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
 }
 
 func NewUploader(
 	logger *slog.Logger,
-	endpoint string,
-	maxRetries, maxConcurrent int,
-	deleteAfterUpload, authEnabled bool,
-	authEndpoint, clientID, clientSecret string,
+	sinks []Sink,
+	policy DeletePolicy,
+	maxConcurrent int,
+	deleteAfterUpload bool,
+	maxBytesPerSecond int64,
+	windows []string,
+	priorityAging time.Duration,
 ) (*Uploader, error) {
-	uploadConfig := uploader.DefaultConfig()
-	uploadConfig.Endpoint = endpoint
-	uploadConfig.MaxRetries = maxRetries
-	uploadConfig.MaxConcurrent = maxConcurrent
-	uploadConfig.DeleteAfterUpload = deleteAfterUpload
-
-	if authEnabled {
-		baseURL := endpoint
-		if before, ok := strings.CutSuffix(baseURL, "/upload"); ok {
-			baseURL = before
-		}
-
-		uploadConfig.AuthEnabled = true
-		uploadConfig.AuthEndpoint = baseURL + authEndpoint
-		uploadConfig.ClientID = clientID
-		uploadConfig.ClientSecret = clientSecret
+	if len(sinks) == 0 {
+		return nil, errors.New("no upload sinks")
 	}
 
-	up, err := uploader.New(uploadConfig, logger)
+	uploadWindows, err := parseUploadWindows(windows)
 	if err != nil {
-		return nil, fmt.Errorf("could notcreate uploader: %w", err)
+		return nil, err
 	}
+
 	return &Uploader{
-		uploader: up,
-		logger:   logger,
-		endpoint: endpoint,
+		logger:            logger,
+		sinks:             &sinkSet{sinks: sinks},
+		endpoint:          sinkLocations(sinks),
+		policy:            policy,
+		maxConcurrent:     maxConcurrent,
+		deleteAfterUpload: deleteAfterUpload,
+		limiter:           newUploadLimiter(maxBytesPerSecond),
+		windows:           uploadWindows,
+		aging:             priorityAging,
+		delivered:         make(map[string]map[string]bool),
+		active:            make(map[string]bool),
+		uploaded:          newHashSet(recentUploads),
+		wake:              make(chan struct{}, 1),
+		slots:             make(chan struct{}, maxConcurrent),
+		results:           make(chan UploadResult, 64),
 	}, nil
 }
 
+// Start starts the sinks and the upload dispatcher. Sinks started before a
+// failing one are stopped again.
 func (u *Uploader) Start() error {
-	if err := u.uploader.Start(); err != nil {
-		if errutil.IsConnRefused(err) {
-			u.logger.Error(
-				"Failed to connect to the server",
-				"endpoint", u.endpoint,
-				"error", err,
-				"hint", "Make sure the external hub server is running at the specified endpoint",
-			)
-			return fmt.Errorf("could not connect to server: %w", err)
+	for i, sink := range u.sinks.sinks {
+		starter, ok := sink.(sinkStarter)
+		if !ok {
+			continue
+		}
+		if err := starter.Start(); err != nil {
+			u.stopSinks(u.sinks.sinks[:i])
+			return fmt.Errorf("could not start %s sink: %w", sink.Name(), err)
 		}
-		return fmt.Errorf("could notstart uploader: %w", err)
 	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	u.cancel = cancel
+
+	u.wg.Add(1)
+	go u.dispatch(ctx)
 	return nil
 }
 
 func (u *Uploader) Stop() error {
-	return u.uploader.Stop()
+	u.mu.Lock()
+	u.stopped = true
+	u.mu.Unlock()
+
+	if u.cancel != nil {
+		u.cancel()
+	}
+	u.wg.Wait()
+	u.retiring.Wait()
+
+	u.sinksMu.Lock()
+	defer u.sinksMu.Unlock()
+	return u.stopSinks(u.sinks.sinks)
+}
+
+// SetSinks replaces the sinks, e.g. after a config reload. The new sinks
+// are started first; uploads in progress finish on the old sinks, which are
+// stopped in the background once they are done.
+func (u *Uploader) SetSinks(sinks []Sink) error {
+	if len(sinks) == 0 {
+		return errors.New("no upload sinks")
+	}
+	for i, sink := range sinks {
+		starter, ok := sink.(sinkStarter)
+		if !ok {
+			continue
+		}
+		if err := starter.Start(); err != nil {
+			u.stopSinks(sinks[:i])
+			return fmt.Errorf("could not start %s sink: %w", sink.Name(), err)
+		}
+	}
+
+	u.sinksMu.Lock()
+	old := u.sinks
+	u.sinks = &sinkSet{sinks: sinks}
+	u.sinksMu.Unlock()
+
+	u.mu.Lock()
+	u.endpoint = sinkLocations(sinks)
+	u.mu.Unlock()
+
+	u.retiring.Add(1)
+	go func() {
+		defer u.retiring.Done()
+		old.inUse.Wait()
+		if err := u.stopSinks(old.sinks); err != nil {
+			u.logger.Warn("Failed to stop replaced sinks", "error", err)
+		}
+	}()
+	return nil
 }
 
+// acquireSinks returns the current sinks, which stay started until the
+// caller calls release.
+func (u *Uploader) acquireSinks() (set *sinkSet, release func()) {
+	u.sinksMu.Lock()
+	defer u.sinksMu.Unlock()
+	set = u.sinks
+	set.inUse.Add(1)
+	return set, set.inUse.Done
+}
+
+// SetLimits replaces the bandwidth limit, upload windows and priority
+// aging interval, e.g. after a config reload.
+func (u *Uploader) SetLimits(maxBytesPerSecond int64, windows []string, priorityAging time.Duration) error {
+	uploadWindows, err := parseUploadWindows(windows)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	u.limiter = newUploadLimiter(maxBytesPerSecond)
+	u.windows = uploadWindows
+	u.aging = priorityAging
+	u.mu.Unlock()
+
+	// snapshots may be allowed to go now
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Endpoint describes where snapshots are uploaded, for logs and events.
+func (u *Uploader) Endpoint() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.endpoint
+}
+
+func newUploadLimiter(maxBytesPerSecond int64) *tokenBucket {
+	if maxBytesPerSecond <= 0 {
+		return nil
+	}
+	// allow one second worth of burst
+	return newTokenBucket(float64(maxBytesPerSecond), float64(maxBytesPerSecond))
+}
+
+func sinkLocations(sinks []Sink) string {
+	locations := make([]string, len(sinks))
+	for i, sink := range sinks {
+		locations[i] = sink.Location()
+	}
+	return strings.Join(locations, ", ")
+}
+
+func (u *Uploader) stopSinks(sinks []Sink) error {
+	var errs []error
+	for _, sink := range sinks {
+		if starter, ok := sink.(sinkStarter); ok {
+			if err := starter.Stop(); err != nil {
+				errs = append(errs, fmt.Errorf("could not stop %s sink: %w", sink.Name(), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// QueueSnapshot adds snapshot to the upload queue, unless a snapshot with
+// the same hash is queued already. A different snapshot of the same clip
+// then gets its result together with the queued one. A new version of a
+// queued snapshot, e.g. its encrypted copy, replaces it. Upload failures are
+// reported on Results.
 func (u *Uploader) QueueSnapshot(snapshot *uploader.Snapshot) error {
-	return u.uploader.QueueSnapshot(snapshot)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.stopped {
+		return ErrUploaderStopped
+	}
+	for i, q := range u.queue {
+		switch {
+		case q.snapshot.Hash == snapshot.Hash:
+			u.logger.Debug("Snapshot already queued", "id", snapshot.ID, "hash", snapshot.Hash)
+			if q.snapshot.ID != snapshot.ID && !slices.ContainsFunc(q.duplicates, func(d *uploader.Snapshot) bool {
+				return d.ID == snapshot.ID
+			}) {
+				u.queue[i].duplicates = append(q.duplicates, snapshot)
+			}
+			return nil
+		case q.snapshot.ID == snapshot.ID:
+			u.logger.Debug("Replacing queued snapshot", "id", snapshot.ID, "hash", snapshot.Hash)
+			u.queue[i].snapshot = snapshot
+			return nil
+		}
+	}
+
+	u.queue = append(u.queue, queuedSnapshot{
+		snapshot: snapshot,
+		priority: snapshotPriority(snapshot),
+		queuedAt: time.Now(),
+	})
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+	return nil
 }
 
-func (u *Uploader) Results() <-chan uploader.UploadResult { return u.uploader.Results() }
+func (u *Uploader) Results() <-chan UploadResult { return u.results }
+
+func (u *Uploader) dispatch(ctx context.Context) {
+	defer u.wg.Done()
+
+	for {
+		// a snapshot is only picked once it can start uploading, so one
+		// queued while every slot was busy still goes first if it should
+		select {
+		case <-ctx.Done():
+			return
+		case u.slots <- struct{}{}:
+		}
+
+		q, ok := u.next(time.Now())
+		if !ok {
+			<-u.slots
+			select {
+			case <-ctx.Done():
+				return
+			case <-u.wake:
+			case <-time.After(windowRecheckInterval):
+			}
+			continue
+		}
+
+		u.wg.Add(1)
+		go func() {
+			defer u.wg.Done()
+			defer func() { <-u.slots }()
+			u.run(ctx, q)
+		}()
+	}
+}
+
+// next removes and returns the snapshot with the highest aged priority among
+// those allowed to go now, and marks its hash active; ties go to the oldest.
+func (u *Uploader) next(now time.Time) (queuedSnapshot, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	inWindow := inUploadWindow(u.windows, now)
+	best := -1
+	var bestPriority Priority
+	for i, q := range u.queue {
+		if q.priority == PriorityRoutine && !inWindow || u.active[q.snapshot.Hash] {
+			continue
+		}
+		p := u.agedPriority(q, now)
+		if best == -1 || p > bestPriority || p == bestPriority && q.queuedAt.Before(u.queue[best].queuedAt) {
+			best, bestPriority = i, p
+		}
+	}
+	if best == -1 {
+		return queuedSnapshot{}, false
+	}
+
+	q := u.queue[best]
+	u.queue = append(u.queue[:best], u.queue[best+1:]...)
+	u.active[q.snapshot.Hash] = true
+	return q, true
+}
+
+func (u *Uploader) agedPriority(q queuedSnapshot, now time.Time) Priority {
+	if u.aging <= 0 {
+		return q.priority
+	}
+	return q.priority + Priority(now.Sub(q.queuedAt)/u.aging)
+}
+
+// run uploads q and publishes the result.
+func (u *Uploader) run(ctx context.Context, q queuedSnapshot) {
+	snapshot := q.snapshot
+	u.mu.Lock()
+	limiter := u.limiter
+	u.mu.Unlock()
+	result := u.upload(withUploadThrottle(ctx, limiter, q.priority), snapshot)
+	result.QueuedAt = q.queuedAt
+
+	u.mu.Lock()
+	delete(u.active, snapshot.Hash)
+	if result.Success {
+		u.uploaded.Add(snapshot.Hash)
+	}
+	u.mu.Unlock()
+	select {
+	case u.wake <- struct{}{}: // duplicates and snapshots waiting for a slot may go
+	default:
+	}
+
+	u.publish(ctx, result)
+	for _, duplicate := range q.duplicates {
+		if !result.Success {
+			u.publish(ctx, UploadResult{Snapshot: duplicate, Error: result.Error, QueuedAt: q.queuedAt})
+			continue
+		}
+		u.logger.Info("Skipping upload of duplicate snapshot", "id", duplicate.ID, "hash", duplicate.Hash)
+		u.publish(ctx, UploadResult{
+			Snapshot:  duplicate,
+			Success:   true,
+			Duplicate: true,
+			Deleted:   u.removeUploaded(duplicate),
+			QueuedAt:  q.queuedAt,
+		})
+	}
+}
+
+// upload sends snapshot to every sink that does not have it yet.
+func (u *Uploader) upload(ctx context.Context, snapshot *uploader.Snapshot) UploadResult {
+	u.mu.Lock()
+	duplicate := u.uploaded.Has(snapshot.Hash)
+	u.mu.Unlock()
+	if duplicate {
+		u.logger.Info("Skipping upload of duplicate snapshot", "id", snapshot.ID, "hash", snapshot.Hash)
+		deleted := u.removeUploaded(snapshot)
+		return UploadResult{Snapshot: snapshot, Success: true, Duplicate: true, Deleted: deleted}
+	}
+
+	set, release := u.acquireSinks()
+	defer release()
+	pending := u.pendingSinks(set.sinks, snapshot.ID)
+
+	start := time.Now()
+	errs := make([]error, len(pending))
+	var wg sync.WaitGroup
+	for i, sink := range pending {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sink.Upload(ctx, snapshot); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", sink.Name(), err)
+				return
+			}
+			u.markDelivered(snapshot.ID, sink.Name())
+		}()
+	}
+	wg.Wait()
+
+	var speed float64
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		speed = float64(snapshot.Size) / elapsed
+	}
+
+	u.mu.Lock()
+	delivered := len(u.delivered[snapshot.ID])
+	u.mu.Unlock()
+
+	err := errors.Join(errs...)
+	if !u.policy.satisfied(delivered, len(set.sinks)) {
+		if _, statErr := os.Stat(snapshot.Path); errors.Is(statErr, fs.ErrNotExist) {
+			// nothing left to retry with
+			u.Forget(snapshot.ID)
+		}
+		return UploadResult{Snapshot: snapshot, Error: err, Speed: speed}
+	}
+	if err != nil {
+		u.logger.Warn("Snapshot stored by some sinks only", "id", snapshot.ID, "error", err)
+	}
+
+	u.mu.Lock()
+	delete(u.delivered, snapshot.ID)
+	u.mu.Unlock()
+
+	deleted := u.removeUploaded(snapshot)
+	return UploadResult{Snapshot: snapshot, Success: true, Speed: speed, Deleted: deleted}
+}
+
+// Forget drops what is known about the sinks that stored snapshot id, for a
+// snapshot that failed and will not be queued again.
+func (u *Uploader) Forget(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.delivered, id)
+}
+
+// removeUploaded deletes the uploaded file if configured to, and reports
+// whether it did.
+func (u *Uploader) removeUploaded(snapshot *uploader.Snapshot) bool {
+	if !u.deleteAfterUpload {
+		return false
+	}
+	if err := os.Remove(snapshot.Path); err != nil {
+		if !os.IsNotExist(err) {
+			u.logger.Warn("Failed to delete uploaded snapshot", "path", snapshot.Path, "error", err)
+		}
+		return false
+	}
+	return true
+}
+
+func (u *Uploader) pendingSinks(sinks []Sink, id string) []Sink {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var pending []Sink
+	for _, sink := range sinks {
+		if !u.delivered[id][sink.Name()] {
+			pending = append(pending, sink)
+		}
+	}
+	return pending
+}
+
+func (u *Uploader) markDelivered(id, sink string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.delivered[id] == nil {
+		u.delivered[id] = make(map[string]bool)
+	}
+	u.delivered[id][sink] = true
+}
+
+func (u *Uploader) publish(ctx context.Context, result UploadResult) {
+	select {
+	case u.results <- result:
+	case <-ctx.Done():
+	}
+}
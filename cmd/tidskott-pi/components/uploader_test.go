@@ -0,0 +1,176 @@
+package components
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+// blockingSink holds every upload until release is closed.
+type blockingSink struct {
+	name    string
+	started chan struct{}
+	release chan struct{}
+	stopped atomic.Bool
+}
+
+func newBlockingSink(name string) *blockingSink {
+	return &blockingSink{name: name, started: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (s *blockingSink) Name() string     { return s.name }
+func (s *blockingSink) Location() string { return s.name }
+func (s *blockingSink) Start() error     { return nil }
+
+func (s *blockingSink) Stop() error {
+	s.stopped.Store(true)
+	return nil
+}
+
+func (s *blockingSink) Upload(ctx context.Context, _ *uploader.Snapshot) error {
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestSetSinksDuringUpload(t *testing.T) {
+	old := newBlockingSink("old")
+	u, err := NewUploader(discardLogger(), []Sink{old}, DeleteWhenAll, 1, false, 0, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	snapshot := writeClip(t, t.TempDir(), "a", time.Now())
+	if err := u.QueueSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	<-old.started
+
+	replaced := make(chan error, 1)
+	go func() { replaced <- u.SetSinks([]Sink{nopSink{}}) }()
+	select {
+	case err := <-replaced:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SetSinks waited for the upload in progress")
+	}
+	if got := u.Endpoint(); got != "nowhere" {
+		t.Errorf("Endpoint() = %q, want the new sinks", got)
+	}
+	if old.stopped.Load() {
+		t.Fatal("old sink stopped while an upload was using it")
+	}
+
+	close(old.release)
+	result := <-u.Results()
+	if !result.Success {
+		t.Fatalf("upload on the old sink failed: %v", result.Error)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !old.stopped.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("old sink not stopped after its upload finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUploaderNext(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local)
+	queued := func(id string, priority Priority, age time.Duration) queuedSnapshot {
+		return queuedSnapshot{
+			snapshot: &uploader.Snapshot{ID: id, Hash: "hash-" + id},
+			priority: priority,
+			queuedAt: now.Add(-age),
+		}
+	}
+	tests := []struct {
+		name    string
+		windows []string
+		aging   time.Duration
+		queue   []queuedSnapshot
+		want    string // "" for none
+	}{
+		{
+			name:  "highest priority first",
+			queue: []queuedSnapshot{queued("routine", PriorityRoutine, time.Minute), queued("manual", PriorityManual, 0)},
+			want:  "manual",
+		},
+		{
+			name:  "oldest first within a priority",
+			queue: []queuedSnapshot{queued("new", PriorityTriggered, 0), queued("old", PriorityTriggered, time.Minute)},
+			want:  "old",
+		},
+		{
+			name:  "aged past a higher priority",
+			aging: 5 * time.Minute,
+			queue: []queuedSnapshot{queued("triggered", PriorityTriggered, 0), queued("routine", PriorityRoutine, 11*time.Minute)},
+			want:  "routine",
+		},
+		{
+			name:  "aged to a tie goes to the oldest",
+			aging: 5 * time.Minute,
+			queue: []queuedSnapshot{queued("triggered", PriorityTriggered, 0), queued("routine", PriorityRoutine, 6*time.Minute)},
+			want:  "routine",
+		},
+		{
+			name:  "not aged enough",
+			aging: 5 * time.Minute,
+			queue: []queuedSnapshot{queued("triggered", PriorityTriggered, 0), queued("routine", PriorityRoutine, 4*time.Minute)},
+			want:  "triggered",
+		},
+		{
+			name:  "no aging",
+			queue: []queuedSnapshot{queued("triggered", PriorityTriggered, 0), queued("routine", PriorityRoutine, time.Hour)},
+			want:  "triggered",
+		},
+		{
+			name:    "routine waits for its window",
+			windows: []string{"01:00-05:00"},
+			queue:   []queuedSnapshot{queued("routine", PriorityRoutine, time.Hour)},
+		},
+		{
+			name:    "triggered skips the window",
+			windows: []string{"01:00-05:00"},
+			queue:   []queuedSnapshot{queued("routine", PriorityRoutine, time.Hour), queued("triggered", PriorityTriggered, 0)},
+			want:    "triggered",
+		},
+		{
+			name:    "aging does not open the window",
+			windows: []string{"01:00-05:00"},
+			aging:   time.Minute,
+			queue:   []queuedSnapshot{queued("routine", PriorityRoutine, time.Hour)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := NewUploader(discardLogger(), []Sink{nopSink{}}, DeleteWhenAll, 1, false, 0, tt.windows, tt.aging)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u.queue = tt.queue
+
+			q, ok := u.next(now)
+			var got string
+			if ok {
+				got = q.snapshot.ID
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
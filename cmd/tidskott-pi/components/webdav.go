@@ -0,0 +1,193 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alesr/tidskott-uploader/pkg/uploader"
+)
+
+// webdavStatusError is an unexpected response from the WebDAV server.
+type webdavStatusError struct {
+	method string
+	status int
+}
+
+func (e *webdavStatusError) Error() string {
+	return fmt.Sprintf("%s returned %d %s", e.method, e.status, http.StatusText(e.status))
+}
+
+// WebDAVSink stores snapshots on a WebDAV server (Nextcloud, Apache
+// mod_dav, ...) under <url>/<device id>/<yyyy>/<mm>/<dd>/. Clips are
+// uploaded under a temporary name and moved into place once complete.
+type WebDAVSink struct {
+	logger     *slog.Logger
+	client     *http.Client
+	baseURL    *url.URL
+	username   string
+	password   string
+	maxRetries int
+
+	mu          sync.Mutex
+	collections map[string]bool // collections known to exist
+}
+
+func NewWebDAVSink(logger *slog.Logger, rawURL, username, password string, maxRetries int, timeout time.Duration) (*WebDAVSink, error) {
+	baseURL, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse webdav url: %w", err)
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid webdav url %q", rawURL)
+	}
+	return &WebDAVSink{
+		logger:      logger,
+		client:      newThrottledClient(&http.Client{Timeout: timeout}),
+		baseURL:     baseURL,
+		username:    username,
+		password:    password,
+		maxRetries:  maxRetries,
+		collections: make(map[string]bool),
+	}, nil
+}
+
+func (w *WebDAVSink) Name() string { return "webdav" }
+
+func (w *WebDAVSink) Location() string { return w.baseURL.Redacted() }
+
+func (w *WebDAVSink) Upload(ctx context.Context, snapshot *uploader.Snapshot) error {
+	key := snapshotKey(snapshot)
+	err := retry(ctx, w.logger, w.Name(), w.maxRetries, webdavRetryable, func() error {
+		if err := w.mkcolAll(ctx, path.Dir(key)); err != nil {
+			return err
+		}
+		tmp := key + ".part"
+		if err := w.put(ctx, tmp, snapshot.Path); err != nil {
+			return err
+		}
+		return w.move(ctx, tmp, key)
+	})
+	if err != nil {
+		return fmt.Errorf("could not upload %s to webdav: %w", key, err)
+	}
+	return nil
+}
+
+// mkcolAll creates dir and its parents, like os.MkdirAll.
+func (w *WebDAVSink) mkcolAll(ctx context.Context, dir string) error {
+	var current string
+	for _, part := range strings.Split(dir, "/") {
+		current = path.Join(current, part)
+
+		w.mu.Lock()
+		exists := w.collections[current]
+		w.mu.Unlock()
+		if exists {
+			continue
+		}
+
+		resp, err := w.do(ctx, "MKCOL", current+"/", nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		// 405 means the collection already exists
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return &webdavStatusError{method: "MKCOL", status: resp.StatusCode}
+		}
+
+		w.mu.Lock()
+		w.collections[current] = true
+		w.mu.Unlock()
+	}
+	return nil
+}
+
+func (w *WebDAVSink) put(ctx context.Context, key, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("could not open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat snapshot: %w", err)
+	}
+
+	resp, err := w.do(ctx, http.MethodPut, key, f, func(req *http.Request) {
+		req.ContentLength = info.Size()
+		req.Header.Set("Content-Type", contentTypeFor(localPath))
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &webdavStatusError{method: http.MethodPut, status: resp.StatusCode}
+	}
+	return nil
+}
+
+func (w *WebDAVSink) move(ctx context.Context, from, to string) error {
+	resp, err := w.do(ctx, "MOVE", from, nil, func(req *http.Request) {
+		req.Header.Set("Destination", w.url(to))
+		req.Header.Set("Overwrite", "T")
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &webdavStatusError{method: "MOVE", status: resp.StatusCode}
+	}
+	return nil
+}
+
+func (w *WebDAVSink) do(ctx context.Context, method, key string, body io.Reader, prepare func(*http.Request)) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, w.url(key), body)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+	if prepare != nil {
+		prepare(req)
+	}
+	return w.client.Do(req)
+}
+
+func (w *WebDAVSink) url(key string) string {
+	u := *w.baseURL
+	u.Path = u.Path + "/" + key
+	u.RawPath = ""
+	return u.String()
+}
+
+// webdavRetryable retries server errors, throttling and network failures.
+func webdavRetryable(err error) bool {
+	var statusErr *webdavStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status >= 500 || statusErr.status == http.StatusTooManyRequests
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return false
+	}
+	return !errors.Is(err, context.Canceled)
+}
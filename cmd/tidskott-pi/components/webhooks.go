@@ -0,0 +1,282 @@
+package components
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/alesr/tidskott-pi/internal/pkg/webhooktmpl"
+)
+
+const (
+	webhookQueueSize               = 100
+	webhookDefaultTimeout          = 10 * time.Second
+	webhookMaxBackoff              = 30 * time.Second
+	webhookDefaultFailureThreshold = 3
+)
+
+type WebhookOptions struct {
+	URL                string
+	Events             []string // empty means every event
+	Template           string   // text/template rendered with the Event; empty sends the event as JSON
+	Secret             string   // HMAC-SHA256 key for the X-Tidskott-Signature header
+	MaxRetries         int
+	Timeout            time.Duration
+	RateLimitPerMinute int // zero disables rate limiting
+	FailureThreshold   int // consecutive upload failures of a snapshot before upload_failed is sent
+}
+
+// Webhooks delivers events to HTTP endpoints, one worker per endpoint.
+type Webhooks struct {
+	logger *slog.Logger
+	client *http.Client
+	hooks  []*webhook
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	failures map[string]int // consecutive upload failures by snapshot ID
+}
+
+type webhook struct {
+	opts    WebhookOptions
+	events  map[EventType]bool
+	tmpl    *template.Template
+	limiter *tokenBucket
+	queue   chan Event
+}
+
+// sampleEvent is rendered by every template at startup, so templates
+// that fail or do not produce JSON are rejected before an event is lost.
+var sampleEvent = Event{
+	Type:       EventUploadFailed,
+	Time:       time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC),
+	DeviceID:   "device",
+	SnapshotID: "snapshot",
+	Path:       "/snapshots/snapshot.mp4",
+	Size:       1,
+	Hash:       "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	Trigger:    TriggerScheduled,
+	Error:      `upload "failed"`,
+	Details:    map[string]string{"consecutive_failures": "3"},
+}
+
+func NewWebhooks(logger *slog.Logger, hooks []WebhookOptions, events *Events) (*Webhooks, error) {
+	w := &Webhooks{
+		logger:   logger,
+		client:   &http.Client{},
+		failures: make(map[string]int),
+	}
+
+	for i, opts := range hooks {
+		hook := &webhook{
+			opts:   opts,
+			events: make(map[EventType]bool, len(opts.Events)),
+			queue:  make(chan Event, webhookQueueSize),
+		}
+		for _, name := range opts.Events {
+			hook.events[EventType(name)] = true
+		}
+		if opts.Template != "" {
+			tmpl, err := webhooktmpl.Parse(fmt.Sprintf("webhook-%d", i), opts.Template)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse template for webhook %s: %w", opts.URL, err)
+			}
+			hook.tmpl = tmpl
+			if _, err := hook.render(sampleEvent); err != nil {
+				return nil, fmt.Errorf("could not render template for webhook %s: %w", opts.URL, err)
+			}
+		}
+		if hook.opts.Timeout <= 0 {
+			hook.opts.Timeout = webhookDefaultTimeout
+		}
+		if hook.opts.FailureThreshold <= 0 {
+			hook.opts.FailureThreshold = webhookDefaultFailureThreshold
+		}
+		if opts.RateLimitPerMinute > 0 {
+			hook.limiter = newTokenBucket(float64(opts.RateLimitPerMinute)/60, float64(opts.RateLimitPerMinute))
+		}
+		w.hooks = append(w.hooks, hook)
+	}
+
+	events.Subscribe(w.enqueue)
+	return w, nil
+}
+
+func (w *Webhooks) Start(ctx context.Context) {
+	ctx, w.cancel = context.WithCancel(ctx)
+	for _, hook := range w.hooks {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case event := <-hook.queue:
+					if hook.limiter != nil {
+						if err := hook.limiter.Wait(ctx, 1); err != nil {
+							return
+						}
+					}
+					w.deliver(ctx, hook, event)
+				}
+			}
+		}()
+	}
+}
+
+// Stop stops the workers and waits for them to exit.
+func (w *Webhooks) Stop() {
+	w.cancel()
+	w.wg.Wait()
+}
+
+func (w *Webhooks) enqueue(event Event) {
+	failures := w.countFailures(event)
+	if failures > 0 {
+		details := make(map[string]string, len(event.Details)+1)
+		maps.Copy(details, event.Details)
+		details["consecutive_failures"] = strconv.Itoa(failures)
+		event.Details = details
+	}
+
+	for _, hook := range w.hooks {
+		if len(hook.events) > 0 && !hook.events[event.Type] {
+			continue
+		}
+		// a failed upload is retried, so only repeated failures are news
+		if failures > 0 && failures%hook.opts.FailureThreshold != 0 {
+			continue
+		}
+		select {
+		case hook.queue <- event:
+		default:
+			w.logger.Warn("Webhook queue full, dropping event", "url", hook.opts.URL, "type", event.Type)
+		}
+	}
+}
+
+// countFailures tracks consecutive upload failures per snapshot and returns
+// the count for an upload_failed event, or zero for any other event.
+func (w *Webhooks) countFailures(event Event) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch event.Type {
+	case EventUploadFailed:
+		w.failures[event.SnapshotID]++
+		return w.failures[event.SnapshotID]
+	case EventUploadSucceeded, EventSnapshotDeleted, EventSnapshotDropped, EventSnapshotEvicted:
+		delete(w.failures, event.SnapshotID)
+	}
+	return 0
+}
+
+func (w *Webhooks) deliver(ctx context.Context, hook *webhook, event Event) {
+	body, err := hook.render(event)
+	if err != nil {
+		w.logger.Error("Failed to render webhook body", "url", hook.opts.URL, "type", event.Type, "error", err)
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retry, err := w.send(ctx, hook, event, body)
+		if err == nil {
+			w.logger.Debug("Webhook delivered", "url", hook.opts.URL, "type", event.Type)
+			return
+		}
+		if !retry || attempt >= hook.opts.MaxRetries {
+			w.logger.Error(
+				"Webhook delivery failed",
+				"url", hook.opts.URL,
+				"type", event.Type,
+				"attempts", attempt+1,
+				"error", err,
+			)
+			return
+		}
+
+		w.logger.Warn("Webhook delivery failed, retrying", "url", hook.opts.URL, "in", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
+
+// send posts body once and reports whether a failure is worth retrying.
+func (w *Webhooks) send(ctx context.Context, hook *webhook, event Event, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, hook.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("could not create request: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tidskott-pi")
+	req.Header.Set("X-Tidskott-Event", string(event.Type))
+	req.Header.Set("X-Tidskott-Timestamp", timestamp)
+	if hook.opts.Secret != "" {
+		req.Header.Set("X-Tidskott-Signature", "sha256="+signWebhook(hook.opts.Secret, timestamp, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("could not send request: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+func (h *webhook) render(event Event) ([]byte, error) {
+	if h.tmpl == nil {
+		return json.Marshal(event)
+	}
+
+	var buf bytes.Buffer
+	if err := h.tmpl.Execute(&buf, event); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, errors.New("template did not produce valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+// signWebhook signs "<timestamp>.<body>" so receivers can reject replays.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,98 @@
+package components
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhooksRepeatedFailures(t *testing.T) {
+	var mu sync.Mutex
+	var received []Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("could not decode webhook body: %v", err)
+		}
+		mu.Lock()
+		received = append(received, event)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	events := NewEvents("device")
+	hooks, err := NewWebhooks(slog.New(slog.NewTextHandler(io.Discard, nil)), []WebhookOptions{{
+		URL:              server.URL,
+		Events:           []string{string(EventUploadFailed)},
+		FailureThreshold: 2,
+	}}, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks.Start(context.Background())
+
+	for _, event := range []Event{
+		{Type: EventUploadFailed, SnapshotID: "a"},
+		{Type: EventUploadFailed, SnapshotID: "b"},
+		{Type: EventUploadFailed, SnapshotID: "a"}, // sent: a failed twice
+		{Type: EventUploadSucceeded, SnapshotID: "b"},
+		{Type: EventUploadFailed, SnapshotID: "b"},
+		{Type: EventUploadFailed, SnapshotID: "a"},
+		{Type: EventUploadFailed, SnapshotID: "a"}, // sent: a failed four times
+	} {
+		events.Publish(event)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	hooks.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("got %d webhooks, want 2", len(received))
+	}
+	for i, want := range []string{"2", "4"} {
+		if received[i].SnapshotID != "a" || received[i].Details["consecutive_failures"] != want {
+			t.Errorf("webhook %d: got %s after %s failures, want a after %s", i, received[i].SnapshotID, received[i].Details["consecutive_failures"], want)
+		}
+	}
+}
+
+func TestWebhooksRejectInvalidJSONTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		wantErr  string
+	}{
+		{`{"text": {{json .Error}}}`, ""},
+		{`{"text": "{{.Error}}"}`, "valid JSON"}, // the error is not escaped
+		{`{"text": {{json .Missing}}}`, "render"},
+	}
+	for _, tt := range tests {
+		_, err := NewWebhooks(slog.New(slog.NewTextHandler(io.Discard, nil)), []WebhookOptions{{
+			URL:      "http://localhost",
+			Template: tt.template,
+		}}, NewEvents("device"))
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", tt.template, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: got %v, want an error containing %q", tt.template, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package components
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// uploadWindow is a daily local time range, e.g. 01:00-05:00. Ranges may
+// wrap around midnight.
+type uploadWindow struct {
+	start time.Duration // since midnight
+	end   time.Duration
+}
+
+func parseUploadWindow(s string) (uploadWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return uploadWindow{}, fmt.Errorf("invalid upload window %q, expected HH:MM-HH:MM", s)
+	}
+
+	start, err := parseClock(strings.TrimSpace(from))
+	if err != nil {
+		return uploadWindow{}, fmt.Errorf("invalid upload window %q: %w", s, err)
+	}
+	end, err := parseClock(strings.TrimSpace(to))
+	if err != nil {
+		return uploadWindow{}, fmt.Errorf("invalid upload window %q: %w", s, err)
+	}
+	if start == end {
+		return uploadWindow{}, fmt.Errorf("invalid upload window %q: empty range", s)
+	}
+	return uploadWindow{start: start, end: end}, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w uploadWindow) contains(t time.Time) bool {
+	year, month, day := t.Date()
+	offset := t.Sub(time.Date(year, month, day, 0, 0, 0, 0, t.Location()))
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+func parseUploadWindows(windows []string) ([]uploadWindow, error) {
+	var uploadWindows []uploadWindow
+	for _, w := range windows {
+		window, err := parseUploadWindow(w)
+		if err != nil {
+			return nil, err
+		}
+		uploadWindows = append(uploadWindows, window)
+	}
+	return uploadWindows, nil
+}
+
+// inUploadWindow reports whether t falls in any window. No windows means
+// uploads are always allowed.
+func inUploadWindow(windows []uploadWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package components
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseUploadWindow(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uploadWindow
+		wantErr bool
+	}{
+		{in: "01:00-05:00", want: uploadWindow{start: time.Hour, end: 5 * time.Hour}},
+		{in: " 22:30 - 06:15 ", want: uploadWindow{start: 22*time.Hour + 30*time.Minute, end: 6*time.Hour + 15*time.Minute}},
+		{in: "00:00-23:59", want: uploadWindow{end: 23*time.Hour + 59*time.Minute}},
+		{in: "01:00", wantErr: true},
+		{in: "01:00-25:00", wantErr: true},
+		{in: "1am-5am", wantErr: true},
+		{in: "03:00-03:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseUploadWindow(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInUploadWindow(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 3, 10, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name    string
+		windows []string
+		t       time.Time
+		want    bool
+	}{
+		{name: "no windows", t: at(12, 0), want: true},
+		{name: "inside", windows: []string{"01:00-05:00"}, t: at(3, 0), want: true},
+		{name: "start is inside", windows: []string{"01:00-05:00"}, t: at(1, 0), want: true},
+		{name: "end is outside", windows: []string{"01:00-05:00"}, t: at(5, 0), want: false},
+		{name: "before", windows: []string{"01:00-05:00"}, t: at(0, 59), want: false},
+		{name: "wrapping, evening", windows: []string{"22:00-02:00"}, t: at(23, 30), want: true},
+		{name: "wrapping, morning", windows: []string{"22:00-02:00"}, t: at(1, 30), want: true},
+		{name: "wrapping, midday", windows: []string{"22:00-02:00"}, t: at(12, 0), want: false},
+		{name: "second window", windows: []string{"01:00-02:00", "12:00-13:00"}, t: at(12, 30), want: true},
+		{name: "between windows", windows: []string{"01:00-02:00", "12:00-13:00"}, t: at(6, 0), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			windows, err := parseUploadWindows(tt.windows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := inUploadWindow(windows, tt.t); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -7,7 +7,18 @@ replace github.com/alesr/tidskott-core => ../tidskott-core
 replace github.com/alesr/tidskott-uploader => ../tidskott-uploader
 
 require (
+	filippo.io/age v1.3.1
 	github.com/alesr/tidskott-core v0.0.0-00010101000000-000000000000
 	github.com/alesr/tidskott-uploader v0.0.0-00010101000000-000000000000
+	github.com/mochi-mqtt/server/v2 v2.7.9
 	github.com/pelletier/go-toml/v2 v2.2.4
 )
+
+require (
+	filippo.io/hpke v0.4.0 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/rs/xid v1.4.0 // indirect
+	golang.org/x/crypto v0.45.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -1,21 +1,49 @@
 package config
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
+	"filippo.io/age"
+	"github.com/alesr/tidskott-pi/internal/pkg/webhooktmpl"
 	"github.com/pelletier/go-toml/v2"
 )
 
 type (
 	Config struct {
-		Device DeviceConfig `toml:"device"`
-		Camera CameraConfig `toml:"camera"`
-		Buffer BufferConfig `toml:"buffer"`
-		Upload UploadConfig `toml:"upload"`
-		Auth   AuthConfig   `toml:"auth"`
+		Device     DeviceConfig     `toml:"device"`
+		Log        LogConfig        `toml:"log"`
+		Camera     CameraConfig     `toml:"camera"`
+		Buffer     BufferConfig     `toml:"buffer"`
+		Upload     UploadConfig     `toml:"upload"`
+		S3         S3Config         `toml:"s3"`
+		WebDAV     WebDAVConfig     `toml:"webdav"`
+		SFTP       SFTPConfig       `toml:"sftp"`
+		Archive    ArchiveConfig    `toml:"archive"`
+		Tus        TusConfig        `toml:"tus"`
+		Spool      SpoolConfig      `toml:"spool"`
+		Retention  RetentionConfig  `toml:"retention"`
+		Audit      AuditConfig      `toml:"audit"`
+		Auth       AuthConfig       `toml:"auth"`
+		TLS        TLSConfig        `toml:"tls"`
+		Encryption EncryptionConfig `toml:"encryption"`
+		Manifest   ManifestConfig   `toml:"manifest"`
+		MQTT       MQTTConfig       `toml:"mqtt"`
+		Tamper     TamperConfig     `toml:"tamper"`
+		Inference  InferenceConfig  `toml:"inference"`
+		Audio      AudioConfig      `toml:"audio"`
+		Webhooks   []WebhookConfig  `toml:"webhooks"`
+
+		// Warnings found while loading, to be logged once logging is set up.
+		Warnings []string `toml:"-"`
 	}
 
 	DeviceConfig struct {
@@ -23,6 +51,10 @@ type (
 		Name string `toml:"name"`
 	}
 
+	LogConfig struct {
+		Level string `toml:"level"`
+	}
+
 	CameraConfig struct {
 		Width   int    `toml:"width"`
 		Height  int    `toml:"height"`
@@ -38,17 +70,160 @@ type (
 	}
 
 	UploadConfig struct {
-		Endpoint          string `toml:"endpoint"`
-		MaxRetries        int    `toml:"max_retries"`
-		MaxConcurrent     int    `toml:"max_concurrent"`
-		DeleteAfterUpload bool   `toml:"delete_after_upload"`
+		Sinks                []string `toml:"sinks"`
+		DeletePolicy         string   `toml:"delete_policy"`
+		Endpoint             string   `toml:"endpoint"`
+		MaxRetries           int      `toml:"max_retries"`
+		MaxConcurrent        int      `toml:"max_concurrent"`
+		DeleteAfterUpload    bool     `toml:"delete_after_upload"`
+		MaxBytesPerSecond    int64    `toml:"max_bytes_per_second"`
+		Windows              []string `toml:"windows"`
+		PriorityAgingSeconds int      `toml:"priority_aging_seconds"`
+		ExistsEndpoint       string   `toml:"exists_endpoint"`
+	}
+
+	S3Config struct {
+		Endpoint        string `toml:"endpoint"`
+		Region          string `toml:"region"`
+		Bucket          string `toml:"bucket"`
+		Prefix          string `toml:"prefix"`
+		AccessKeyID     string `toml:"access_key_id"`
+		SecretAccessKey string `toml:"secret_access_key"`
+		SessionToken    string `toml:"session_token"`
+		PathStyle       bool   `toml:"path_style"`
+		PartSizeMB      int64  `toml:"part_size_mb"`
+	}
+
+	WebDAVConfig struct {
+		URL            string `toml:"url"`
+		Username       string `toml:"username"`
+		Password       string `toml:"password"`
+		TimeoutSeconds int    `toml:"timeout_seconds"`
+	}
+
+	SFTPConfig struct {
+		Host         string `toml:"host"`
+		Port         int    `toml:"port"`
+		User         string `toml:"user"`
+		IdentityFile string `toml:"identity_file"`
+		Dir          string `toml:"dir"`
+	}
+
+	ArchiveConfig struct {
+		Dir                  string `toml:"dir"`
+		MaxMB                int64  `toml:"max_mb"`
+		MaxAgeDays           int    `toml:"max_age_days"`
+		MinFreeMB            int64  `toml:"min_free_mb"`
+		CheckIntervalSeconds int    `toml:"check_interval_seconds"`
+	}
+
+	TusConfig struct {
+		Endpoint    string `toml:"endpoint"`
+		ChunkSizeMB int64  `toml:"chunk_size_mb"`
+		StateDir    string `toml:"state_dir"`
+	}
+
+	SpoolConfig struct {
+		Enabled              bool   `toml:"enabled"`
+		Dir                  string `toml:"dir"`
+		RetryIntervalSeconds int    `toml:"retry_interval_seconds"`
+	}
+
+	RetentionConfig struct {
+		Enabled              bool   `toml:"enabled"`
+		Dir                  string `toml:"dir"`
+		MaxMB                int64  `toml:"max_mb"`
+		MaxAgeHours          int    `toml:"max_age_hours"`
+		MinFreeMB            int64  `toml:"min_free_mb"`
+		CheckIntervalSeconds int    `toml:"check_interval_seconds"`
+	}
+
+	AuditConfig struct {
+		Enabled   bool   `toml:"enabled"`
+		File      string `toml:"file"`
+		MaxSizeMB int64  `toml:"max_size_mb"`
+		MaxFiles  int    `toml:"max_files"`
 	}
 
 	AuthConfig struct {
-		Enabled      bool   `toml:"enabled"`
-		Endpoint     string `toml:"endpoint"`
-		ClientID     string `toml:"client_id"`
-		ClientSecret string `toml:"client_secret"`
+		Enabled      bool     `toml:"enabled"`
+		Endpoint     string   `toml:"endpoint"`
+		ClientID     string   `toml:"client_id"`
+		ClientSecret string   `toml:"client_secret"`
+		Scopes       []string `toml:"scopes"`
+		Audience     string   `toml:"audience"`
+	}
+
+	TLSConfig struct {
+		CertFile  string   `toml:"cert_file"`
+		KeyFile   string   `toml:"key_file"`
+		CAFile    string   `toml:"ca_file"`
+		PinSHA256 []string `toml:"pin_sha256"`
+	}
+
+	EncryptionConfig struct {
+		Enabled   bool   `toml:"enabled"`
+		Recipient string `toml:"recipient"`
+	}
+
+	ManifestConfig struct {
+		Enabled   bool   `toml:"enabled"`
+		KeyFile   string `toml:"key_file"`
+		ChainFile string `toml:"chain_file"`
+	}
+
+	MQTTConfig struct {
+		Enabled          bool   `toml:"enabled"`
+		Broker           string `toml:"broker"`
+		ClientID         string `toml:"client_id"`
+		Username         string `toml:"username"`
+		Password         string `toml:"password"`
+		TopicPrefix      string `toml:"topic_prefix"`
+		QoS              int    `toml:"qos"`
+		KeepAliveSeconds int    `toml:"keepalive_seconds"`
+	}
+
+	TamperConfig struct {
+		Enabled         bool    `toml:"enabled"`
+		MinBrightness   float64 `toml:"min_brightness"`
+		MinContrast     float64 `toml:"min_contrast"`
+		DefocusRatio    float64 `toml:"defocus_ratio"`
+		MinSimilarity   float64 `toml:"min_similarity"`
+		TriggerSnapshot bool    `toml:"trigger_snapshot"`
+	}
+
+	InferenceConfig struct {
+		Enabled        bool     `toml:"enabled"`
+		Mode           string   `toml:"mode"`
+		Endpoint       string   `toml:"endpoint"`
+		Command        []string `toml:"command"`
+		Input          string   `toml:"input"`
+		TimeoutSeconds int      `toml:"timeout_seconds"`
+		MinConfidence  float64  `toml:"min_confidence"`
+		Labels         []string `toml:"labels"`
+		DropUnmatched  bool     `toml:"drop_unmatched"`
+	}
+
+	AudioConfig struct {
+		Enabled         bool    `toml:"enabled"`
+		Device          string  `toml:"device"`
+		SampleRate      int     `toml:"sample_rate"`
+		WindowMillis    int     `toml:"window_ms"`
+		Metric          string  `toml:"metric"`
+		ThresholdDBFS   float64 `toml:"threshold_dbfs"`
+		HysteresisDB    float64 `toml:"hysteresis_db"`
+		CooldownSeconds int     `toml:"cooldown_seconds"`
+	}
+
+	WebhookConfig struct {
+		URL                string   `toml:"url"`
+		Events             []string `toml:"events"`
+		Template           string   `toml:"template"`
+		Secret             string   `toml:"secret"`
+		MaxRetries         int      `toml:"max_retries"`
+		TimeoutSeconds     int      `toml:"timeout_seconds"`
+		RateLimitPerMinute int      `toml:"rate_limit_per_minute"`
+		FailureThreshold   int      `toml:"failure_threshold"`
 	}
 )
 
@@ -58,6 +233,9 @@ func DefaultConfig() *Config {
 			ID:   "tidskott-pi-device",
 			Name: "tidskott Pi Camera",
 		},
+		Log: LogConfig{
+			Level: "info",
+		},
 		Camera: CameraConfig{
 			Width:   1920,
 			Height:  1080,
@@ -71,10 +249,49 @@ func DefaultConfig() *Config {
 			SnapshotInterval: 5,
 		},
 		Upload: UploadConfig{
-			Endpoint:          "http://localhost:8080/upload",
-			MaxRetries:        3,
-			MaxConcurrent:     2,
-			DeleteAfterUpload: true,
+			Sinks:                []string{"hub"},
+			DeletePolicy:         "all",
+			Endpoint:             "http://localhost:8080/upload",
+			MaxRetries:           3,
+			MaxConcurrent:        2,
+			DeleteAfterUpload:    true,
+			PriorityAgingSeconds: 300,
+		},
+		S3: S3Config{
+			Endpoint:   "https://s3.amazonaws.com",
+			Region:     "us-east-1",
+			Prefix:     "tidskott/",
+			PartSizeMB: 8,
+		},
+		WebDAV: WebDAVConfig{
+			TimeoutSeconds: 600,
+		},
+		SFTP: SFTPConfig{
+			Port: 22,
+		},
+		Archive: ArchiveConfig{
+			CheckIntervalSeconds: 3600,
+		},
+		Tus: TusConfig{
+			Endpoint:    "http://localhost:8080/files",
+			ChunkSizeMB: 4,
+			StateDir:    "tus",
+		},
+		Spool: SpoolConfig{
+			Enabled:              false,
+			Dir:                  "spool",
+			RetryIntervalSeconds: 60,
+		},
+		Retention: RetentionConfig{
+			Enabled:              false,
+			MinFreeMB:            500,
+			CheckIntervalSeconds: 60,
+		},
+		Audit: AuditConfig{
+			Enabled:   false,
+			File:      "audit/audit.jsonl",
+			MaxSizeMB: 10,
+			MaxFiles:  5,
 		},
 		Auth: AuthConfig{
 			Enabled:      false,
@@ -82,12 +299,73 @@ func DefaultConfig() *Config {
 			ClientID:     "tidskott-client",
 			ClientSecret: "tidskott-secret",
 		},
+		Manifest: ManifestConfig{
+			Enabled:   false,
+			KeyFile:   "manifest.key",
+			ChainFile: "manifest-chain.json",
+		},
+		MQTT: MQTTConfig{
+			Enabled:          false,
+			Broker:           "tcp://localhost:1883",
+			TopicPrefix:      "tidskott",
+			QoS:              1,
+			KeepAliveSeconds: 30,
+		},
+		Tamper: TamperConfig{
+			Enabled:         false,
+			MinBrightness:   20,
+			MinContrast:     8,
+			DefocusRatio:    0.4,
+			MinSimilarity:   0.5,
+			TriggerSnapshot: true,
+		},
+		Inference: InferenceConfig{
+			Enabled:        false,
+			Mode:           "http",
+			Endpoint:       "http://localhost:9000/detect",
+			Input:          "keyframe",
+			TimeoutSeconds: 10,
+			MinConfidence:  0.5,
+		},
+		Audio: AudioConfig{
+			Enabled:         false,
+			Device:          "default",
+			SampleRate:      16000,
+			WindowMillis:    100,
+			Metric:          "rms",
+			ThresholdDBFS:   -20,
+			HysteresisDB:    6,
+			CooldownSeconds: 30,
+		},
 	}
 }
 
 func DefaultConfigPath() string { return "config.toml" }
 
-func LoadConfig(path string) (*Config, error) {
+// LoadConfig loads the config file at path over the defaults, then applies
+// environment overrides and flags, which take precedence in that order:
+// flags > environment > file > defaults.
+func LoadConfig(path string, flags Overrides) (*Config, error) {
+	config, err := load(path, flags)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Check loads the config file at path like LoadConfig and returns its
+// warnings, along with the error that LoadConfig would return, if any.
+func Check(path string, flags Overrides) ([]string, error) {
+	config, err := load(path, flags)
+	if config == nil {
+		return nil, err
+	}
+	return config.Warnings, err
+}
+
+// load is LoadConfig, except that it also returns the config when it is
+// invalid.
+func load(path string, flags Overrides) (*Config, error) {
 	contents, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
@@ -97,74 +375,441 @@ func LoadConfig(path string) (*Config, error) {
 	if err := toml.Unmarshal(contents, config); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
+	env := EnvOverrides()
+	if err := config.apply(env, envName); err != nil {
+		return nil, err
+	}
+	if err := config.apply(flags, flagName); err != nil {
+		return nil, err
+	}
+
+	var raw Config
+	if unknown, err := decodeStrict(contents, &raw); err == nil {
+		config.Warnings = append(secretWarnings(path, &raw), unknown...)
+	}
+	if err := config.resolveSecrets(); err != nil {
+		return nil, err
+	}
 
 	if err := config.Validate(); err != nil {
-		return nil, fmt.Errorf("invalid configuration: %w", err)
+		var errs ValidationErrors
+		if errors.As(err, &errs) {
+			errs.locate(contents, env, flags)
+		}
+		return config, fmt.Errorf("invalid configuration: %w", err)
 	}
 	return config, nil
 }
 
-// TODO(alesr): enum errors and split
+// decodeStrict decodes contents into v, returning a warning for each key
+// that is not a config field, e.g. a misspelled one, which would otherwise
+// be ignored.
+func decodeStrict(contents []byte, v any) ([]string, error) {
+	dec := toml.NewDecoder(bytes.NewReader(contents))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+
+	var strict *toml.StrictMissingError
+	if !errors.As(err, &strict) {
+		return nil, err
+	}
+	warnings := make([]string, 0, len(strict.Errors))
+	for _, e := range strict.Errors {
+		line, _ := e.Position()
+		warnings = append(warnings, fmt.Sprintf("line %d: unknown config key %s", line, strings.Join(e.Key(), ".")))
+	}
+	return warnings, nil
+}
+
+// Validate checks the config and returns all the problems found as
+// ValidationErrors.
 func (c *Config) Validate() error {
+	var errs ValidationErrors
+
 	if strings.TrimSpace(c.Device.ID) == "" {
-		return errors.New("device.id cannot be empty")
+		errs.add("device.id", "cannot be empty")
 	}
 	if strings.TrimSpace(c.Device.Name) == "" {
-		return errors.New("device.name cannot be empty")
+		errs.add("device.name", "cannot be empty")
+	}
+
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		errs.add("log.level", "must be debug, info, warn or error")
 	}
 
 	if c.Camera.Width <= 0 {
-		return errors.New("camera.width must be positive")
+		errs.add("camera.width", "must be positive")
 	}
 	if c.Camera.Height <= 0 {
-		return errors.New("camera.height must be positive")
+		errs.add("camera.height", "must be positive")
 	}
 	if c.Camera.FPS <= 0 || c.Camera.FPS > 120 {
-		return errors.New("camera.fps must be between 1 and 120")
+		errs.add("camera.fps", "must be between 1 and 120")
 	}
 	if c.Camera.Bitrate < 0 {
-		return errors.New("camera.bitrate cannot be negative")
+		errs.add("camera.bitrate", "cannot be negative")
 	}
 	if strings.TrimSpace(c.Camera.Codec) == "" {
-		return errors.New("camera.codec cannot be empty")
+		errs.add("camera.codec", "cannot be empty")
 	}
 
 	if c.Buffer.WindowSeconds < 5 || c.Buffer.WindowSeconds > 60 {
-		return errors.New("buffer.window_seconds must be between 5 and 60")
+		errs.add("buffer.window_seconds", "must be between 5 and 60")
 	}
-	if c.Buffer.SnapshotDuration <= 0 {
-		return errors.New("buffer.snapshot_duration must be positive")
+	if c.Buffer.SnapshotDuration < 1 {
+		errs.add("buffer.snapshot_duration", "must be at least 1")
+	} else if c.Buffer.SnapshotDuration > c.Buffer.WindowSeconds {
+		errs.add("buffer.snapshot_duration", "cannot exceed buffer.window_seconds (%d)", c.Buffer.WindowSeconds)
 	}
-	if c.Buffer.SnapshotDuration > c.Buffer.WindowSeconds {
-		return errors.New("buffer.snapshot_duration cannot exceed buffer.window_seconds")
+	if c.Buffer.SnapshotInterval < 1 {
+		errs.add("buffer.snapshot_interval", "must be at least 1")
 	}
-	if c.Buffer.SnapshotInterval <= 0 {
-		return errors.New("buffer.snapshot_interval must be positive")
+
+	if len(c.Upload.Sinks) == 0 {
+		errs.add("upload.sinks", "cannot be empty")
 	}
+	seen := make(map[string]bool)
+	for _, sink := range c.Upload.Sinks {
+		if seen[sink] {
+			errs.add("upload.sinks", "lists %q more than once", sink)
+			continue
+		}
+		seen[sink] = true
 
-	if strings.TrimSpace(c.Upload.Endpoint) == "" {
-		return errors.New("upload.endpoint cannot be empty")
+		switch sink {
+		case "hub":
+			// upload.endpoint is checked below, along with its other users
+		case "s3":
+			if strings.TrimSpace(c.S3.Bucket) == "" {
+				errs.add("s3.bucket", "cannot be empty when the s3 sink is used")
+			}
+			if !isHTTP(c.S3.Endpoint) {
+				errs.add("s3.endpoint", "must start with http:// or https://")
+			}
+			if strings.TrimSpace(c.S3.Region) == "" {
+				errs.add("s3.region", "cannot be empty")
+			}
+			if c.S3.PartSizeMB < 5 {
+				errs.add("s3.part_size_mb", "must be at least 5")
+			}
+		case "webdav":
+			if !isHTTP(c.WebDAV.URL) {
+				errs.add("webdav.url", "must start with http:// or https://")
+			}
+			if c.WebDAV.TimeoutSeconds <= 0 {
+				errs.add("webdav.timeout_seconds", "must be positive")
+			}
+		case "sftp":
+			if strings.TrimSpace(c.SFTP.Host) == "" {
+				errs.add("sftp.host", "cannot be empty when the sftp sink is used")
+			}
+			if strings.TrimSpace(c.SFTP.User) == "" {
+				errs.add("sftp.user", "cannot be empty when the sftp sink is used")
+			}
+			if c.SFTP.Port <= 0 || c.SFTP.Port > 65535 {
+				errs.add("sftp.port", "must be between 1 and 65535")
+			}
+		case "archive":
+			if strings.TrimSpace(c.Archive.Dir) == "" {
+				errs.add("archive.dir", "cannot be empty when the archive sink is used")
+			}
+			if c.Archive.MaxMB < 0 {
+				errs.add("archive.max_mb", "cannot be negative")
+			}
+			if c.Archive.MaxAgeDays < 0 {
+				errs.add("archive.max_age_days", "cannot be negative")
+			}
+			if c.Archive.MinFreeMB < 0 {
+				errs.add("archive.min_free_mb", "cannot be negative")
+			}
+			if c.Archive.CheckIntervalSeconds <= 0 {
+				errs.add("archive.check_interval_seconds", "must be positive")
+			}
+		case "tus":
+			if !isHTTP(c.Tus.Endpoint) {
+				errs.add("tus.endpoint", "must start with http:// or https://")
+			}
+			if c.Tus.ChunkSizeMB <= 0 {
+				errs.add("tus.chunk_size_mb", "must be positive")
+			}
+			if strings.TrimSpace(c.Tus.StateDir) == "" {
+				errs.add("tus.state_dir", "cannot be empty when the tus sink is used")
+			}
+		default:
+			errs.add("upload.sinks", "entry %q must be hub, tus, s3, webdav, sftp or archive", sink)
+		}
+	}
+	if c.Upload.ExistsEndpoint != "" && !strings.Contains(c.Upload.ExistsEndpoint, "{sha256}") {
+		errs.add("upload.exists_endpoint", "must contain {sha256}")
 	}
-	if !strings.HasPrefix(c.Upload.Endpoint, "http://") && !strings.HasPrefix(c.Upload.Endpoint, "https://") {
-		return errors.New("upload.endpoint must start with http:// or https://")
+	if c.usesUploadEndpoint() {
+		if strings.TrimSpace(c.Upload.Endpoint) == "" {
+			errs.add("upload.endpoint", "cannot be empty")
+		} else if !isHTTP(c.Upload.Endpoint) {
+			errs.add("upload.endpoint", "must start with http:// or https://")
+		}
+	}
+	if c.Upload.DeletePolicy != "all" && c.Upload.DeletePolicy != "any" {
+		errs.add("upload.delete_policy", "must be all or any")
 	}
 	if c.Upload.MaxRetries < 0 {
-		return errors.New("upload.max_retries cannot be negative")
+		errs.add("upload.max_retries", "cannot be negative")
 	}
 	if c.Upload.MaxConcurrent <= 0 {
-		return errors.New("upload.max_concurrent must be positive")
+		errs.add("upload.max_concurrent", "must be positive")
+	}
+	if c.Upload.MaxBytesPerSecond < 0 {
+		errs.add("upload.max_bytes_per_second", "cannot be negative")
+	}
+	if c.Upload.PriorityAgingSeconds < 0 {
+		errs.add("upload.priority_aging_seconds", "cannot be negative")
+	}
+	for _, w := range c.Upload.Windows {
+		from, to, ok := strings.Cut(w, "-")
+		if !ok || !isClock(strings.TrimSpace(from)) || !isClock(strings.TrimSpace(to)) {
+			errs.add("upload.windows", "entry %q must be in HH:MM-HH:MM format", w)
+		}
+	}
+
+	if c.Spool.Enabled {
+		if strings.TrimSpace(c.Spool.Dir) == "" {
+			errs.add("spool.dir", "cannot be empty when spool is enabled")
+		}
+		if c.Spool.RetryIntervalSeconds <= 0 {
+			errs.add("spool.retry_interval_seconds", "must be positive")
+		}
+	}
+
+	if c.Retention.Enabled && c.Retention.Dir != "" {
+		// eviction deletes files there, so keep it off the directories of others
+		dir := filepath.Clean(c.Retention.Dir)
+		switch {
+		case filepath.IsAbs(dir) && dir == filepath.Dir(dir):
+			errs.add("retention.dir", "cannot be the filesystem root")
+		case c.Spool.Enabled && dir == filepath.Clean(c.Spool.Dir):
+			errs.add("retention.dir", "cannot be spool.dir")
+		case c.Audit.Enabled && dir == filepath.Dir(filepath.Clean(c.Audit.File)):
+			errs.add("retention.dir", "cannot be the directory of audit.file")
+		case c.Archive.Dir != "" && dir == filepath.Clean(c.Archive.Dir):
+			errs.add("retention.dir", "cannot be archive.dir")
+		}
+	}
+	if c.Retention.Enabled {
+		if c.Retention.MaxMB < 0 {
+			errs.add("retention.max_mb", "cannot be negative")
+		}
+		if c.Retention.MaxAgeHours < 0 {
+			errs.add("retention.max_age_hours", "cannot be negative")
+		}
+		if c.Retention.MinFreeMB < 0 {
+			errs.add("retention.min_free_mb", "cannot be negative")
+		}
+		if c.Retention.CheckIntervalSeconds <= 0 {
+			errs.add("retention.check_interval_seconds", "must be positive")
+		}
+	}
+
+	if c.Audit.Enabled {
+		if strings.TrimSpace(c.Audit.File) == "" {
+			errs.add("audit.file", "cannot be empty when the audit log is enabled")
+		}
+		if c.Audit.MaxSizeMB <= 0 {
+			errs.add("audit.max_size_mb", "must be positive")
+		}
+		if c.Audit.MaxFiles < 1 {
+			errs.add("audit.max_files", "must be at least 1")
+		}
 	}
 
 	if c.Auth.Enabled {
 		if strings.TrimSpace(c.Auth.Endpoint) == "" {
-			return errors.New("auth.endpoint cannot be empty when auth is enabled")
+			errs.add("auth.endpoint", "cannot be empty when auth is enabled")
 		}
 		if strings.TrimSpace(c.Auth.ClientID) == "" {
-			return errors.New("auth.client_id cannot be empty when auth is enabled")
+			errs.add("auth.client_id", "cannot be empty when auth is enabled")
 		}
 		if strings.TrimSpace(c.Auth.ClientSecret) == "" {
-			return errors.New("auth.client_secret cannot be empty when auth is enabled")
+			errs.add("auth.client_secret", "cannot be empty when auth is enabled")
+		}
+	}
+
+	if c.TLS.CertFile != "" && c.TLS.KeyFile == "" {
+		errs.add("tls.key_file", "must be set together with tls.cert_file")
+	}
+	if c.TLS.KeyFile != "" && c.TLS.CertFile == "" {
+		errs.add("tls.cert_file", "must be set together with tls.key_file")
+	}
+	for _, pin := range c.TLS.PinSHA256 {
+		if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+			errs.add("tls.pin_sha256", "entry %q must be a base64 SHA-256 hash", pin)
+		}
+	}
+	if c.TLS.Enabled() {
+		if c.usesUploadEndpoint() && !strings.HasPrefix(c.Upload.Endpoint, "https://") {
+			errs.add("upload.endpoint", "must start with https:// when tls is configured")
+		}
+		if slices.Contains(c.Upload.Sinks, "tus") && !strings.HasPrefix(c.Tus.Endpoint, "https://") {
+			errs.add("tus.endpoint", "must start with https:// when tls is configured")
+		}
+	}
+
+	if c.Encryption.Enabled {
+		if _, err := age.ParseX25519Recipient(c.Encryption.Recipient); err != nil {
+			errs.add("encryption.recipient", "must be an age X25519 recipient (age1...)")
+		}
+	}
+
+	if c.Manifest.Enabled {
+		if strings.TrimSpace(c.Manifest.KeyFile) == "" {
+			errs.add("manifest.key_file", "cannot be empty when manifests are enabled")
+		}
+		if strings.TrimSpace(c.Manifest.ChainFile) == "" {
+			errs.add("manifest.chain_file", "cannot be empty when manifests are enabled")
+		}
+	}
+
+	if c.MQTT.Enabled {
+		if !strings.HasPrefix(c.MQTT.Broker, "tcp://") && !strings.HasPrefix(c.MQTT.Broker, "ssl://") &&
+			!strings.HasPrefix(c.MQTT.Broker, "tls://") {
+			errs.add("mqtt.broker", "must start with tcp://, ssl:// or tls://")
+		}
+		if strings.TrimSpace(c.MQTT.TopicPrefix) == "" {
+			errs.add("mqtt.topic_prefix", "cannot be empty when mqtt is enabled")
+		} else if strings.ContainsAny(c.MQTT.TopicPrefix, "+#") {
+			errs.add("mqtt.topic_prefix", "cannot contain wildcards")
+		}
+		if c.MQTT.QoS < 0 || c.MQTT.QoS > 1 {
+			errs.add("mqtt.qos", "must be 0 or 1")
+		}
+		if c.MQTT.KeepAliveSeconds <= 0 {
+			errs.add("mqtt.keepalive_seconds", "must be positive")
+		}
+	}
+
+	if c.Tamper.Enabled {
+		if c.Tamper.MinBrightness < 0 || c.Tamper.MinBrightness > 255 {
+			errs.add("tamper.min_brightness", "must be between 0 and 255")
+		}
+		if c.Tamper.MinContrast < 0 {
+			errs.add("tamper.min_contrast", "cannot be negative")
+		}
+		if c.Tamper.DefocusRatio < 0 || c.Tamper.DefocusRatio > 1 {
+			errs.add("tamper.defocus_ratio", "must be between 0 and 1")
+		}
+		if c.Tamper.MinSimilarity < -1 || c.Tamper.MinSimilarity > 1 {
+			errs.add("tamper.min_similarity", "must be between -1 and 1")
+		}
+	}
+
+	if c.Inference.Enabled {
+		switch c.Inference.Mode {
+		case "http":
+			if !isHTTP(c.Inference.Endpoint) {
+				errs.add("inference.endpoint", "must start with http:// or https://")
+			}
+		case "exec":
+			if len(c.Inference.Command) == 0 {
+				errs.add("inference.command", "cannot be empty in exec mode")
+			}
+		default:
+			errs.add("inference.mode", "must be http or exec")
+		}
+		if c.Inference.Input != "keyframe" && c.Inference.Input != "clip" {
+			errs.add("inference.input", "must be keyframe or clip")
+		}
+		if c.Inference.TimeoutSeconds <= 0 {
+			errs.add("inference.timeout_seconds", "must be positive")
+		}
+		if c.Inference.MinConfidence < 0 || c.Inference.MinConfidence > 1 {
+			errs.add("inference.min_confidence", "must be between 0 and 1")
+		}
+		if c.Inference.DropUnmatched && len(c.Inference.Labels) == 0 {
+			errs.add("inference.labels", "cannot be empty when inference.drop_unmatched is set")
+		}
+	}
+
+	if c.Audio.Enabled {
+		if strings.TrimSpace(c.Audio.Device) == "" {
+			errs.add("audio.device", "cannot be empty when audio is enabled")
+		}
+		if c.Audio.SampleRate < 8000 || c.Audio.SampleRate > 192000 {
+			errs.add("audio.sample_rate", "must be between 8000 and 192000")
+		}
+		if c.Audio.WindowMillis < 10 || c.Audio.WindowMillis > 1000 {
+			errs.add("audio.window_ms", "must be between 10 and 1000")
+		}
+		if c.Audio.Metric != "rms" && c.Audio.Metric != "peak" {
+			errs.add("audio.metric", "must be rms or peak")
+		}
+		if c.Audio.ThresholdDBFS > 0 || c.Audio.ThresholdDBFS < -96 {
+			errs.add("audio.threshold_dbfs", "must be between -96 and 0")
+		}
+		if c.Audio.HysteresisDB < 0 {
+			errs.add("audio.hysteresis_db", "cannot be negative")
+		}
+		if c.Audio.CooldownSeconds < 0 {
+			errs.add("audio.cooldown_seconds", "cannot be negative")
+		}
+	}
+
+	for i, hook := range c.Webhooks {
+		path := fmt.Sprintf("webhooks[%d]", i)
+		if !isHTTP(hook.URL) {
+			errs.add(path+".url", "must start with http:// or https://")
+		}
+		if hook.MaxRetries < 0 {
+			errs.add(path+".max_retries", "cannot be negative")
+		}
+		if hook.TimeoutSeconds < 0 {
+			errs.add(path+".timeout_seconds", "cannot be negative")
+		}
+		if hook.RateLimitPerMinute < 0 {
+			errs.add(path+".rate_limit_per_minute", "cannot be negative")
+		}
+		if hook.FailureThreshold < 0 {
+			errs.add(path+".failure_threshold", "cannot be negative")
+		}
+		for _, event := range hook.Events {
+			if !slices.Contains(webhookEvents, event) {
+				errs.add(path+".events", "entry %q is not an event type", event)
+			}
+		}
+		if hook.Template != "" {
+			if _, err := webhooktmpl.Parse("webhook", hook.Template); err != nil {
+				errs.add(path+".template", "is not a valid template: %v", err)
+			}
 		}
 	}
-	return nil
+	return errs.err()
+}
+
+// Enabled reports whether any hub TLS option is set.
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.CAFile != "" || len(t.PinSHA256) > 0
+}
+
+// webhookEvents are the event types webhooks can subscribe to.
+var webhookEvents = []string{
+	"snapshot_created", "snapshot_hashed", "snapshot_queued", "snapshot_deleted", "snapshot_dropped",
+	"snapshot_evicted", "upload_succeeded", "upload_failed", "server_unreachable", "tamper_detected",
+	"tamper_cleared", "audio_triggered",
+}
+
+// usesUploadEndpoint reports whether anything talks to the hub at
+// upload.endpoint: the hub sink uploads there, and auth and
+// upload.exists_endpoint are resolved against it.
+func (c *Config) usesUploadEndpoint() bool {
+	return slices.Contains(c.Upload.Sinks, "hub") || c.Upload.ExistsEndpoint != "" ||
+		(c.Auth.Enabled && slices.Contains(c.Upload.Sinks, "tus"))
+}
+
+func isHTTP(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+func isClock(s string) bool {
+	_, err := time.Parse("15:04", s)
+	return err == nil
 }
@@ -0,0 +1,259 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  string
+		flag string
+		want int
+	}{
+		{name: "default", want: 3},
+		{name: "file", file: "5", want: 5},
+		{name: "env over file", file: "5", env: "6", want: 6},
+		{name: "flag over env", file: "5", env: "6", flag: "7", want: 7},
+		{name: "flag over file", file: "5", flag: "7", want: 7},
+		{name: "env over default", env: "6", want: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contents := "[upload]\n"
+			if tt.file != "" {
+				contents += "max_retries = " + tt.file + "\n"
+			}
+			if tt.env != "" {
+				t.Setenv("TIDSKOTT_UPLOAD_MAX_RETRIES", tt.env)
+			}
+			flags := Overrides{}
+			if tt.flag != "" {
+				flags["upload.max_retries"] = tt.flag
+			}
+
+			c, err := LoadConfig(writeConfig(t, contents), flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Upload.MaxRetries != tt.want {
+				t.Errorf("got max_retries %d, want %d", c.Upload.MaxRetries, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		flags   Overrides
+		check   func(*Config) bool
+		wantErr string // "" for none
+	}{
+		{
+			name:  "comma separated list",
+			flags: Overrides{"upload.sinks": "hub, archive", "archive.dir": "/srv/clips"},
+			check: func(c *Config) bool { return strings.Join(c.Upload.Sinks, ",") == "hub,archive" },
+		},
+		{
+			name:  "TOML array",
+			env:   map[string]string{"TIDSKOTT_UPLOAD_WINDOWS": `["01:00-05:00", "22:00-23:00"]`},
+			check: func(c *Config) bool { return len(c.Upload.Windows) == 2 },
+		},
+		{
+			name:  "bool",
+			flags: Overrides{"s3.path_style": "true"},
+			check: func(c *Config) bool { return c.S3.PathStyle },
+		},
+		{
+			name:    "unknown flag",
+			flags:   Overrides{"upload.max_retry": "5"},
+			wantErr: "failed to apply --upload.max_retry: unknown config field",
+		},
+		{
+			name:    "integer",
+			flags:   Overrides{"upload.max_retries": "many"},
+			wantErr: "failed to apply --upload.max_retries: expected an integer",
+		},
+		{
+			name:    "env bool",
+			env:     map[string]string{"TIDSKOTT_S3_PATH_STYLE": "yes please"},
+			wantErr: "failed to apply TIDSKOTT_S3_PATH_STYLE: expected true or false",
+		},
+		{
+			name:    "number",
+			flags:   Overrides{"tamper.defocus_ratio": "half"},
+			wantErr: "failed to apply --tamper.defocus_ratio: expected a number",
+		},
+		{
+			name:    "array of tables",
+			flags:   Overrides{"webhooks": "[]"},
+			wantErr: "failed to apply --webhooks: unknown config field",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			c, err := LoadConfig(writeConfig(t, ""), tt.flags)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(c) {
+				t.Errorf("override not applied: %+v", c.Upload)
+			}
+		})
+	}
+}
+
+func TestLoadConfigUnknownKeys(t *testing.T) {
+	path := writeConfig(t, "[upload]\nmax_retries = 5\nmax_retires = 6\n\n[uplod]\nendpoint = \"x\"\n")
+
+	c, err := LoadConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Upload.MaxRetries != 5 {
+		t.Errorf("got max_retries %d, want 5", c.Upload.MaxRetries)
+	}
+	want := []string{"line 3: unknown config key upload.max_retires", "line 5: unknown config key uplod"}
+	if strings.Join(c.Warnings, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got warnings %q, want %q", c.Warnings, want)
+	}
+}
+
+func TestLoadConfigTypeError(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, "[upload]\nmax_retries = \"three\"\n"), nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "failed to parse config file: ") {
+		t.Fatalf("got %v, want a parse error", err)
+	}
+}
+
+func TestLoadConfigValidationErrors(t *testing.T) {
+	t.Setenv("TIDSKOTT_BUFFER_SNAPSHOT_INTERVAL", "0")
+	path := writeConfig(t, `[buffer]
+window_seconds = 90
+
+[upload]
+max_retries = -1
+
+[[webhooks]]
+url = "ftp://example.com"
+`)
+
+	_, err := LoadConfig(path, Overrides{"camera.fps": "0"})
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("got %v, want validation errors", err)
+	}
+
+	want := map[string]string{
+		"camera.fps":               "camera.fps must be between 1 and 120 (set by --camera.fps)",
+		"buffer.window_seconds":    "line 2: buffer.window_seconds must be between 5 and 60",
+		"buffer.snapshot_interval": "buffer.snapshot_interval must be at least 1 (set by TIDSKOTT_BUFFER_SNAPSHOT_INTERVAL)",
+		"upload.max_retries":       "line 5: upload.max_retries cannot be negative",
+		"webhooks[0].url":          "line 8: webhooks[0].url must start with http:// or https://",
+	}
+	got := make(map[string]string)
+	for _, e := range errs {
+		got[e.Path] = e.Error()
+	}
+	for path, msg := range want {
+		if got[path] != msg {
+			t.Errorf("got %q for %s, want %q", got[path], path, msg)
+		}
+	}
+	if len(errs) != len(want) {
+		t.Errorf("got %d errors, want %d: %v", len(errs), len(want), err)
+	}
+}
+
+func TestValidateUploadEndpoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(*Config)
+		wantErr string // "" for none
+	}{
+		{
+			name:    "hub sink",
+			setup:   func(c *Config) { c.Upload.Endpoint = "" },
+			wantErr: "upload.endpoint cannot be empty",
+		},
+		{
+			name: "unused",
+			setup: func(c *Config) {
+				c.Upload.Sinks = []string{"archive"}
+				c.Archive.Dir = "/srv/clips"
+				c.Upload.Endpoint = ""
+			},
+		},
+		{
+			name: "exists check",
+			setup: func(c *Config) {
+				c.Upload.Sinks = []string{"archive"}
+				c.Archive.Dir = "/srv/clips"
+				c.Upload.ExistsEndpoint = "/snapshots/{sha256}"
+				c.Upload.Endpoint = "hub.example.com"
+			},
+			wantErr: "upload.endpoint must start with http:// or https://",
+		},
+		{
+			name: "tus without auth",
+			setup: func(c *Config) {
+				c.Upload.Sinks = []string{"tus"}
+				c.Upload.Endpoint = ""
+			},
+		},
+		{
+			name: "tus with auth",
+			setup: func(c *Config) {
+				c.Upload.Sinks = []string{"tus"}
+				c.Upload.Endpoint = ""
+				c.Auth.Enabled = true
+				c.Auth.ClientID = "id"
+				c.Auth.ClientSecret = "secret"
+			},
+			wantErr: "upload.endpoint cannot be empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.setup(c)
+			err := c.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// EnvPrefix starts the environment variable of every config field: the
+// field path upper-cased with dots replaced by underscores, e.g.
+// TIDSKOTT_UPLOAD_ENDPOINT for upload.endpoint.
+const EnvPrefix = "TIDSKOTT_"
+
+// Overrides are config values by field path, e.g. "upload.endpoint", in
+// their string form: lists are comma separated or TOML arrays.
+type Overrides map[string]string
+
+// Field is a config field that can be overridden.
+type Field struct {
+	Path string // e.g. upload.endpoint
+	Env  string // e.g. TIDSKOTT_UPLOAD_ENDPOINT
+	Kind reflect.Kind
+}
+
+// Fields lists the fields of every config section, sorted by path. Arrays
+// of tables, i.e. webhooks, can only be set in the config file.
+func Fields() []Field {
+	var fields []Field
+	walkFields(DefaultConfig(), func(path string, value reflect.Value) {
+		fields = append(fields, Field{Path: path, Env: envName(path), Kind: value.Kind()})
+	})
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Path < fields[j].Path })
+	return fields
+}
+
+// EnvOverrides returns the overrides set in the environment.
+func EnvOverrides() Overrides {
+	overrides := make(Overrides)
+	for _, field := range Fields() {
+		if value, ok := os.LookupEnv(field.Env); ok {
+			overrides[field.Path] = value
+		}
+	}
+	return overrides
+}
+
+func flagName(path string) string { return "--" + path }
+
+func envName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// walkFields calls fn with the path and settable value of each field of the
+// config sections.
+func walkFields(c *Config, fn func(path string, value reflect.Value)) {
+	root := reflect.ValueOf(c).Elem()
+	for i := range root.NumField() {
+		section, name := root.Field(i), tomlName(root.Type().Field(i))
+		if name == "" || section.Kind() != reflect.Struct {
+			continue
+		}
+		for j := range section.NumField() {
+			key := tomlName(section.Type().Field(j))
+			if key == "" {
+				continue
+			}
+			fn(name+"."+key, section.Field(j))
+		}
+	}
+}
+
+func tomlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+// apply sets the fields in overrides; name returns how a field was set, for
+// errors, e.g. its environment variable.
+func (c *Config) apply(overrides Overrides, name func(path string) string) error {
+	if len(overrides) == 0 {
+		return nil
+	}
+
+	fields := make(map[string]reflect.Value)
+	walkFields(c, func(path string, value reflect.Value) { fields[path] = value })
+
+	paths := make([]string, 0, len(overrides))
+	for path := range overrides {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		field, ok := fields[path]
+		if !ok {
+			return fmt.Errorf("failed to apply %s: unknown config field", name(path))
+		}
+		if err := setField(field, overrides[path]); err != nil {
+			return fmt.Errorf("failed to apply %s: %w", name(path), err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("expected true or false")
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return errors.New("expected an integer")
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return errors.New("expected a number")
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("cannot override %s fields", field.Type())
+		}
+		list, err := parseList(value)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("cannot override %s fields", field.Type())
+	}
+	return nil
+}
+
+// parseList parses a TOML array of strings, or a comma separated list.
+func parseList(value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "[") {
+		var v struct{ List []string }
+		if err := toml.Unmarshal([]byte("List = "+value), &v); err != nil {
+			return nil, errors.New("expected a TOML array of strings")
+		}
+		return v.List, nil
+	}
+
+	list := []string{}
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list, nil
+}
+
+// Diff returns the paths of the fields that differ between a and b, sorted,
+// e.g. after a reload. Webhooks are compared as a whole.
+func Diff(a, b *Config) []string {
+	values := make(map[string]reflect.Value)
+	walkFields(a, func(path string, value reflect.Value) { values[path] = value })
+
+	var changed []string
+	walkFields(b, func(path string, value reflect.Value) {
+		old := values[path]
+		// an empty list is the same as none
+		if old.Kind() == reflect.Slice && old.Len() == 0 && value.Len() == 0 {
+			return
+		}
+		if !reflect.DeepEqual(old.Interface(), value.Interface()) {
+			changed = append(changed, path)
+		}
+	})
+	if (len(a.Webhooks) > 0 || len(b.Webhooks) > 0) && !reflect.DeepEqual(a.Webhooks, b.Webhooks) {
+		changed = append(changed, "webhooks")
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Secret values may be references instead of the secret itself:
+//
+//	file:/run/secrets/tidskott   contents of the file, without trailing newline
+//	env:TIDSKOTT_SECRET          value of the environment variable
+//	keyring:tidskott/hub         password stored in the system keyring for
+//	                             service tidskott and account hub
+const (
+	secretFilePrefix    = "file:"
+	secretEnvPrefix     = "env:"
+	secretKeyringPrefix = "keyring:"
+)
+
+// secrets returns the secret fields of c by config path.
+func (c *Config) secrets() map[string]*string {
+	secrets := map[string]*string{
+		"s3.secret_access_key": &c.S3.SecretAccessKey,
+		"s3.session_token":     &c.S3.SessionToken,
+		"webdav.password":      &c.WebDAV.Password,
+		"auth.client_secret":   &c.Auth.ClientSecret,
+		"mqtt.password":        &c.MQTT.Password,
+	}
+	for i := range c.Webhooks {
+		secrets[fmt.Sprintf("webhooks[%d].secret", i)] = &c.Webhooks[i].Secret
+	}
+	return secrets
+}
+
+// resolveSecrets replaces secret references in c with the secrets, in path
+// order, so the same config always fails on the same reference.
+func (c *Config) resolveSecrets() error {
+	secrets := c.secrets()
+	paths := make([]string, 0, len(secrets))
+	for path := range secrets {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		value := secrets[path]
+		secret, err := resolveSecret(*value)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", path, err)
+		}
+		*value = secret
+	}
+	return nil
+}
+
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, secretFilePrefix) ||
+		strings.HasPrefix(value, secretEnvPrefix) ||
+		strings.HasPrefix(value, secretKeyringPrefix)
+}
+
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretFilePrefix):
+		data, err := os.ReadFile(strings.TrimPrefix(value, secretFilePrefix))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, secretKeyringPrefix):
+		service, account, ok := strings.Cut(strings.TrimPrefix(value, secretKeyringPrefix), "/")
+		if !ok || service == "" || account == "" {
+			return "", errors.New("keyring reference must be keyring:<service>/<account>")
+		}
+		return keyringSecret(service, account)
+	default:
+		return value, nil
+	}
+}
+
+// keyringSecret looks the secret up with secret-tool (libsecret) on Linux
+// and security on macOS.
+func keyringSecret(service, account string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	default:
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", fmt.Errorf("no keyring secret for %s/%s", service, account)
+		}
+		return "", fmt.Errorf("could not query keyring: %w", err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// secretWarnings warns about secrets stored in plaintext in the config
+// file at path, or in secret files, readable by other users. raw is the
+// config as written in the file, before defaults and references apply.
+func secretWarnings(path string, raw *Config) []string {
+	var warnings []string
+	worldReadable := func(p string) bool {
+		info, err := os.Stat(p)
+		return err == nil && info.Mode().Perm()&0o004 != 0
+	}
+
+	configReadable := worldReadable(path)
+	for name, value := range raw.secrets() {
+		switch {
+		case *value == "":
+		case strings.HasPrefix(*value, secretFilePrefix):
+			if file := strings.TrimPrefix(*value, secretFilePrefix); worldReadable(file) {
+				warnings = append(warnings, fmt.Sprintf("%s is read from world-readable %s", name, file))
+			}
+		case !isSecretRef(*value) && configReadable:
+			warnings = append(warnings, fmt.Sprintf(
+				"%s is stored in plaintext in world-readable %s; use a file:, env: or keyring: reference or chmod 600 it",
+				name, path,
+			))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
@@ -0,0 +1,217 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Update sets values, keyed by "section.key", in the TOML file at path.
+// Existing keys are replaced in place and missing ones are added to their
+// section, so the rest of the file, comments included, is left as it is.
+// The file is created, readable by its owner only, if it does not exist.
+func Update(path string, values map[string]any) error {
+	contents, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	mode := fs.FileMode(0o600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	var lines []string
+	if len(contents) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		section, key, ok := strings.Cut(k, ".")
+		if !ok || section == "" || key == "" {
+			return fmt.Errorf("config key %q must be section.key", k)
+		}
+		encoded, err := tomlValue(values[k])
+		if err != nil {
+			return fmt.Errorf("could not encode %s: %w", k, err)
+		}
+		lines, err = setKey(lines, section, key+" = "+encoded)
+		if err != nil {
+			return fmt.Errorf("could not set %s: %w", k, err)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".config-*.toml")
+	if err != nil {
+		return fmt.Errorf("failed to create config file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+// setKey replaces or adds the line "key = value" in section, keeping a
+// trailing comment of the replaced line.
+func setKey(lines []string, section, line string) ([]string, error) {
+	key, _, _ := strings.Cut(line, " =")
+
+	start := -1
+	for i, l := range lines {
+		if tableName(l) == section {
+			start = i
+			break
+		}
+	}
+	if start == -1 {
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+			lines = append(lines, "")
+		}
+		return append(lines, "["+section+"]", line), nil
+	}
+
+	last := start // last non-blank line of the section
+	for i := start + 1; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(trimmed, "[") {
+			break
+		}
+		if trimmed != "" {
+			last = i
+		}
+
+		name, value, ok := strings.Cut(trimmed, "=")
+		if !ok || strings.TrimSpace(name) != key {
+			continue
+		}
+		end, err := valueEnd(value)
+		if err != nil {
+			return nil, err
+		}
+		indent := lines[i][:len(lines[i])-len(strings.TrimLeft(lines[i], " \t"))]
+		lines[i] = indent + line
+		if comment := strings.TrimSpace(value[end:]); comment != "" {
+			lines[i] += " " + comment
+		}
+		return lines, nil
+	}
+
+	lines = append(lines[:last+1], append([]string{line}, lines[last+1:]...)...)
+	return lines, nil
+}
+
+// tableName returns the name of the table a "[name]" header line opens, or
+// "" for any other line.
+func tableName(line string) string {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "[") || strings.HasPrefix(line, "[[") {
+		return ""
+	}
+	name, _, ok := strings.Cut(line[1:], "]")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(name)
+}
+
+// valueEnd returns the length of the value at the start of s, i.e. up to a
+// comment. Values spanning several lines are not supported.
+func valueEnd(s string) (int, error) {
+	var quote byte
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if strings.HasPrefix(s[i:], `"""`) || strings.HasPrefix(s[i:], "'''") {
+				return 0, errors.New("multi-line strings are not supported")
+			}
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == '#' && depth == 0:
+			return i, nil
+		}
+	}
+	if quote != 0 || depth != 0 {
+		return 0, errors.New("values spanning several lines are not supported")
+	}
+	return len(s), nil
+}
+
+// tomlValue encodes v in the style of config.example.toml.
+func tomlValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return tomlString(v), nil
+	case []string:
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = tomlString(s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]", nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unsupported type %T", v)
+	}
+}
+
+func tomlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
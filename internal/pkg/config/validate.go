@@ -0,0 +1,171 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldError is a problem with the value of a config field.
+type FieldError struct {
+	Path    string // e.g. buffer.window_seconds or webhooks[0].url
+	Message string // e.g. must be between 5 and 60
+
+	// Line is the line of the config file that sets the field, or of its
+	// section if the field is not set there; 0 if unknown.
+	Line int
+	// Override is the environment variable or flag that set the field, if any.
+	Override string
+}
+
+func (e *FieldError) Error() string {
+	msg := e.Path + " " + e.Message
+	switch {
+	case e.Override != "":
+		return fmt.Sprintf("%s (set by %s)", msg, e.Override)
+	case e.Line > 0:
+		return fmt.Sprintf("line %d: %s", e.Line, msg)
+	}
+	return msg
+}
+
+// ValidationErrors are all the problems found validating a config.
+type ValidationErrors []*FieldError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+func (e *ValidationErrors) add(path, format string, args ...any) {
+	*e = append(*e, &FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e ValidationErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// locate sets where each field was set: the override that set it, or its
+// line in contents.
+func (e ValidationErrors) locate(contents []byte, env, flags Overrides) {
+	lines := fieldLines(contents)
+	for _, err := range e {
+		if _, ok := flags[err.Path]; ok {
+			err.Override = flagName(err.Path)
+			continue
+		}
+		if _, ok := env[err.Path]; ok {
+			err.Override = envName(err.Path)
+			continue
+		}
+		if line, ok := lines[err.Path]; ok {
+			err.Line = line
+			continue
+		}
+		// not set in the file: point at its section, if there is one
+		section := err.Path
+		if i := strings.LastIndex(section, "."); i >= 0 {
+			section = section[:i]
+		}
+		err.Line = lines[section]
+	}
+}
+
+// fieldLines maps the paths of the tables and keys in a TOML document to
+// the lines that set them, e.g. "buffer" and "buffer.window_seconds", or
+// "webhooks[0].url" for arrays of tables. Values spanning several lines
+// are mapped to their first line.
+func fieldLines(contents []byte) map[string]int {
+	lines := make(map[string]int)
+	tables := make(map[string]int) // arrays of tables seen so far
+
+	table := ""
+	depth := 0 // of brackets of a multi-line array
+	for i, line := range strings.Split(string(contents), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if depth > 0 {
+			depth += bracketDepth(trimmed)
+			continue
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if name, ok := strings.CutPrefix(trimmed, "[["); ok {
+			name, _, _ = strings.Cut(name, "]]")
+			name = strings.TrimSpace(name)
+			table = fmt.Sprintf("%s[%d]", name, tables[name])
+			tables[name]++
+			lines[table] = i + 1
+			continue
+		}
+		if name := tableName(trimmed); name != "" {
+			table = name
+			lines[table] = i + 1
+			continue
+		}
+
+		key, value, ok := strings.Cut(trimmed, "=")
+		if !ok {
+			continue
+		}
+		path := dottedKey(key)
+		if table != "" {
+			path = table + "." + path
+		}
+		if _, seen := lines[path]; !seen {
+			lines[path] = i + 1
+		}
+		depth = bracketDepth(value)
+	}
+	return lines
+}
+
+// dottedKey normalises a possibly dotted or quoted key, e.g. `buffer . "x"`.
+func dottedKey(key string) string {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+// bracketDepth returns how many more array brackets s opens than it closes,
+// ignoring strings and comments.
+func bracketDepth(s string) int {
+	var quote byte
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return depth
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth
+}
@@ -0,0 +1,21 @@
+// Package webhooktmpl parses webhook body templates, for both config
+// validation and delivery.
+package webhooktmpl
+
+import (
+	"encoding/json"
+	"text/template"
+)
+
+// Funcs are the functions webhook body templates can call.
+var Funcs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// Parse parses a webhook body template with Funcs.
+func Parse(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(Funcs).Parse(text)
+}
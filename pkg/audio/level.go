@@ -0,0 +1,71 @@
+package audio
+
+import (
+	"math"
+	"time"
+)
+
+// MinDBFS is the level reported for silence; 16-bit audio has about
+// 96 dB of dynamic range.
+const MinDBFS = -96.0
+
+// Levels returns the RMS and peak level of 16-bit samples in dBFS.
+func Levels(samples []int16) (rms, peak float64) {
+	if len(samples) == 0 {
+		return MinDBFS, MinDBFS
+	}
+
+	var sumSq float64
+	var maxAbs float64
+	for _, s := range samples {
+		v := math.Abs(float64(s))
+		sumSq += v * v
+		maxAbs = max(maxAbs, v)
+	}
+	return toDBFS(math.Sqrt(sumSq / float64(len(samples)))), toDBFS(maxAbs)
+}
+
+func toDBFS(amplitude float64) float64 {
+	if amplitude <= 0 {
+		return MinDBFS
+	}
+	return max(MinDBFS, 20*math.Log10(amplitude/32768))
+}
+
+// Gate fires once when the level rises to the threshold and re-arms only
+// after the level falls below threshold minus hysteresis and the cooldown
+// since the last firing has passed.
+type Gate struct {
+	threshold  float64
+	hysteresis float64
+	cooldown   time.Duration
+
+	armed bool
+	last  time.Time
+}
+
+func NewGate(threshold, hysteresis float64, cooldown time.Duration) *Gate {
+	return &Gate{
+		threshold:  threshold,
+		hysteresis: hysteresis,
+		cooldown:   cooldown,
+		armed:      true,
+	}
+}
+
+// Update feeds a level measured at now and reports whether the gate fired.
+func (g *Gate) Update(level float64, now time.Time) bool {
+	if !g.armed {
+		if level < g.threshold-g.hysteresis && now.Sub(g.last) >= g.cooldown {
+			g.armed = true
+		}
+		return false
+	}
+
+	if level >= g.threshold {
+		g.armed = false
+		g.last = now
+		return true
+	}
+	return false
+}
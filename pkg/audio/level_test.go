@@ -0,0 +1,81 @@
+package audio
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLevels(t *testing.T) {
+	sine := make([]int16, 4800)
+	for i := range sine {
+		sine[i] = int16(16384 * math.Sin(2*math.Pi*float64(i)/48))
+	}
+
+	tests := []struct {
+		name      string
+		samples   []int16
+		rms, peak float64
+	}{
+		{"empty", nil, MinDBFS, MinDBFS},
+		{"silence", make([]int16, 100), MinDBFS, MinDBFS},
+		{"full scale negative", []int16{-32768, -32768}, 0, 0},
+		{"half scale square", []int16{16384, -16384}, -6.02, -6.02},
+		{"half scale sine", sine, -9.03, -6.02},
+		{"single loud sample", append(make([]int16, 99), 32767), -20, 0},
+		{"rms below the floor", append(make([]int16, 63), 1), MinDBFS, -90.31},
+	}
+	for _, tt := range tests {
+		rms, peak := Levels(tt.samples)
+		if math.Abs(rms-tt.rms) > 0.01 || math.Abs(peak-tt.peak) > 0.01 {
+			t.Errorf("%s: got rms %.2f peak %.2f, want %.2f %.2f", tt.name, rms, peak, tt.rms, tt.peak)
+		}
+	}
+}
+
+func TestGate(t *testing.T) {
+	start := time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+	type step struct {
+		second int
+		level  float64
+		fire   bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"quiet", []step{{0, -40, false}, {1, -21, false}}},
+		{"at the threshold", []step{{0, -20, true}}},
+		{"fires once while loud", []step{{0, -10, true}, {1, -5, false}, {60, -10, false}}},
+		{
+			name: "re-arms below the hysteresis after the cooldown",
+			steps: []step{
+				{0, -10, true},
+				{40, -25, false}, // inside the hysteresis band
+				{41, -10, false},
+				{42, -27, false}, // re-armed
+				{43, -15, true},
+			},
+		},
+		{
+			name: "quiet during the cooldown does not re-arm",
+			steps: []step{
+				{0, -10, true},
+				{10, -60, false},
+				{20, -10, false},
+				{31, -60, false}, // re-armed
+				{32, -10, true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGate(-20, 6, 30*time.Second)
+			for _, s := range tt.steps {
+				if got := g.Update(s.level, start.Add(time.Duration(s.second)*time.Second)); got != s.fire {
+					t.Errorf("%ds at %v dBFS: got fired %t, want %t", s.second, s.level, got, s.fire)
+				}
+			}
+		})
+	}
+}
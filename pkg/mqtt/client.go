@@ -0,0 +1,359 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrClosed = errors.New("mqtt connection closed")
+
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+	Dup     bool // set when a QoS 1 message is sent again
+}
+
+type Handler func(Message)
+
+type Options struct {
+	Broker    string // tcp://host:port, ssl://host:port or tls://host:port
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	Will      *Message
+	TLSConfig *tls.Config
+}
+
+// Client is a minimal MQTT 3.1.1 client supporting QoS 0 and 1,
+// retained messages and a last will. It does not reconnect on its own;
+// callers watch Done, dial again and send the QoS 1 messages that were not
+// acknowledged again, with Dup set.
+type Client struct {
+	logger *slog.Logger
+	opts   Options
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	nextID   uint16
+	handlers map[string]Handler
+	subAcks  map[uint16]chan error
+	pubAcks  map[uint16]chan struct{}
+
+	lastRecv  atomic.Int64
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+func Dial(ctx context.Context, logger *slog.Logger, opts Options) (*Client, error) {
+	u, err := url.Parse(opts.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse broker address: %w", err)
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{}
+	switch u.Scheme {
+	case "tcp":
+		conn, err = dialer.DialContext(ctx, "tcp", hostPort(u, "1883"))
+	case "ssl", "tls":
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: opts.TLSConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", hostPort(u, "8883"))
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to broker: %w", err)
+	}
+
+	c := &Client{
+		logger:   logger.With("component", "mqtt"),
+		opts:     opts,
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		handlers: make(map[string]Handler),
+		subAcks:  make(map[uint16]chan error),
+		pubAcks:  make(map[uint16]chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if err := c.handshake(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.readLoop()
+	go c.keepAlive()
+	return c, nil
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	return u.Host
+}
+
+func (c *Client) handshake(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	if err := c.write(connectPacket(c.opts, uint16(c.opts.KeepAlive/time.Second))); err != nil {
+		return fmt.Errorf("could not send connect: %w", err)
+	}
+
+	p, err := readPacket(c.reader)
+	if err != nil {
+		return fmt.Errorf("could not read connack: %w", err)
+	}
+	if p.kind != packetConnAck || len(p.body) < 2 {
+		return fmt.Errorf("unexpected packet type %d during handshake", p.kind)
+	}
+	if code := p.body[1]; code != 0 {
+		return fmt.Errorf("broker refused connection: %s", connAckErrors[code])
+	}
+
+	c.lastRecv.Store(time.Now().UnixNano())
+	return nil
+}
+
+// Subscribe registers handler for messages matching filter and waits for
+// the broker to acknowledge. Handlers run on the read loop and must not block.
+func (c *Client) Subscribe(ctx context.Context, filter string, qos byte, handler Handler) error {
+	ack := make(chan error, 1)
+
+	c.mu.Lock()
+	id := c.packetID()
+	c.handlers[filter] = handler
+	c.subAcks[id] = ack
+	c.mu.Unlock()
+
+	if err := c.write(subscribePacket(filter, qos, id)); err != nil {
+		return fmt.Errorf("could not send subscribe: %w", err)
+	}
+
+	select {
+	case err := <-ack:
+		return err
+	case <-c.done:
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Publish sends msg. For QoS 1 it waits for the broker to acknowledge
+// the message, and returns an error if the connection is lost or ctx is
+// done first, in which case the message may or may not have been delivered.
+func (c *Client) Publish(ctx context.Context, msg Message) error {
+	if msg.QoS == 0 {
+		return c.write(publishPacket(msg, 0))
+	}
+
+	ack := make(chan struct{})
+	c.mu.Lock()
+	id := c.packetID()
+	c.pubAcks[id] = ack
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pubAcks, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(publishPacket(msg, id)); err != nil {
+		return fmt.Errorf("could not send publish: %w", err)
+	}
+
+	select {
+	case <-ack:
+		return nil
+	case <-c.done:
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) Disconnect() error {
+	err := c.write(packet{kind: packetDisconnect})
+	c.close(ErrClosed)
+	return err
+}
+
+// Done is closed once the connection is lost or closed.
+func (c *Client) Done() <-chan struct{} { return c.done }
+
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *Client) packetID() uint16 {
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	return c.nextID
+}
+
+func (c *Client) write(p packet) error {
+	data, err := p.encode()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.conn.Write(data); err != nil {
+		c.close(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) close(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+func (c *Client) readLoop() {
+	for {
+		p, err := readPacket(c.reader)
+		if err != nil {
+			c.close(fmt.Errorf("could not read packet: %w", err))
+			return
+		}
+		c.lastRecv.Store(time.Now().UnixNano())
+
+		switch p.kind {
+		case packetPublish:
+			c.handlePublish(p)
+		case packetSubAck:
+			c.handleSubAck(p)
+		case packetPubAck:
+			c.handlePubAck(p)
+		case packetPingResp:
+		default:
+			c.logger.Debug("Ignoring unexpected packet", "type", p.kind)
+		}
+	}
+}
+
+func (c *Client) handlePublish(p packet) {
+	msg, id, err := parsePublish(p)
+	if err != nil {
+		c.logger.Warn("Dropping malformed publish", "error", err)
+		return
+	}
+	if msg.QoS > 0 {
+		if err := c.write(idPacket(packetPubAck, id)); err != nil {
+			return
+		}
+	}
+
+	c.mu.Lock()
+	var handler Handler
+	for filter, h := range c.handlers {
+		if topicMatches(filter, msg.Topic) {
+			handler = h
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if handler != nil {
+		handler(msg)
+	}
+}
+
+func (c *Client) handlePubAck(p packet) {
+	if len(p.body) < 2 {
+		return
+	}
+	id := binary.BigEndian.Uint16(p.body)
+
+	c.mu.Lock()
+	ack, ok := c.pubAcks[id]
+	delete(c.pubAcks, id)
+	c.mu.Unlock()
+	if ok {
+		close(ack)
+	}
+}
+
+func (c *Client) handleSubAck(p packet) {
+	if len(p.body) < 3 {
+		return
+	}
+	id := binary.BigEndian.Uint16(p.body)
+
+	c.mu.Lock()
+	ack, ok := c.subAcks[id]
+	delete(c.subAcks, id)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if p.body[2] == 0x80 {
+		ack <- errors.New("broker rejected subscription")
+		return
+	}
+	ack <- nil
+}
+
+func (c *Client) keepAlive() {
+	if c.opts.KeepAlive <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.opts.KeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, c.lastRecv.Load()))
+			if idle > c.opts.KeepAlive*3/2 {
+				c.close(errors.New("broker keepalive timeout"))
+				return
+			}
+			if err := c.write(packet{kind: packetPingReq}); err != nil {
+				return
+			}
+		}
+	}
+}
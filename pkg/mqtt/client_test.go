@@ -0,0 +1,200 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// startBroker runs an embedded broker and returns its address.
+func startBroker(t *testing.T) (*mochi.Server, string) {
+	t.Helper()
+
+	server := mochi.New(&mochi.Options{InlineClient: true, Logger: testLogger})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(listeners.NewNet("test", l)); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return server, "tcp://" + l.Addr().String()
+}
+
+func dial(t *testing.T, broker, clientID string, will *Message) *Client {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, testLogger, Options{Broker: broker, ClientID: clientID, KeepAlive: 30 * time.Second, Will: will})
+	if err != nil {
+		t.Fatalf("could not dial broker: %v", err)
+	}
+	t.Cleanup(func() { c.Disconnect() })
+	return c
+}
+
+func receive(t *testing.T, messages <-chan Message) Message {
+	t.Helper()
+
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+		return Message{}
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	_, broker := startBroker(t)
+	ctx := context.Background()
+
+	subscriber := dial(t, broker, "subscriber", nil)
+	messages := make(chan Message, 1)
+	err := subscriber.Subscribe(ctx, "tidskott/+/command", 1, func(msg Message) { messages <- msg })
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	publisher := dial(t, broker, "publisher", nil)
+	err = publisher.Publish(ctx, Message{Topic: "tidskott/dev/command", Payload: []byte("snapshot"), QoS: 1})
+	if err != nil {
+		t.Fatalf("could not publish: %v", err)
+	}
+
+	msg := receive(t, messages)
+	if msg.Topic != "tidskott/dev/command" || string(msg.Payload) != "snapshot" {
+		t.Errorf("got %s %q, want tidskott/dev/command \"snapshot\"", msg.Topic, msg.Payload)
+	}
+}
+
+func TestRetainedMessage(t *testing.T) {
+	_, broker := startBroker(t)
+	ctx := context.Background()
+
+	publisher := dial(t, broker, "device", nil)
+	err := publisher.Publish(ctx, Message{Topic: "tidskott/dev/status", Payload: []byte("online"), QoS: 1, Retain: true})
+	if err != nil {
+		t.Fatalf("could not publish: %v", err)
+	}
+
+	// subscribed after the publish: only the retained message is delivered
+	subscriber := dial(t, broker, "subscriber", nil)
+	messages := make(chan Message, 1)
+	if err := subscriber.Subscribe(ctx, "tidskott/dev/status", 1, func(msg Message) { messages <- msg }); err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	msg := receive(t, messages)
+	if string(msg.Payload) != "online" || !msg.Retain {
+		t.Errorf("got %q retain=%t, want retained \"online\"", msg.Payload, msg.Retain)
+	}
+}
+
+func TestWillPublishedOnConnectionLoss(t *testing.T) {
+	server, broker := startBroker(t)
+
+	messages := make(chan string, 1)
+	err := server.Subscribe("tidskott/dev/status", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		messages <- string(pk.Payload)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := dial(t, broker, "device", &Message{Topic: "tidskott/dev/status", Payload: []byte("offline"), QoS: 1, Retain: true})
+	// drop the connection without a disconnect packet, as a power loss would
+	c.conn.Close()
+
+	select {
+	case payload := <-messages:
+		if payload != "offline" {
+			t.Errorf("got will %q, want \"offline\"", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for last will")
+	}
+}
+
+func TestPublishWaitsForAck(t *testing.T) {
+	// a broker that accepts the connection but never acknowledges publishes
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan packet, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		if _, err := readPacket(r); err != nil {
+			return
+		}
+		data, _ := packet{kind: packetConnAck, body: []byte{0, 0}}.encode()
+		conn.Write(data)
+		for {
+			p, err := readPacket(r)
+			if err != nil {
+				return
+			}
+			if p.kind == packetPublish {
+				received <- p
+			}
+		}
+	}()
+
+	c := dial(t, "tcp://"+l.Addr().String(), "device", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = c.Publish(ctx, Message{Topic: "tidskott/dev/events", Payload: []byte("{}"), QoS: 1, Dup: true})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	p := <-received
+	msg, _, err := parsePublish(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Dup || msg.QoS != 1 {
+		t.Errorf("got dup=%t qos=%d, want dup=true qos=1", msg.Dup, msg.QoS)
+	}
+}
+
+func TestPublishFailsWhenConnectionLost(t *testing.T) {
+	_, broker := startBroker(t)
+
+	c := dial(t, broker, "device", nil)
+	c.conn.Close()
+	<-c.Done()
+
+	err := c.Publish(context.Background(), Message{Topic: "tidskott/dev/events", Payload: []byte("{}"), QoS: 1})
+	if err == nil {
+		t.Fatal("publish on a lost connection succeeded")
+	}
+}
@@ -0,0 +1,215 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// control packet types (MQTT 3.1.1, section 2.2.1)
+const (
+	packetConnect    byte = 1
+	packetConnAck    byte = 2
+	packetPublish    byte = 3
+	packetPubAck     byte = 4
+	packetSubscribe  byte = 8
+	packetSubAck     byte = 9
+	packetPingReq    byte = 12
+	packetPingResp   byte = 13
+	packetDisconnect byte = 14
+
+	maxRemainingBytes = 268435455
+)
+
+var connAckErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func (p packet) encode() ([]byte, error) {
+	if len(p.body) > maxRemainingBytes {
+		return nil, fmt.Errorf("packet too large: %d bytes", len(p.body))
+	}
+
+	out := []byte{p.kind<<4 | p.flags&0x0f}
+
+	// remaining length is encoded 7 bits at a time, msb flags continuation
+	n := len(p.body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(out, p.body...), nil
+}
+
+func readPacket(r *bufio.Reader) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+
+	var length, multiplier int = 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return packet{}, errors.New("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+	return packet{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendBytes(b, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("short string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("short string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+func connectPacket(opts Options, keepAliveSeconds uint16) packet {
+	var flags byte = 0x02 // clean session
+	if opts.Will != nil {
+		flags |= 0x04 | opts.Will.QoS<<3
+		if opts.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+		if opts.Password != "" {
+			flags |= 0x40
+		}
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, keepAliveSeconds)
+	body = appendString(body, opts.ClientID)
+	if opts.Will != nil {
+		body = appendString(body, opts.Will.Topic)
+		body = appendBytes(body, opts.Will.Payload)
+	}
+	if opts.Username != "" {
+		body = appendString(body, opts.Username)
+		if opts.Password != "" {
+			body = appendString(body, opts.Password)
+		}
+	}
+	return packet{kind: packetConnect, body: body}
+}
+
+func publishPacket(msg Message, id uint16) packet {
+	flags := msg.QoS << 1
+	if msg.Retain {
+		flags |= 0x01
+	}
+	if msg.Dup && msg.QoS > 0 {
+		flags |= 0x08
+	}
+
+	body := appendString(nil, msg.Topic)
+	if msg.QoS > 0 {
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	return packet{kind: packetPublish, flags: flags, body: append(body, msg.Payload...)}
+}
+
+func parsePublish(p packet) (Message, uint16, error) {
+	msg := Message{
+		QoS:    (p.flags >> 1) & 0x03,
+		Retain: p.flags&0x01 != 0,
+		Dup:    p.flags&0x08 != 0,
+	}
+
+	topic, rest, err := readString(p.body)
+	if err != nil {
+		return Message{}, 0, fmt.Errorf("could not read topic: %w", err)
+	}
+	msg.Topic = topic
+
+	var id uint16
+	if msg.QoS > 0 {
+		if len(rest) < 2 {
+			return Message{}, 0, errors.New("missing packet identifier")
+		}
+		id = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	msg.Payload = rest
+	return msg, id, nil
+}
+
+func subscribePacket(topic string, qos byte, id uint16) packet {
+	body := binary.BigEndian.AppendUint16(nil, id)
+	body = appendString(body, topic)
+	body = append(body, qos)
+	return packet{kind: packetSubscribe, flags: 0x02, body: body}
+}
+
+func idPacket(kind byte, id uint16) packet {
+	return packet{kind: kind, body: binary.BigEndian.AppendUint16(nil, id)}
+}
+
+// topicMatches reports whether topic matches the subscription filter,
+// honouring the single (+) and multi (#) level wildcards.
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,354 @@
+// Package s3 is a small client for S3-compatible object storage (AWS S3,
+// MinIO, ...). It supports single-request and multipart uploads signed with
+// AWS Signature Version 4, which is all tidskott-pi needs.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MinPartSize is the smallest part S3 accepts in a multipart upload,
+	// except for the last one.
+	MinPartSize = 5 << 20
+
+	DefaultPartSize = 8 << 20
+
+	// MaxMetadataSize is the most user metadata S3 accepts on an object:
+	// the keys and values of its x-amz-meta-* headers, in bytes.
+	MaxMetadataSize = 2 << 10
+)
+
+type Config struct {
+	Endpoint        string // e.g. https://s3.eu-north-1.amazonaws.com or http://minio:9000
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// PathStyle addresses objects as endpoint/bucket/key rather than
+	// bucket.endpoint/key. MinIO needs it.
+	PathStyle bool
+	PartSize  int64
+}
+
+type Client struct {
+	cfg        Config
+	endpoint   *url.URL
+	httpClient *http.Client
+}
+
+// New returns a client for cfg. Credentials missing from cfg are taken from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+func New(cfg Config, httpClient *http.Client) (*Client, error) {
+	if cfg.AccessKeyID == "" {
+		cfg.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		cfg.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		cfg.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, errors.New("missing access key")
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("missing bucket")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = DefaultPartSize
+	}
+	if cfg.PartSize < MinPartSize {
+		return nil, fmt.Errorf("part size must be at least %d bytes", MinPartSize)
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", cfg.Endpoint)
+	}
+
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{cfg: cfg, endpoint: endpoint, httpClient: httpClient}, nil
+}
+
+// Error is an error response returned by the storage service.
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3: status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Retryable reports whether the request may succeed if sent again.
+func (e *Error) Retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests || e.Code == "RequestTimeTooSkewed"
+}
+
+// UploadFile stores the file at path under key. Files larger than the part
+// size are sent as a multipart upload, which is aborted on failure.
+// metadata is stored as x-amz-meta-* headers.
+func (c *Client) UploadFile(ctx context.Context, key, path, contentType string, metadata map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat file: %w", err)
+	}
+
+	if info.Size() <= c.cfg.PartSize {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return fmt.Errorf("could not read file: %w", err)
+		}
+		return c.PutObject(ctx, key, data, contentType, metadata)
+	}
+	return c.multipartUpload(ctx, key, f, contentType, metadata)
+}
+
+// PutObject stores data under key in a single request.
+func (c *Client) PutObject(ctx context.Context, key string, data []byte, contentType string, metadata map[string]string) error {
+	req, err := c.newRequest(ctx, http.MethodPut, key, nil, data)
+	if err != nil {
+		return err
+	}
+	setObjectHeaders(req, contentType, metadata)
+
+	resp, err := c.do(req, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) multipartUpload(ctx context.Context, key string, r io.Reader, contentType string, metadata map[string]string) error {
+	uploadID, err := c.createMultipartUpload(ctx, key, contentType, metadata)
+	if err != nil {
+		return err
+	}
+
+	if err := c.uploadParts(ctx, key, uploadID, r); err != nil {
+		// use a fresh context so the abort goes out even when ctx is done
+		abortCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if abortErr := c.abortMultipartUpload(abortCtx, key, uploadID); abortErr != nil {
+			return errors.Join(err, fmt.Errorf("could not abort multipart upload: %w", abortErr))
+		}
+		return err
+	}
+	return nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (c *Client) uploadParts(ctx context.Context, key, uploadID string, r io.Reader) error {
+	var parts []completedPart
+	buf := make([]byte, c.cfg.PartSize)
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("could not read part %d: %w", number, err)
+		}
+
+		etag, err := c.uploadPart(ctx, key, uploadID, number, buf[:n])
+		if err != nil {
+			return fmt.Errorf("could not upload part %d: %w", number, err)
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+
+		if n < len(buf) {
+			break
+		}
+	}
+	return c.completeMultipartUpload(ctx, key, uploadID, parts)
+}
+
+func (c *Client) createMultipartUpload(ctx context.Context, key, contentType string, metadata map[string]string) (string, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	setObjectHeaders(req, contentType, metadata)
+
+	resp, err := c.do(req, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not create multipart upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("could not decode multipart upload: %w", err)
+	}
+	if result.UploadID == "" {
+		return "", errors.New("empty multipart upload id")
+	}
+	return result.UploadID, nil
+}
+
+func (c *Client) uploadPart(ctx context.Context, key, uploadID string, number int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	req, err := c.newRequest(ctx, http.MethodPut, key, query, data)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.do(req, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", errors.New("missing ETag")
+	}
+	return etag, nil
+}
+
+func (c *Client) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return fmt.Errorf("could not encode parts: %w", err)
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := c.do(req, body)
+	if err != nil {
+		return fmt.Errorf("could not complete multipart upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// S3 may report a failure with a 200 status once the response has
+	// started, so the body has to be checked too.
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read response: %w", err)
+	}
+	if bytes.Contains(respBody, []byte("<Error>")) {
+		s3Err := &Error{StatusCode: resp.StatusCode}
+		_ = xml.Unmarshal(respBody, s3Err)
+		return fmt.Errorf("could not complete multipart upload: %w", s3Err)
+	}
+	return nil
+}
+
+func (c *Client) abortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Request, error) {
+	u := *c.endpoint
+	key = strings.TrimPrefix(key, "/")
+	basePath := strings.TrimSuffix(u.Path, "/")
+	if c.cfg.PathStyle {
+		u.Path = basePath + "/" + c.cfg.Bucket + "/" + key
+	} else {
+		u.Host = c.cfg.Bucket + "." + u.Host
+		u.Path = basePath + "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	req.ContentLength = int64(len(body))
+	return req, nil
+}
+
+// do signs and sends req, turning non-2xx responses into *Error.
+func (c *Client) do(req *http.Request, body []byte) (*http.Response, error) {
+	c.sign(req, hashHex(body), time.Now())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	s3Err := &Error{StatusCode: resp.StatusCode}
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	_ = xml.Unmarshal(respBody, s3Err)
+	return nil, s3Err
+}
+
+// setObjectHeaders sets the content type and user metadata. Header values
+// must be ASCII, so anything else is RFC 2047 encoded as S3 itself does.
+func setObjectHeaders(req *http.Request, contentType string, metadata map[string]string) {
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range metadata {
+		req.Header.Set("X-Amz-Meta-"+k, encodeMetadata(v))
+	}
+}
+
+// MetadataSize returns the size of metadata as S3 counts it against
+// MaxMetadataSize, with the values encoded as they are sent.
+func MetadataSize(metadata map[string]string) int {
+	n := 0
+	for k, v := range metadata {
+		n += len(k) + len(encodeMetadata(v))
+	}
+	return n
+}
+
+func encodeMetadata(v string) string { return mime.QEncoding.Encode("utf-8", v) }
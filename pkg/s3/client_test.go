@@ -0,0 +1,263 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type request struct {
+	method string
+	path   string
+	query  string
+	header http.Header
+	body   []byte
+}
+
+// fakeS3 records requests and answers them as S3 would, unless fail returns
+// a status for a request.
+type fakeS3 struct {
+	t    *testing.T
+	fail func(r *http.Request) int
+
+	mu       sync.Mutex
+	requests []request
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.t.Errorf("could not read request body: %v", err)
+		return
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, request{r.Method, r.URL.EscapedPath(), r.URL.RawQuery, r.Header.Clone(), body})
+	f.mu.Unlock()
+
+	if got, want := r.Header.Get("X-Amz-Content-Sha256"), hashHex(body); got != want {
+		f.t.Errorf("%s %s: got payload hash %s, want %s", r.Method, r.URL, got, want)
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		f.t.Errorf("%s %s: unsigned request", r.Method, r.URL)
+	}
+
+	if f.fail != nil {
+		if status := f.fail(r); status != 0 {
+			w.WriteHeader(status)
+			fmt.Fprint(w, "<Error><Code>InternalError</Code><Message>We encountered an internal error.</Message></Error>")
+			return
+		}
+	}
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>")
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		w.Header().Set("ETag", `"etag-`+query.Get("partNumber")+`"`)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		fmt.Fprint(w, "<CompleteMultipartUploadResult><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	calls := make([]string, len(f.requests))
+	for i, r := range f.requests {
+		calls[i] = r.method + " " + r.path + "?" + r.query
+	}
+	return calls
+}
+
+func newTestClient(t *testing.T, fake *fakeS3) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	c, err := New(Config{
+		Endpoint:        server.URL,
+		Bucket:          "bucket",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+		PartSize:        MinPartSize,
+	}, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func writeFile(t *testing.T, size int) (string, []byte) {
+	t.Helper()
+
+	data := bytes.Repeat([]byte("0123456789"), size/10+1)[:size]
+	path := filepath.Join(t.TempDir(), "clip.mp4")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestUploadFileSingleRequest(t *testing.T) {
+	fake := &fakeS3{t: t}
+	c := newTestClient(t, fake)
+	path, data := writeFile(t, 1000)
+
+	err := c.UploadFile(context.Background(), "dev/2024/01/02/a b.mp4", path, "video/mp4", map[string]string{"device_name": "Främre dörr"})
+	if err != nil {
+		t.Fatalf("could not upload: %v", err)
+	}
+
+	if got, want := fake.calls(), []string{"PUT /bucket/dev/2024/01/02/a%20b.mp4?"}; !slices.Equal(got, want) {
+		t.Fatalf("got requests %q, want %q", got, want)
+	}
+	r := fake.requests[0]
+	if !bytes.Equal(r.body, data) {
+		t.Error("body differs from the file")
+	}
+	if got := r.header.Get("Content-Type"); got != "video/mp4" {
+		t.Errorf("got Content-Type %q, want video/mp4", got)
+	}
+	if got, want := r.header.Get("X-Amz-Meta-Device_name"), "=?utf-8?q?Fr=C3=A4mre_d=C3=B6rr?="; got != want {
+		t.Errorf("got metadata %q, want %q", got, want)
+	}
+}
+
+func TestUploadFileMultipart(t *testing.T) {
+	fake := &fakeS3{t: t}
+	c := newTestClient(t, fake)
+	path, data := writeFile(t, 2*MinPartSize+100)
+
+	if err := c.UploadFile(context.Background(), "clip.mp4", path, "video/mp4", nil); err != nil {
+		t.Fatalf("could not upload: %v", err)
+	}
+
+	want := []string{
+		"POST /bucket/clip.mp4?uploads=",
+		"PUT /bucket/clip.mp4?partNumber=1&uploadId=upload-1",
+		"PUT /bucket/clip.mp4?partNumber=2&uploadId=upload-1",
+		"PUT /bucket/clip.mp4?partNumber=3&uploadId=upload-1",
+		"POST /bucket/clip.mp4?uploadId=upload-1",
+	}
+	if got := fake.calls(); !slices.Equal(got, want) {
+		t.Fatalf("got requests %q, want %q", got, want)
+	}
+
+	var uploaded []byte
+	for _, r := range fake.requests[1:4] {
+		uploaded = append(uploaded, r.body...)
+	}
+	if !bytes.Equal(uploaded, data) {
+		t.Error("parts differ from the file")
+	}
+
+	var complete struct {
+		Parts []completedPart `xml:"Part"`
+	}
+	if err := xml.Unmarshal(fake.requests[4].body, &complete); err != nil {
+		t.Fatalf("could not decode complete request: %v", err)
+	}
+	wantParts := []completedPart{{1, `"etag-1"`}, {2, `"etag-2"`}, {3, `"etag-3"`}}
+	if fmt.Sprint(complete.Parts) != fmt.Sprint(wantParts) {
+		t.Errorf("got parts %v, want %v", complete.Parts, wantParts)
+	}
+}
+
+func TestUploadFileAbortsFailedMultipart(t *testing.T) {
+	fake := &fakeS3{t: t, fail: func(r *http.Request) int {
+		if r.URL.Query().Get("partNumber") == "2" {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}}
+	c := newTestClient(t, fake)
+	path, _ := writeFile(t, 2*MinPartSize)
+
+	err := c.UploadFile(context.Background(), "clip.mp4", path, "video/mp4", nil)
+	var s3Err *Error
+	if !errors.As(err, &s3Err) || s3Err.Code != "InternalError" || !s3Err.Retryable() {
+		t.Fatalf("got %v, want a retryable InternalError", err)
+	}
+
+	want := []string{
+		"POST /bucket/clip.mp4?uploads=",
+		"PUT /bucket/clip.mp4?partNumber=1&uploadId=upload-1",
+		"PUT /bucket/clip.mp4?partNumber=2&uploadId=upload-1",
+		"DELETE /bucket/clip.mp4?uploadId=upload-1",
+	}
+	if got := fake.calls(); !slices.Equal(got, want) {
+		t.Fatalf("got requests %q, want %q", got, want)
+	}
+}
+
+func TestUploadFileCompleteErrorWithOK(t *testing.T) {
+	fake := &fakeS3{t: t}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Query().Has("uploadId") {
+			io.Copy(io.Discard, r.Body)
+			// S3 reports some failures after it has sent a 200 status
+			fmt.Fprint(w, "<Error><Code>InternalError</Code><Message>retry</Message></Error>")
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	c, err := New(Config{
+		Endpoint:        server.URL,
+		Bucket:          "bucket",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+		PartSize:        MinPartSize,
+	}, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _ := writeFile(t, MinPartSize+1)
+
+	err = c.UploadFile(context.Background(), "clip.mp4", path, "video/mp4", nil)
+	var s3Err *Error
+	if !errors.As(err, &s3Err) || s3Err.Code != "InternalError" {
+		t.Fatalf("got %v, want InternalError", err)
+	}
+	if calls := fake.calls(); calls[len(calls)-1] != "DELETE /bucket/clip.mp4?uploadId=upload-1" {
+		t.Errorf("multipart upload not aborted, requests %q", calls)
+	}
+}
+
+func TestVirtualHostedStyle(t *testing.T) {
+	c, err := New(Config{
+		Endpoint:        "https://s3.eu-north-1.amazonaws.com",
+		Bucket:          "bucket",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := c.newRequest(context.Background(), http.MethodPut, "/dev/clip.mp4", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := req.URL.String(), "https://bucket.s3.eu-north-1.amazonaws.com/dev/clip.mp4"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,204 @@
+package tamper
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+type Alert string
+
+const (
+	AlertCovered   Alert = "covered"
+	AlertDefocused Alert = "defocused"
+	AlertMoved     Alert = "moved"
+)
+
+// Frame is an 8-bit grayscale image.
+type Frame struct {
+	Width  int
+	Height int
+	Pix    []uint8
+}
+
+func NewFrame(width, height int, pix []uint8) (*Frame, error) {
+	if width <= 0 || height <= 0 || len(pix) != width*height {
+		return nil, fmt.Errorf("invalid frame: %dx%d with %d bytes", width, height, len(pix))
+	}
+	return &Frame{Width: width, Height: height, Pix: pix}, nil
+}
+
+type Thresholds struct {
+	MinBrightness float64 // mean luma below this means the lens is covered
+	MinContrast   float64 // luma standard deviation below this means the view is blocked
+	DefocusRatio  float64 // sharpness below this fraction of the reference means defocused
+	MinSimilarity float64 // correlation with the reference below this means the camera moved
+}
+
+type Result struct {
+	Brightness float64
+	Contrast   float64
+	Sharpness  float64
+	Similarity float64
+	Alerts     []Alert
+	Rebased    bool // the frame became the new reference
+}
+
+// Detector compares frames against a reference taken from the first clean
+// frame. The reference slowly follows clean frames to absorb lighting changes,
+// and is replaced once the camera points at a new, steady scene.
+type Detector struct {
+	thresholds   Thresholds
+	reference    []float64
+	refWidth     int
+	refHeight    int
+	refSharpness float64
+
+	previous    []uint8 // last frame while moved
+	steadyCount int     // consecutive moved frames similar to the previous one
+}
+
+const (
+	// referenceWeight is how much each clean frame contributes to the reference.
+	referenceWeight = 0.05
+	// rebaseFrames is how many consecutive frames of a moved camera must show
+	// the same scene before it becomes the reference, e.g. after the camera
+	// was deliberately repositioned.
+	rebaseFrames = 10
+)
+
+func NewDetector(thresholds Thresholds) *Detector {
+	return &Detector{thresholds: thresholds}
+}
+
+func (d *Detector) Analyze(f *Frame) Result {
+	res := Result{Similarity: 1}
+	res.Brightness, res.Contrast = meanStdDev(f.Pix)
+	res.Sharpness = Sharpness(f)
+
+	// a covered lens also fails the sharpness and similarity checks,
+	// so don't report those on top of it
+	if res.Brightness < d.thresholds.MinBrightness || res.Contrast < d.thresholds.MinContrast {
+		res.Alerts = append(res.Alerts, AlertCovered)
+		return res
+	}
+
+	if d.reference == nil || d.refWidth != f.Width || d.refHeight != f.Height {
+		d.setReference(f, res.Sharpness)
+		return res
+	}
+
+	res.Similarity = correlation(d.reference, f.Pix)
+	if res.Sharpness < d.refSharpness*d.thresholds.DefocusRatio {
+		res.Alerts = append(res.Alerts, AlertDefocused)
+	}
+	if res.Similarity < d.thresholds.MinSimilarity {
+		res.Alerts = append(res.Alerts, AlertMoved)
+	}
+
+	if !slices.Equal(res.Alerts, []Alert{AlertMoved}) {
+		d.previous, d.steadyCount = nil, 0
+	} else if d.steady(f) {
+		d.setReference(f, res.Sharpness)
+		res.Alerts, res.Rebased = nil, true
+		return res
+	}
+
+	if len(res.Alerts) == 0 {
+		for i, p := range f.Pix {
+			d.reference[i] += (float64(p) - d.reference[i]) * referenceWeight
+		}
+		d.refSharpness += (res.Sharpness - d.refSharpness) * referenceWeight
+	}
+	return res
+}
+
+// steady reports whether the last rebaseFrames frames, f included, show the
+// same scene.
+func (d *Detector) steady(f *Frame) bool {
+	if d.previous != nil && correlation(toFloats(d.previous), f.Pix) >= d.thresholds.MinSimilarity {
+		d.steadyCount++
+	} else {
+		d.steadyCount = 1
+	}
+	d.previous = slices.Clone(f.Pix)
+	return d.steadyCount >= rebaseFrames
+}
+
+func (d *Detector) setReference(f *Frame, sharpness float64) {
+	d.previous, d.steadyCount = nil, 0
+	d.reference = toFloats(f.Pix)
+	d.refWidth, d.refHeight = f.Width, f.Height
+	d.refSharpness = sharpness
+}
+
+func toFloats(pix []uint8) []float64 {
+	out := make([]float64, len(pix))
+	for i, p := range pix {
+		out[i] = float64(p)
+	}
+	return out
+}
+
+// Sharpness is the variance of the Laplacian; blurred images have few
+// edges and therefore a low variance.
+func Sharpness(f *Frame) float64 {
+	if f.Width < 3 || f.Height < 3 {
+		return 0
+	}
+
+	var sum, sumSq float64
+	n := float64((f.Width - 2) * (f.Height - 2))
+	for y := 1; y < f.Height-1; y++ {
+		for x := 1; x < f.Width-1; x++ {
+			i := y*f.Width + x
+			lap := 4*float64(f.Pix[i]) -
+				float64(f.Pix[i-1]) - float64(f.Pix[i+1]) -
+				float64(f.Pix[i-f.Width]) - float64(f.Pix[i+f.Width])
+			sum += lap
+			sumSq += lap * lap
+		}
+	}
+	mean := sum / n
+	return sumSq/n - mean*mean
+}
+
+func meanStdDev(pix []uint8) (float64, float64) {
+	if len(pix) == 0 {
+		return 0, 0
+	}
+
+	var sum, sumSq float64
+	for _, p := range pix {
+		v := float64(p)
+		sum += v
+		sumSq += v * v
+	}
+	n := float64(len(pix))
+	mean := sum / n
+	return mean, math.Sqrt(max(0, sumSq/n-mean*mean))
+}
+
+// correlation is the normalized cross-correlation of two equally sized
+// images, in [-1, 1]. Flat images correlate with nothing.
+func correlation(ref []float64, pix []uint8) float64 {
+	n := float64(len(pix))
+	var refSum, pixSum float64
+	for i, p := range pix {
+		refSum += ref[i]
+		pixSum += float64(p)
+	}
+	refMean, pixMean := refSum/n, pixSum/n
+
+	var cov, refVar, pixVar float64
+	for i, p := range pix {
+		a, b := ref[i]-refMean, float64(p)-pixMean
+		cov += a * b
+		refVar += a * a
+		pixVar += b * b
+	}
+	if refVar == 0 || pixVar == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(refVar*pixVar)
+}
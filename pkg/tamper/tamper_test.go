@@ -0,0 +1,198 @@
+package tamper
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+const size = 32
+
+// scene is a textured test image; seed changes the texture.
+func scene(seed float64) *Frame {
+	pix := make([]uint8, size*size)
+	for y := range size {
+		for x := range size {
+			v := 128 + 60*math.Sin(float64(x)*0.9+seed)*math.Cos(float64(y)*0.7-seed) + 40*math.Sin(float64(x*y)*0.3+seed)
+			pix[y*size+x] = uint8(v)
+		}
+	}
+	return &Frame{Width: size, Height: size, Pix: pix}
+}
+
+// blur averages each pixel with its neighbours.
+func blur(f *Frame) *Frame {
+	out := slices.Clone(f.Pix)
+	for y := 1; y < f.Height-1; y++ {
+		for x := 1; x < f.Width-1; x++ {
+			var sum int
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					sum += int(f.Pix[(y+dy)*f.Width+x+dx])
+				}
+			}
+			out[y*f.Width+x] = uint8(sum / 9)
+		}
+	}
+	return &Frame{Width: f.Width, Height: f.Height, Pix: out}
+}
+
+func flat(v uint8) *Frame {
+	pix := make([]uint8, size*size)
+	for i := range pix {
+		pix[i] = v
+	}
+	return &Frame{Width: size, Height: size, Pix: pix}
+}
+
+func TestNewFrame(t *testing.T) {
+	tests := []struct {
+		width, height, n int
+		wantErr          bool
+	}{
+		{2, 2, 4, false},
+		{2, 2, 3, true},
+		{0, 2, 0, true},
+		{-1, 2, 2, true},
+	}
+	for _, tt := range tests {
+		_, err := NewFrame(tt.width, tt.height, make([]uint8, tt.n))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewFrame(%d, %d, %d bytes): got error %v, want error %t", tt.width, tt.height, tt.n, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMeanStdDev(t *testing.T) {
+	tests := []struct {
+		name         string
+		pix          []uint8
+		mean, stddev float64
+	}{
+		{"empty", nil, 0, 0},
+		{"flat", []uint8{100, 100, 100, 100}, 100, 0},
+		{"two levels", []uint8{0, 200, 0, 200}, 100, 100},
+		{"black and white", []uint8{0, 255}, 127.5, 127.5},
+	}
+	for _, tt := range tests {
+		mean, stddev := meanStdDev(tt.pix)
+		if mean != tt.mean || stddev != tt.stddev {
+			t.Errorf("%s: got %v %v, want %v %v", tt.name, mean, stddev, tt.mean, tt.stddev)
+		}
+	}
+}
+
+func TestSharpness(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *Frame
+		want  float64
+	}{
+		{"too small", &Frame{Width: 2, Height: 2, Pix: []uint8{0, 255, 255, 0}}, 0},
+		{"flat", flat(128), 0},
+		// the Laplacians of the two inner pixels are 40 and -10
+		{"single dot", &Frame{Width: 4, Height: 3, Pix: []uint8{
+			0, 0, 0, 0,
+			0, 10, 0, 0,
+			0, 0, 0, 0,
+		}}, 625},
+	}
+	for _, tt := range tests {
+		if got := Sharpness(tt.frame); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if sharp, blurred := Sharpness(scene(0)), Sharpness(blur(scene(0))); blurred >= sharp/2 {
+		t.Errorf("blurred sharpness %v not well below %v", blurred, sharp)
+	}
+}
+
+func TestCorrelation(t *testing.T) {
+	pix := []uint8{10, 20, 30, 40}
+	tests := []struct {
+		name string
+		ref  []uint8
+		pix  []uint8
+		want float64
+	}{
+		{"identical", pix, pix, 1},
+		{"brighter", pix, []uint8{110, 120, 130, 140}, 1},
+		{"inverted", pix, []uint8{40, 30, 20, 10}, -1},
+		{"flat", pix, []uint8{50, 50, 50, 50}, 0},
+		{"flat reference", []uint8{50, 50, 50, 50}, pix, 0},
+	}
+	for _, tt := range tests {
+		if got := correlation(toFloats(tt.ref), tt.pix); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDetector(t *testing.T) {
+	thresholds := Thresholds{
+		MinBrightness: 20,
+		MinContrast:   5,
+		DefocusRatio:  0.5,
+		MinSimilarity: 0.6,
+	}
+
+	tests := []struct {
+		name   string
+		frames []*Frame
+		want   []Alert // alerts of the last frame
+	}{
+		{"reference", []*Frame{scene(0)}, nil},
+		{"same scene", []*Frame{scene(0), scene(0)}, nil},
+		{"dark", []*Frame{scene(0), flat(5)}, []Alert{AlertCovered}},
+		{"blocked", []*Frame{scene(0), flat(128)}, []Alert{AlertCovered}},
+		{"covered before the reference", []*Frame{flat(0)}, []Alert{AlertCovered}},
+		{"defocused", []*Frame{scene(0), blur(scene(0))}, []Alert{AlertDefocused}},
+		{"moved", []*Frame{scene(0), scene(2)}, []Alert{AlertMoved}},
+		{"moved back", []*Frame{scene(0), scene(2), scene(0)}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDetector(thresholds)
+			var res Result
+			for _, f := range tt.frames {
+				res = d.Analyze(f)
+			}
+			if !slices.Equal(res.Alerts, tt.want) {
+				t.Errorf("got alerts %v, want %v (similarity %.2f, sharpness %.0f)", res.Alerts, tt.want, res.Similarity, res.Sharpness)
+			}
+		})
+	}
+}
+
+func TestDetectorRebase(t *testing.T) {
+	d := NewDetector(Thresholds{MinBrightness: 20, MinContrast: 5, DefocusRatio: 0.5, MinSimilarity: 0.6})
+	d.Analyze(scene(0))
+
+	for i := 1; i < rebaseFrames; i++ {
+		if res := d.Analyze(scene(2)); !slices.Equal(res.Alerts, []Alert{AlertMoved}) || res.Rebased {
+			t.Fatalf("frame %d: got alerts %v, rebased %t, want moved", i, res.Alerts, res.Rebased)
+		}
+	}
+	if res := d.Analyze(scene(2)); len(res.Alerts) != 0 || !res.Rebased {
+		t.Fatalf("got alerts %v, rebased %t, want the new scene as reference", res.Alerts, res.Rebased)
+	}
+	if res := d.Analyze(scene(2)); len(res.Alerts) != 0 {
+		t.Errorf("got alerts %v on the new reference", res.Alerts)
+	}
+	if res := d.Analyze(scene(0)); !slices.Equal(res.Alerts, []Alert{AlertMoved}) {
+		t.Errorf("got alerts %v for the old scene, want moved", res.Alerts)
+	}
+}
+
+func TestDetectorRebaseNeedsSteadyScene(t *testing.T) {
+	d := NewDetector(Thresholds{MinBrightness: 20, MinContrast: 5, DefocusRatio: 0.5, MinSimilarity: 0.6})
+	d.Analyze(scene(0))
+
+	// a camera that keeps moving never becomes the reference
+	for i := range 3 * rebaseFrames {
+		if res := d.Analyze(scene(float64(2 + i%2*2))); res.Rebased {
+			t.Fatalf("frame %d rebased on a changing scene", i)
+		}
+	}
+}